@@ -0,0 +1,183 @@
+package lsm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/utils"
+	"github.com/aixiasang/sqldb/wal"
+)
+
+// archivedWal 归档目录中的WAL文件
+type archivedWal struct {
+	logNum  uint32
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// archiveEnabled 是否开启了WAL归档
+func (l *LSM) archiveEnabled() bool {
+	return l.conf.WalArchiveDir != ""
+}
+
+// archiveWal 将已刷盘的WAL移动到归档目录，并清理超出保留时长或大小上限的归档。
+// 归档时间按配置的时钟记录为文件的修改时间，保留时长据此计算
+func (l *LSM) archiveWal(w *wal.Wal) error {
+	path := l.getArchivedWalPath(w.LogNum())
+	if err := w.Archive(path); err != nil {
+		return err
+	}
+	if err := l.touchArchived(path); err != nil {
+		return err
+	}
+	l.logger.Debug("归档WAL", "wal", w.LogNum(), "bytes", w.Size())
+	return l.purgeArchive()
+}
+
+// touchArchived 把归档的WAL的修改时间设为配置时钟的当前时间，作为归档时间
+func (l *LSM) touchArchived(path string) error {
+	now := l.conf.Clock.Now()
+	return os.Chtimes(path, now, now)
+}
+
+// loadArchive 启动时清理过期的归档，并从最新的归档中恢复序列号
+func (l *LSM) loadArchive() error {
+	if !l.archiveEnabled() {
+		return nil
+	}
+	if err := l.purgeArchive(); err != nil {
+		return err
+	}
+	archived, err := l.listArchivedWals()
+	if err != nil || len(archived) == 0 {
+		return err
+	}
+	newest := archived[len(archived)-1]
+	lastSeq, err := readLastSeq(newest.path, newest.logNum)
+	if err != nil {
+		return err
+	}
+	l.seq = max(l.seq, lastSeq)
+	return nil
+}
+
+// listArchivedWals 按日志编号升序列出归档目录中的WAL
+func (l *LSM) listArchivedWals() ([]*archivedWal, error) {
+	files, err := os.ReadDir(l.getArchiveDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	archived := make([]*archivedWal, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".wal" {
+			continue
+		}
+		logNum, err := utils.ParseWalPath(file.Name())
+		if err != nil {
+			return nil, err
+		}
+		info, err := file.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		archived = append(archived, &archivedWal{
+			logNum:  logNum,
+			path:    filepath.Join(l.getArchiveDir(), file.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+	sort.Slice(archived, func(i, j int) bool {
+		return archived[i].logNum < archived[j].logNum
+	})
+	return archived, nil
+}
+
+// purgeArchive 删除超过保留时长的归档WAL，再从最旧的开始删除直到总大小不超过上限
+func (l *LSM) purgeArchive() error {
+	if l.conf.WalArchiveTTL <= 0 && l.conf.WalArchiveSizeLimit <= 0 {
+		return nil
+	}
+	archived, err := l.listArchivedWals()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	var totalSize, purgedSize int64
+	purged := 0
+	kept := make([]*archivedWal, 0, len(archived))
+	now := l.conf.Clock.Now()
+	for _, a := range archived {
+		if l.conf.WalArchiveTTL > 0 && now.Sub(a.modTime) > l.conf.WalArchiveTTL {
+			if err := l.removeArchivedWal(a); err != nil {
+				errs = append(errs, err)
+			}
+			purged++
+			purgedSize += a.size
+			continue
+		}
+		kept = append(kept, a)
+		totalSize += a.size
+	}
+
+	if l.conf.WalArchiveSizeLimit > 0 {
+		for len(kept) > 0 && totalSize > l.conf.WalArchiveSizeLimit {
+			if err := l.removeArchivedWal(kept[0]); err != nil {
+				errs = append(errs, err)
+			}
+			purged++
+			purgedSize += kept[0].size
+			totalSize -= kept[0].size
+			kept = kept[1:]
+		}
+	}
+	if purged > 0 {
+		l.logger.Info("清理归档WAL", "files", purged, "bytes", purgedSize, "remaining_bytes", totalSize)
+	}
+	return errors.Join(errs...)
+}
+
+// removeArchivedWal 删除归档的WAL并登记通知，文件已不存在时忽略
+func (l *LSM) removeArchivedWal(a *archivedWal) error {
+	if err := os.Remove(a.path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	l.queueEvent(func(listener config.EventListener) {
+		listener.OnWALDeleted(config.WALFileInfo{LogNum: a.logNum, Path: a.path, Bytes: a.size, Reason: "purge"})
+	})
+	return nil
+}
+
+// readLastSeq 读取WAL文件中最后一条记录的序列号
+func readLastSeq(path string, logNum uint32) (uint64, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+
+	var lastSeq uint64
+	reader := wal.NewReader(fp, logNum)
+	for reader.Next() {
+		lastSeq = reader.Record().Seq
+	}
+	if err := reader.Err(); err != nil && !errors.Is(err, wal.ErrTruncated) {
+		return 0, err
+	}
+	return lastSeq, nil
+}
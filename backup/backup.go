@@ -0,0 +1,462 @@
+// Package backup 在本地目录中保存数据库的多个版本的增量备份。每次备份基于检查点，
+// SST文件写入后不再修改，按内容哈希保存在shared目录中由各备份共享；WAL和清单保存在备份自己的目录中
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aixiasang/sqldb/utils"
+)
+
+const (
+	sharedDir  = "shared"  // 按内容哈希保存的SST文件
+	privateDir = "private" // 各备份的WAL和清单，子目录名为备份ID
+	metaDir    = "meta"    // 各备份的元数据，文件名为备份ID
+	tmpDir     = "tmp"     // 创建中的检查点
+	tmpSuffix  = ".tmp"    // 写入中的文件的后缀
+	sstSuffix  = ".sst"
+)
+
+var (
+	ErrNotFound  = errors.New("backup: backup not found")            // 备份不存在
+	ErrCorrupted = errors.New("backup: backup file corrupted")       // 备份中的文件缺失、大小或校验和不符
+	ErrNotEmpty  = errors.New("backup: restore directory not empty") // 恢复的目标目录不为空
+)
+
+// Checkpointer 能创建检查点的数据库，*lsm.LSM满足该接口
+type Checkpointer interface {
+	Checkpoint(dir string) error
+}
+
+// Info 备份的概要信息
+type Info struct {
+	ID        uint32    // 备份ID，从1开始递增
+	Timestamp time.Time // 创建时间
+	Size      int64     // 备份中全部文件的总大小，包括与其他备份共享的文件
+	NumFiles  int       // 文件数
+}
+
+// fileMeta 备份中的一个文件
+type fileMeta struct {
+	Path     string `json:"path"`             // 相对于数据目录的路径
+	Shared   string `json:"shared,omitempty"` // shared目录中的文件名，为空表示保存在备份自己的目录中
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"` // SHA-256，十六进制
+}
+
+// backupMeta 备份的元数据，所有文件写入后最后写入，没有元数据的备份目录是未完成的备份
+type backupMeta struct {
+	ID        uint32     `json:"id"`
+	Timestamp time.Time  `json:"timestamp"`
+	Files     []fileMeta `json:"files"`
+}
+
+func (m *backupMeta) info() Info {
+	info := Info{ID: m.ID, Timestamp: m.Timestamp, NumFiles: len(m.Files)}
+	for _, file := range m.Files {
+		info.Size += file.Size
+	}
+	return info
+}
+
+// Engine 管理备份目录，方法可以并发调用
+type Engine struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewEngine 打开或创建备份目录dir，清理崩溃时未完成的备份
+func NewEngine(dir string) (*Engine, error) {
+	e := &Engine{dir: dir}
+	for _, sub := range []string{sharedDir, privateDir, metaDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(dir, tmpDir)); err != nil {
+		return nil, err
+	}
+	metas, err := e.readMetas()
+	if err != nil {
+		return nil, err
+	}
+	if err := e.removeUnreferenced(metas); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// CreateBackup 为db创建新的备份并返回其信息。与已有备份内容相同的SST文件只保存一份
+func (e *Engine) CreateBackup(db Checkpointer) (*Info, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	metas, err := e.readMetas()
+	if err != nil {
+		return nil, err
+	}
+	meta := &backupMeta{ID: 1, Timestamp: time.Now()}
+	if len(metas) > 0 {
+		meta.ID = metas[len(metas)-1].ID + 1
+	}
+
+	tmp := filepath.Join(e.dir, tmpDir)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	checkpoint := filepath.Join(tmp, strconv.FormatUint(uint64(meta.ID), 10))
+	if err := db.Checkpoint(checkpoint); err != nil {
+		return nil, fmt.Errorf("backup: checkpoint: %w", err)
+	}
+
+	private := e.privatePath(meta.ID)
+	err = filepath.WalkDir(checkpoint, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(checkpoint, path)
+		if err != nil {
+			return err
+		}
+		file, err := e.addFile(path, filepath.ToSlash(rel), private)
+		if err != nil {
+			return err
+		}
+		meta.Files = append(meta.Files, *file)
+		return nil
+	})
+	// 私有文件及其目录项持久化之后才发布元数据，否则崩溃后可能列出缺少文件的备份
+	if err == nil {
+		err = syncDirs(private)
+	}
+	if err == nil {
+		err = utils.SyncDir(filepath.Join(e.dir, privateDir))
+	}
+	if err == nil {
+		err = e.writeMeta(meta)
+	}
+	if err != nil {
+		// 只有新备份引用的共享文件也一并删除
+		os.RemoveAll(private)
+		e.removeUnreferenced(metas)
+		return nil, err
+	}
+	info := meta.info()
+	return &info, nil
+}
+
+// addFile 把检查点中的文件加入备份：SST文件放入shared目录，已有相同内容的文件时直接引用，其余文件复制到private目录
+func (e *Engine) addFile(path, rel, private string) (*fileMeta, error) {
+	checksum, size, err := fileChecksum(path)
+	if err != nil {
+		return nil, err
+	}
+	file := &fileMeta{Path: rel, Size: size, Checksum: checksum}
+	if !strings.HasSuffix(rel, sstSuffix) {
+		dst := filepath.Join(private, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return nil, err
+		}
+		return file, utils.CopyFile(path, dst)
+	}
+
+	file.Shared = fmt.Sprintf("%s_%d%s", checksum, size, sstSuffix)
+	dst := filepath.Join(e.dir, sharedDir, file.Shared)
+	if _, err := os.Stat(dst); err == nil {
+		return file, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	// 检查点中的SST文件是数据库文件的硬链接，复制而不是链接，备份不与数据库共享同一份数据
+	if err := utils.CopyFile(path, dst+tmpSuffix); err != nil {
+		os.Remove(dst + tmpSuffix)
+		return nil, err
+	}
+	if err := os.Rename(dst+tmpSuffix, dst); err != nil {
+		os.Remove(dst + tmpSuffix)
+		return nil, err
+	}
+	return file, utils.SyncDir(filepath.Dir(dst))
+}
+
+// ListBackups 按ID升序返回所有备份的信息
+func (e *Engine) ListBackups() ([]Info, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	metas, err := e.readMetas()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]Info, len(metas))
+	for i, meta := range metas {
+		infos[i] = meta.info()
+	}
+	return infos, nil
+}
+
+// VerifyBackup 检查备份中的每个文件都存在，且大小和校验和与创建时相同
+func (e *Engine) VerifyBackup(id uint32) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	meta, err := e.readMeta(id)
+	if err != nil {
+		return err
+	}
+	for _, file := range meta.Files {
+		checksum, size, err := fileChecksum(e.filePath(meta.ID, &file))
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrCorrupted, file.Path, err)
+		}
+		if size != file.Size || checksum != file.Checksum {
+			return fmt.Errorf("%w: %s: size %d checksum %s, expected size %d checksum %s",
+				ErrCorrupted, file.Path, size, checksum, file.Size, file.Checksum)
+		}
+	}
+	return nil
+}
+
+// PurgeOldBackups 只保留最新的keep个备份，删除其余备份以及不再被引用的共享文件
+func (e *Engine) PurgeOldBackups(keep int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	metas, err := e.readMetas()
+	if err != nil {
+		return err
+	}
+	keep = max(keep, 0)
+	if len(metas) <= keep {
+		return nil
+	}
+	purged, kept := metas[:len(metas)-keep], metas[len(metas)-keep:]
+	// 先删除元数据，中途失败时剩下的文件在下次打开或清理时删除
+	for _, meta := range purged {
+		if err := os.Remove(e.metaPath(meta.ID)); err != nil {
+			return err
+		}
+	}
+	if err := utils.SyncDir(filepath.Join(e.dir, metaDir)); err != nil {
+		return err
+	}
+	return e.removeUnreferenced(kept)
+}
+
+// RestoreToDir 把备份恢复到dir，dir不存在或为空。恢复时校验每个文件，dir可作为数据目录直接打开
+func (e *Engine) RestoreToDir(id uint32, dir string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	meta, err := e.readMeta(id)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrNotEmpty
+	}
+
+	// 先恢复到临时目录，全部文件校验通过后再重命名
+	tmp := dir + tmpSuffix
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	for _, file := range meta.Files {
+		dst := filepath.Join(tmp, filepath.FromSlash(file.Path))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+		if err := utils.CopyFile(e.filePath(meta.ID, &file), dst); err != nil {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("%w: %s: %v", ErrCorrupted, file.Path, err)
+		}
+		checksum, size, err := fileChecksum(dst)
+		if err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+		if size != file.Size || checksum != file.Checksum {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("%w: %s", ErrCorrupted, file.Path)
+		}
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return utils.SyncDir(filepath.Dir(dir))
+}
+
+// removeUnreferenced 删除没有元数据的备份目录和不被metas引用的共享文件
+func (e *Engine) removeUnreferenced(metas []*backupMeta) error {
+	live := make(map[string]bool)
+	ids := make(map[string]bool, len(metas))
+	for _, meta := range metas {
+		ids[strconv.FormatUint(uint64(meta.ID), 10)] = true
+		for _, file := range meta.Files {
+			if file.Shared != "" {
+				live[file.Shared] = true
+			}
+		}
+	}
+	privates, err := os.ReadDir(filepath.Join(e.dir, privateDir))
+	if err != nil {
+		return err
+	}
+	for _, entry := range privates {
+		if !ids[entry.Name()] {
+			if err := os.RemoveAll(filepath.Join(e.dir, privateDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	shared, err := os.ReadDir(filepath.Join(e.dir, sharedDir))
+	if err != nil {
+		return err
+	}
+	for _, entry := range shared {
+		if !live[entry.Name()] {
+			if err := os.Remove(filepath.Join(e.dir, sharedDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readMetas 按ID升序读取所有备份的元数据，忽略写入中的临时文件
+func (e *Engine) readMetas() ([]*backupMeta, error) {
+	entries, err := os.ReadDir(filepath.Join(e.dir, metaDir))
+	if err != nil {
+		return nil, err
+	}
+	metas := make([]*backupMeta, 0, len(entries))
+	for _, entry := range entries {
+		id, err := strconv.ParseUint(entry.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		meta, err := e.readMeta(uint32(id))
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].ID < metas[j].ID
+	})
+	return metas, nil
+}
+
+func (e *Engine) readMeta(id uint32) (*backupMeta, error) {
+	data, err := os.ReadFile(e.metaPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %d", ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := &backupMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("backup: parse metadata of backup %d: %w", id, err)
+	}
+	return meta, nil
+}
+
+// writeMeta 将元数据写入临时文件，同步后原子地重命名，备份在重命名后才可见
+func (e *Engine) writeMeta(meta *backupMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	path := e.metaPath(meta.ID)
+	fp, err := os.Create(path + tmpSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		os.Remove(path + tmpSuffix)
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		os.Remove(path + tmpSuffix)
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		os.Remove(path + tmpSuffix)
+		return err
+	}
+	if err := os.Rename(path+tmpSuffix, path); err != nil {
+		os.Remove(path + tmpSuffix)
+		return err
+	}
+	return utils.SyncDir(filepath.Dir(path))
+}
+
+func (e *Engine) metaPath(id uint32) string {
+	return filepath.Join(e.dir, metaDir, strconv.FormatUint(uint64(id), 10))
+}
+
+func (e *Engine) privatePath(id uint32) string {
+	return filepath.Join(e.dir, privateDir, strconv.FormatUint(uint64(id), 10))
+}
+
+// filePath 返回备份中的文件的保存位置
+func (e *Engine) filePath(id uint32, file *fileMeta) string {
+	if file.Shared != "" {
+		return filepath.Join(e.dir, sharedDir, file.Shared)
+	}
+	return filepath.Join(e.privatePath(id), filepath.FromSlash(file.Path))
+}
+
+// fileChecksum 返回文件内容的SHA-256和大小
+func fileChecksum(path string) (string, int64, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer fp.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, fp)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// syncDirs 同步root及其下的所有目录，root不存在时什么也不做
+func syncDirs(root string) error {
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		return utils.SyncDir(path)
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
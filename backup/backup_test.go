@@ -0,0 +1,159 @@
+package backup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	lsm "github.com/aixiasang/sqldb"
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+func putRange(t *testing.T, db *lsm.LSM, start, end int) {
+	t.Helper()
+	for i := start; i < end; i++ {
+		if err := db.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEngine(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.Level0CompactionTrigger = 100
+	db, err := lsm.NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	e, err := NewEngine(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putRange(t, db, 0, 50)
+	first, err := e.CreateBackup(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRange(t, db, 50, 100)
+	second, err := e.CreateBackup(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != 1 || second.ID != 2 || second.NumFiles <= first.NumFiles {
+		t.Fatalf("unexpected backups: %+v, %+v", first, second)
+	}
+
+	// 第一次备份的SST文件在第二次备份中共享
+	shared, err := os.ReadDir(filepath.Join(e.dir, sharedDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shared) != 2 {
+		t.Fatalf("expected 2 shared tables, got %d", len(shared))
+	}
+	infos, err := e.ListBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].ID != 1 || infos[1].ID != 2 {
+		t.Fatalf("unexpected backups: %+v", infos)
+	}
+	for _, info := range infos {
+		if err := e.VerifyBackup(info.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.VerifyBackup(3); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// 恢复第一次备份，之后的写入不可见
+	restored := filepath.Join(t.TempDir(), "restored")
+	if err := e.RestoreToDir(first.ID, restored); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RestoreToDir(first.ID, restored); !errors.Is(err, ErrNotEmpty) {
+		t.Fatalf("expected ErrNotEmpty, got %v", err)
+	}
+	restoredConf := config.NewConfig()
+	restoredConf.DataDir = restored
+	restoredDB, err := lsm.NewLSM(restoredConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		_, found, err := restoredDB.Get(utils.GenerateKey(i))
+		if err != nil || found != (i < 50) {
+			t.Fatalf("key %d: found=%v, err=%v", i, found, err)
+		}
+	}
+	if err := restoredDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 删除旧备份后只保留仍被引用的共享文件
+	if err := e.PurgeOldBackups(1); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := e.ListBackups(); len(infos) != 1 || infos[0].ID != second.ID {
+		t.Fatalf("unexpected backups after purge: %+v", infos)
+	}
+	if err := e.VerifyBackup(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(e.privatePath(first.ID)); !os.IsNotExist(err) {
+		t.Fatalf("expected private directory of purged backup to be removed, err=%v", err)
+	}
+
+	// 校验发现被篡改的文件
+	meta, err := e.readMeta(second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(e.filePath(second.ID, &meta.Files[0]), []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.VerifyBackup(second.ID); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected ErrCorrupted, got %v", err)
+	}
+	if err := e.RestoreToDir(second.ID, filepath.Join(t.TempDir(), "corrupted")); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected ErrCorrupted, got %v", err)
+	}
+}
+
+func TestNewEngine_RemovesIncompleteBackups(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewEngine(dir); err != nil {
+		t.Fatal(err)
+	}
+	// 崩溃时留下的检查点、备份目录和共享文件没有元数据引用
+	for _, path := range []string{
+		filepath.Join(dir, tmpDir, "1", "MANIFEST"),
+		filepath.Join(dir, privateDir, "1", "MANIFEST"),
+		filepath.Join(dir, sharedDir, "abc_3.sst"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("abc"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e, err := NewEngine(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{tmpDir, filepath.Join(privateDir, "1"), filepath.Join(sharedDir, "abc_3.sst")} {
+		if _, err := os.Stat(filepath.Join(dir, sub)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed, err=%v", sub, err)
+		}
+	}
+	if infos, err := e.ListBackups(); err != nil || len(infos) != 0 {
+		t.Fatalf("infos=%+v, err=%v", infos, err)
+	}
+}
@@ -0,0 +1,60 @@
+package lsm
+
+import (
+	"github.com/aixiasang/sqldb/wal"
+)
+
+// WriteBatch 一组原子写入的操作，可以跨列族。提交时作为一条WAL记录写入，
+// 崩溃后要么全部恢复，要么全部丢失。列族参数为nil时作用于默认列族
+type WriteBatch struct {
+	ops []batchOp
+}
+
+// batchOp 批次中的一个操作
+type batchOp struct {
+	cf  *ColumnFamily // nil表示默认列族
+	rec *wal.Record
+}
+
+// NewWriteBatch 创建空的写入批次
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put 写入键值对，与LSM.Put相同，value为nil时视为删除
+func (b *WriteBatch) Put(cf *ColumnFamily, key, value []byte) {
+	b.ops = append(b.ops, batchOp{cf: cf, rec: wal.NewRecord(key, value)})
+}
+
+// Delete 删除键
+func (b *WriteBatch) Delete(cf *ColumnFamily, key []byte) {
+	b.ops = append(b.ops, batchOp{cf: cf, rec: wal.NewRecord(key, nil)})
+}
+
+// SingleDelete 删除只写入过一次的键，见LSM.SingleDelete
+func (b *WriteBatch) SingleDelete(cf *ColumnFamily, key []byte) {
+	b.ops = append(b.ops, batchOp{cf: cf, rec: wal.NewSingleDeleteRecord(key)})
+}
+
+// DeleteRange 删除[start, end]内的所有键
+func (b *WriteBatch) DeleteRange(cf *ColumnFamily, start, end []byte) {
+	b.ops = append(b.ops, batchOp{cf: cf, rec: wal.NewRangeDeleteRecord(start, end)})
+}
+
+// Merge 写入合并操作数
+func (b *WriteBatch) Merge(cf *ColumnFamily, key, operand []byte) {
+	if operand == nil {
+		operand = []byte{}
+	}
+	b.ops = append(b.ops, batchOp{cf: cf, rec: wal.NewMergeRecord(key, operand)})
+}
+
+// Count 返回批次中的操作数量
+func (b *WriteBatch) Count() int {
+	return len(b.ops)
+}
+
+// Clear 清空批次，以便复用
+func (b *WriteBatch) Clear() {
+	b.ops = b.ops[:0]
+}
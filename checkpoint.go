@@ -0,0 +1,110 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aixiasang/sqldb/utils"
+)
+
+// Checkpoint 在dir中创建数据库当前状态的一致快照，期间不停止写入。先刷盘使需要复制的WAL尽量小，
+// 再在一次加锁中把各列族的有效SST文件硬链接到dir(不支持硬链接时复制)，复制仍需重放的WAL并写入清单。
+// dir不能已存在，以与当前LSM相同的WalDir和SSTDir、DataDir为dir的配置打开即为独立的数据库
+func (l *LSM) Checkpoint(dir string) error {
+	if l.closed.Load() {
+		return ErrClosed
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("检查点目录 %s 已存在", dir)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	start := time.Now()
+	if err := l.Flush(true); err != nil {
+		return err
+	}
+
+	// 先写入临时目录，完成后重命名，失败时不留下不完整的检查点
+	tmpDir := dir + tempFileSuffix
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	files, err := l.writeCheckpoint(tmpDir)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("创建检查点失败: %w", err)
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	if err := utils.SyncDir(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	l.logger.Info("创建检查点完成", "dir", dir, "files", files, "duration", time.Since(start))
+	return nil
+}
+
+// writeCheckpoint 持有读锁，写入、刷盘和合并的安装都被阻塞，文件集合、WAL和序列号保持一致。
+// 有效文件在锁内不会被删除；复制的WAL对应尚未安装的内存表，与此时崩溃后的恢复状态相同。
+// 返回链接或复制的SST文件数
+func (l *LSM) writeCheckpoint(dir string) (int, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed.Load() {
+		return 0, ErrClosed
+	}
+
+	var files int
+	for _, cf := range l.columnFamilies {
+		sstDir := filepath.Join(dir, cf.conf.SSTDir)
+		if err := os.MkdirAll(sstDir, 0755); err != nil {
+			return files, err
+		}
+		for _, nodes := range cf.nodes {
+			for _, node := range nodes {
+				if err := linkOrCopyFile(node.path, filepath.Join(sstDir, filepath.Base(node.path))); err != nil {
+					return files, err
+				}
+				files++
+			}
+		}
+		if err := utils.SyncDir(sstDir); err != nil {
+			return files, err
+		}
+	}
+
+	walDir := filepath.Join(dir, l.conf.WalDir)
+	if err := os.MkdirAll(walDir, 0755); err != nil {
+		return files, err
+	}
+	for _, immutable := range l.immutableMemtables {
+		if immutable.wal == nil {
+			continue
+		}
+		if err := immutable.wal.CopyTo(filepath.Join(walDir, filepath.Base(immutable.wal.FilePath()))); err != nil {
+			return files, err
+		}
+	}
+	if err := l.currWal.CopyTo(filepath.Join(walDir, filepath.Base(l.currWal.FilePath()))); err != nil {
+		return files, err
+	}
+	if err := utils.SyncDir(walDir); err != nil {
+		return files, err
+	}
+	return files, writeManifest(filepath.Join(dir, manifestFileName), l.currentManifest())
+}
+
+// linkOrCopyFile 为src创建硬链接dst，跨文件系统等无法链接时复制。SST文件写入后不再修改，可以共享
+func linkOrCopyFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return utils.CopyFile(src, dst)
+}
@@ -0,0 +1,143 @@
+package lsm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+func TestCheckpoint(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	cf, err := lsm.CreateColumnFamily("meta", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			if err := lsm.Flush(true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.PutCF(cf, []byte("cf-key"), []byte("cf-value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Checkpoint(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Checkpoint(dir); err == nil {
+		t.Fatal("expected error for existing checkpoint directory")
+	}
+
+	// SST文件与原数据库共享
+	lsm.mu.RLock()
+	node := lsm.defaultCF.nodes[0][0]
+	lsm.mu.RUnlock()
+	src, err := os.Stat(node.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := os.Stat(filepath.Join(dir, conf.SSTDir, filepath.Base(node.path)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(src, dst) {
+		t.Fatal("expected checkpoint table to be a hard link")
+	}
+
+	// 检查点之后的写入和合并不影响检查点
+	for i := 0; i < 100; i++ {
+		if err := lsm.Delete(utils.GenerateKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cpConf := config.NewConfig()
+	cpConf.DataDir = dir
+	checkpoint, err := NewLSM(cpConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkpoint.Close()
+	for i := 0; i < 100; i++ {
+		value, found, err := checkpoint.Get(utils.GenerateKey(i))
+		if err != nil || !found || string(value) != string(utils.GenerateValue(i)) {
+			t.Fatalf("key %d: value=%q, found=%v, err=%v", i, value, found, err)
+		}
+	}
+	cpCF, ok := checkpoint.GetColumnFamily("meta")
+	if !ok {
+		t.Fatal("expected column family in checkpoint")
+	}
+	if value, found, err := checkpoint.GetCF(cpCF, []byte("cf-key")); err != nil || !found || string(value) != "cf-value" {
+		t.Fatalf("value=%q, found=%v, err=%v", value, found, err)
+	}
+	if _, err := os.Stat(dir + tempFileSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expected temporary directory to be removed, err=%v", err)
+	}
+}
+
+func TestCheckpoint_CopiesWal(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 10; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seq := lsm.LatestSequenceNumber()
+
+	// 不刷盘直接写入检查点，内存表中的数据从复制的WAL中恢复
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lsm.writeCheckpoint(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Put(utils.GenerateKey(10), utils.GenerateValue(10)); err != nil {
+		t.Fatal(err)
+	}
+
+	cpConf := config.NewConfig()
+	cpConf.DataDir = dir
+	checkpoint, err := NewLSM(cpConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkpoint.Close()
+	if got := checkpoint.LatestSequenceNumber(); got != seq {
+		t.Fatalf("expected sequence %d, got %d", seq, got)
+	}
+	for i := 0; i < 10; i++ {
+		if _, found, err := checkpoint.Get(utils.GenerateKey(i)); err != nil || !found {
+			t.Fatalf("key %d: found=%v, err=%v", i, found, err)
+		}
+	}
+	if _, found, _ := checkpoint.Get(utils.GenerateKey(10)); found {
+		t.Fatal("unexpected key written after checkpoint")
+	}
+}
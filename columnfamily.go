@@ -0,0 +1,263 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/memtable"
+)
+
+// DefaultColumnFamilyName 默认列族的名称。默认列族总是存在，不能删除，
+// Put、Get等不带列族参数的方法都作用于默认列族
+const DefaultColumnFamilyName = "default"
+
+// ColumnFamily 列族：独立的键空间，有自己的内存表、层级和选项，所有列族共享同一个WAL，
+// 跨列族的WriteBatch原子写入。由CreateColumnFamily创建，重新打开后通过GetColumnFamily获取
+type ColumnFamily struct {
+	id      uint32
+	name    string
+	options config.ColumnFamilyOptions
+	conf    *config.Config // 列族使用的配置，SSTDir指向列族的SST目录
+
+	// 以下字段由LSM.mu保护
+	mutableMemtable *memTable        // 可变内存表
+	levelId         []*atomic.Uint32 // 层级ID
+	nodes           [][]*Node        // 节点
+	compactPointer  [][]byte         // 各层级上次合并的文件的最大键，下次从其后开始选择
+	dropped         bool             // 是否已删除
+}
+
+// Name 返回列族的名称
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// ID 返回列族的ID，默认列族为0
+func (cf *ColumnFamily) ID() uint32 {
+	return cf.id
+}
+
+// newColumnFamily 创建列族的内存结构。默认列族直接使用LSM的配置，SST文件位于SST目录下，
+// 其余列族的SST文件位于以ID命名的子目录中
+func (l *LSM) newColumnFamily(id uint32, name string, options config.ColumnFamilyOptions) *ColumnFamily {
+	cf := &ColumnFamily{
+		id:             id,
+		name:           name,
+		options:        options,
+		conf:           l.conf,
+		levelId:        make([]*atomic.Uint32, l.conf.MaxLevel),
+		nodes:          make([][]*Node, l.conf.MaxLevel),
+		compactPointer: make([][]byte, l.conf.MaxLevel),
+	}
+	if id != 0 {
+		cf.conf = l.conf.ForColumnFamily(filepath.Join(l.conf.SSTDir, strconv.FormatUint(uint64(id), 10)), options)
+	}
+	for i := range cf.levelId {
+		cf.levelId[i] = &atomic.Uint32{}
+		cf.nodes[i] = make([]*Node, 0)
+	}
+	cf.mutableMemtable = newMemTable(cf.conf)
+	return cf
+}
+
+// sstDir 返回列族的SST目录
+func (cf *ColumnFamily) sstDir() string {
+	return fmt.Sprintf("%s/%s", cf.conf.DataDir, cf.conf.SSTDir)
+}
+
+// DefaultColumnFamily 返回默认列族
+func (l *LSM) DefaultColumnFamily() *ColumnFamily {
+	return l.defaultCF
+}
+
+// GetColumnFamily 按名称查找列族
+func (l *LSM) GetColumnFamily(name string) (*ColumnFamily, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, cf := range l.columnFamilies {
+		if cf.name == name {
+			return cf, true
+		}
+	}
+	return nil, false
+}
+
+// ColumnFamilies 返回所有列族的名称，按创建顺序排列，默认列族在最前
+func (l *LSM) ColumnFamilies() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	names := make([]string, 0, len(l.columnFamilies))
+	for _, cf := range l.columnFamilies {
+		names = append(names, cf.name)
+	}
+	return names
+}
+
+// CreateColumnFamily 创建名为name的列族，opts为nil时使用默认选项。列族和选项记录在清单中
+func (l *LSM) CreateColumnFamily(name string, opts *config.ColumnFamilyOptions) (*ColumnFamily, error) {
+	if l.closed.Load() {
+		return nil, ErrClosed
+	}
+	if name == "" {
+		return nil, errors.New("列族名称不能为空")
+	}
+	var options config.ColumnFamilyOptions
+	if opts != nil {
+		options = *opts
+	}
+	if memtable.NewMemTable(options.MemTableType, config.DefaultMemTableCapSize) == nil {
+		return nil, fmt.Errorf("不支持的内存表类型: %d", options.MemTableType)
+	}
+
+	defer l.fireEvents()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed.Load() {
+		return nil, ErrClosed
+	}
+	if l.bgErr != nil {
+		return nil, l.bgErr
+	}
+	for _, cf := range l.columnFamilies {
+		if cf.name == name {
+			return nil, fmt.Errorf("列族 %s 已存在", name)
+		}
+	}
+
+	cf := l.newColumnFamily(l.nextColumnFamilyID, name, options)
+	if err := os.MkdirAll(cf.sstDir(), 0755); err != nil {
+		return nil, fmt.Errorf("创建列族目录失败: %w", err)
+	}
+	l.nextColumnFamilyID++
+	l.columnFamilies = append(l.columnFamilies, cf)
+	if err := l.saveManifest(); err != nil {
+		l.columnFamilies = l.columnFamilies[:len(l.columnFamilies)-1]
+		return nil, l.setBackgroundError(BackgroundOpManifest, err, true)
+	}
+	l.logger.Info("创建列族", "name", name, "id", cf.id)
+	return cf, nil
+}
+
+// DropColumnFamily 删除列族及其全部数据，之后使用该列族的操作返回ErrColumnFamilyDropped。
+// 先等待该列族进行中的刷盘和合并结束，再从清单中移除并删除SST文件；WAL中残留的记录在重放时忽略
+func (l *LSM) DropColumnFamily(cf *ColumnFamily) error {
+	if l.closed.Load() {
+		return ErrClosed
+	}
+	if cf == nil || cf.id == 0 {
+		return errors.New("不能删除默认列族")
+	}
+
+	defer l.fireEvents()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if cf.dropped {
+		return ErrColumnFamilyDropped
+	}
+	if l.bgErr != nil {
+		return l.bgErr
+	}
+	// 标记后不再为该列族调度新的刷盘和合并，进行中的刷盘写完文件后由installFlushes删除
+	cf.dropped = true
+	for (l.hasRunningFlush(cf) || l.hasRunningCompaction(cf)) && !l.closed.Load() {
+		l.flushCond.Wait()
+	}
+	if l.closed.Load() {
+		cf.dropped = false
+		return ErrClosed
+	}
+
+	i := slices.Index(l.columnFamilies, cf)
+	l.columnFamilies = slices.Delete(l.columnFamilies, i, i+1)
+	if err := l.saveManifest(); err != nil {
+		l.columnFamilies = slices.Insert(l.columnFamilies, i, cf)
+		cf.dropped = false
+		return l.setBackgroundError(BackgroundOpManifest, err, true)
+	}
+
+	// 清单中已没有该列族，文件删除失败时重新打开会作为残留目录清理
+	var files int
+	for _, nodes := range cf.nodes {
+		for _, node := range nodes {
+			table := node.TableInfo("drop-column-family")
+			node.Close()
+			if err := os.Remove(node.path); err != nil {
+				l.logger.Warn("删除列族的SST文件失败", "path", node.path, "error", err)
+				continue
+			}
+			files++
+			l.queueEvent(func(listener config.EventListener) { listener.OnTableFileDeleted(table) })
+		}
+	}
+	cf.nodes = nil
+	cf.mutableMemtable = nil
+	if err := os.RemoveAll(cf.sstDir()); err != nil {
+		l.logger.Warn("删除列族目录失败", "path", cf.sstDir(), "error", err)
+	}
+	l.logger.Info("删除列族", "name", cf.name, "id", cf.id, "files", files)
+	return nil
+}
+
+// hasRunningFlush 列族是否有进行中的刷盘。调用方需持有锁
+func (l *LSM) hasRunningFlush(cf *ColumnFamily) bool {
+	for _, immutable := range l.immutableMemtables {
+		if !immutable.flushing {
+			continue
+		}
+		for _, table := range immutable.tables {
+			if table.cf == cf && !table.skip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasRunningCompaction 列族是否有进行中的合并。调用方需持有锁
+func (l *LSM) hasRunningCompaction(cf *ColumnFamily) bool {
+	for _, c := range l.runningCompactions {
+		if c.cf == cf {
+			return true
+		}
+	}
+	return false
+}
+
+// columnFamilyByID 按ID查找未删除的列族，用于重放WAL。调用方需持有锁
+func (l *LSM) columnFamilyByID(id uint32) *ColumnFamily {
+	for _, cf := range l.columnFamilies {
+		if cf.id == id {
+			return cf
+		}
+	}
+	return nil
+}
+
+// PutCF 向列族写入键值对
+func (l *LSM) PutCF(cf *ColumnFamily, key, value []byte) error {
+	batch := NewWriteBatch()
+	batch.Put(cf, key, value)
+	return l.Write(batch)
+}
+
+// DeleteCF 删除列族中的键
+func (l *LSM) DeleteCF(cf *ColumnFamily, key []byte) error {
+	batch := NewWriteBatch()
+	batch.Delete(cf, key)
+	return l.Write(batch)
+}
+
+// MergeCF 向列族写入合并操作数
+func (l *LSM) MergeCF(cf *ColumnFamily, key, operand []byte) error {
+	batch := NewWriteBatch()
+	batch.Merge(cf, key, operand)
+	return l.Write(batch)
+}
@@ -0,0 +1,258 @@
+package lsm
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/memtable"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+func TestColumnFamily_Isolation(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lsm.CreateColumnFamily("users", &config.ColumnFamilyOptions{MemTableType: memtable.MemTableType(100)}); err == nil {
+		t.Fatal("expected error for unsupported memtable type")
+	}
+	opts := &config.ColumnFamilyOptions{BlockSize: 1024, BloomFilterSize: 4096, BloomFilterHashCount: 3}
+	users, err := lsm.CreateColumnFamily("users", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lsm.CreateColumnFamily("users", nil); err == nil {
+		t.Fatal("expected error for duplicate column family")
+	}
+
+	key := utils.GenerateKey(1)
+	if err := lsm.Put(key, []byte("default")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.PutCF(users, key, []byte("users")); err != nil {
+		t.Fatal(err)
+	}
+	// 跨列族的批次
+	batch := NewWriteBatch()
+	batch.Put(nil, utils.GenerateKey(2), []byte("default-2"))
+	batch.Put(users, utils.GenerateKey(2), []byte("users-2"))
+	batch.Delete(users, key)
+	if err := lsm.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(cf *ColumnFamily, key []byte, want string) {
+		t.Helper()
+		value, found, err := lsm.GetCF(cf, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want == "" {
+			if found {
+				t.Fatalf("%s: expected %s to be deleted, got %q", cf.Name(), key, value)
+			}
+			return
+		}
+		if !found || string(value) != want {
+			t.Fatalf("%s: expected %s=%q, got %q (found=%v)", cf.Name(), key, want, value, found)
+		}
+	}
+	verify := func() {
+		t.Helper()
+		check(lsm.DefaultColumnFamily(), key, "default")
+		check(users, key, "")
+		check(lsm.DefaultColumnFamily(), utils.GenerateKey(2), "default-2")
+		check(users, utils.GenerateKey(2), "users-2")
+	}
+	verify()
+
+	// 只有WAL时重放到各列族
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, ok := lsm.GetColumnFamily("users")
+	if !ok {
+		t.Fatal("column family not found after reopen")
+	}
+	verify()
+
+	// 刷盘后从各列族的SST中读取
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.CompactRangeCF(users, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	verify()
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	if names := lsm.ColumnFamilies(); len(names) != 2 || names[0] != DefaultColumnFamilyName || names[1] != "users" {
+		t.Fatalf("unexpected column families: %v", names)
+	}
+	users, _ = lsm.GetColumnFamily("users")
+	if users.options != *opts || users.conf.BlockSize != opts.BlockSize {
+		t.Fatalf("options not restored: %+v", users.options)
+	}
+	verify()
+}
+
+func TestColumnFamily_Drop(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs, err := lsm.CreateColumnFamily("logs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := lsm.PutCF(logs, utils.GenerateKey(i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	// 这部分只在WAL中，重新打开时应被忽略
+	if err := lsm.PutCF(logs, utils.GenerateKey(100), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Put(utils.GenerateKey(100), []byte("default")); err != nil {
+		t.Fatal(err)
+	}
+	dir := logs.sstDir()
+
+	if err := lsm.DropColumnFamily(lsm.DefaultColumnFamily()); err == nil {
+		t.Fatal("expected error when dropping the default column family")
+	}
+	if err := lsm.DropColumnFamily(logs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("column family directory not removed: %v", err)
+	}
+	if err := lsm.PutCF(logs, utils.GenerateKey(1), []byte("value")); !errors.Is(err, ErrColumnFamilyDropped) {
+		t.Fatalf("expected ErrColumnFamilyDropped, got %v", err)
+	}
+	if _, _, err := lsm.GetCF(logs, utils.GenerateKey(1)); !errors.Is(err, ErrColumnFamilyDropped) {
+		t.Fatalf("expected ErrColumnFamilyDropped, got %v", err)
+	}
+	if err := lsm.DropColumnFamily(logs); !errors.Is(err, ErrColumnFamilyDropped) {
+		t.Fatalf("expected ErrColumnFamilyDropped, got %v", err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	if _, ok := lsm.GetColumnFamily("logs"); ok {
+		t.Fatal("dropped column family reappeared after reopen")
+	}
+	if value, found, err := lsm.Get(utils.GenerateKey(100)); err != nil || !found || string(value) != "default" {
+		t.Fatalf("value=%q, found=%v, err=%v", value, found, err)
+	}
+	// 新列族不会复用已删除列族的ID
+	metrics, err := lsm.CreateColumnFamily("metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.ID() == logs.ID() {
+		t.Fatalf("column family id %d reused", metrics.ID())
+	}
+	if _, found, err := lsm.GetCF(metrics, utils.GenerateKey(1)); err != nil || found {
+		t.Fatalf("found=%v, err=%v", found, err)
+	}
+}
+
+// blockingFlushListener 在指定列族开始刷盘时阻塞，直到release关闭
+type blockingFlushListener struct {
+	config.NoopEventListener
+	cf      string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingFlushListener) OnFlushBegin(info config.FlushInfo) {
+	if info.ColumnFamily == b.cf {
+		close(b.started)
+		<-b.release
+	}
+}
+
+func TestColumnFamily_DropDuringFlush(t *testing.T) {
+	listener := &blockingFlushListener{cf: "logs", started: make(chan struct{}), release: make(chan struct{})}
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.Listeners = []config.EventListener{listener}
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	// 失败时也要放行刷盘，否则Close一直等待
+	release := sync.OnceFunc(func() { close(listener.release) })
+	defer release()
+	logs, err := lsm.CreateColumnFamily("logs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := lsm.PutCF(logs, utils.GenerateKey(i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Flush(false); err != nil {
+		t.Fatal(err)
+	}
+	<-listener.started
+
+	// 刷盘进行中时删除列族需要等待刷盘结束
+	dropped := make(chan error, 1)
+	go func() { dropped <- lsm.DropColumnFamily(logs) }()
+	select {
+	case err := <-dropped:
+		t.Fatalf("drop returned during flush: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	release()
+	if err := <-dropped; err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.BackgroundError(); err != nil {
+		t.Fatalf("unexpected background error: %v", err)
+	}
+	if _, err := os.Stat(logs.sstDir()); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("column family directory not removed: %v", err)
+	}
+	if err := lsm.Put(utils.GenerateKey(1), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+}
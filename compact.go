@@ -3,284 +3,788 @@ package lsm
 import (
 	"fmt"
 	"os"
-	"path/filepath"
-	"sync/atomic"
+	"sort"
 	"time"
 
 	"github.com/aixiasang/sqldb/config"
 	"github.com/aixiasang/sqldb/sstable"
+	"github.com/aixiasang/sqldb/utils"
 )
 
-// 默认L0阈值，应从config读取
-const defaultLevel0CompactThreshold = 4
-
-// 标记当前正在进行合并的状态
-var compactionInProgress atomic.Bool
+// 刷盘和合并的原因，用于事件通知和日志
+const (
+	flushReasonMemtableFull = "memtable-full"
+	flushReasonManual       = "manual"
+	flushReasonRecovery     = "recovery"
+	flushReasonWalError     = "wal-error"
+	flushReasonClose        = "close"
+
+	compactionReasonLevel0 = "level0-files"
+	compactionReasonSize   = "level-size"
+	compactionReasonManual = "manual"
+)
 
-func (l *LSM) compactionWorker() {
-	fmt.Println("[DEBUG] 合并工作线程启动")
-	defer fmt.Println("[DEBUG] 合并工作线程退出")
+// compaction 一次合并任务，把level层的输入文件与下一层键范围重叠的文件合并后写入outputLevel层。
+// 手动合并最底层时level与outputLevel相同，原地重写输入文件
+type compaction struct {
+	cf          *ColumnFamily
+	level       int
+	outputLevel int
+	reason      string
+	inputs      []*Node           // 输入文件，按从新到旧排列
+	smallest    []byte            // 输入文件键范围的下界
+	largest     []byte            // 输入文件键范围的上界
+	bottommost  bool              // 更低的层级中没有与键范围重叠的文件，可以丢弃删除标记
+	manual      *manualCompaction // 对应的手动合并，自动合并时为nil
+	dropOnly    bool              // 只删除输入文件，不生成输出文件(FIFO合并)
+}
 
-	// 启动另一个worker以增加处理能力
-	go func() {
-		fmt.Println("[DEBUG] 辅助合并工作线程启动")
-		for {
-			if !l.isRunning.Load() {
-				fmt.Println("[DEBUG] LSM已经停止运行，辅助合并工作线程退出")
-				return
+// startWorkers 启动固定数量的后台工作线程执行刷盘和合并任务，jobs关闭后退出
+func (l *LSM) startWorkers() {
+	workers := cap(l.jobs)
+	l.bgWg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer l.bgWg.Done()
+			for job := range l.jobs {
+				job()
 			}
+		}()
+	}
+	l.logger.Debug("后台工作线程启动", "workers", workers)
+}
 
-			// 检查是否有需要合并的内存表
-			l.mu.RLock()
-			immCount := len(l.immutableMemtables)
-			l.mu.RUnlock()
+// maybeSchedule 在并发上限内为待刷盘的内存表和超出阈值的层级提交后台任务。
+// 进行中的任务计入上限，提交时jobs不会阻塞。调用方需持有写锁
+func (l *LSM) maybeSchedule() {
+	if l.closed.Load() || l.bgErr != nil {
+		return
+	}
+	for _, immutable := range l.immutableMemtables {
+		if l.runningFlushes >= l.conf.MaxBackgroundFlushes {
+			break
+		}
+		if immutable.flushing || immutable.flushed {
+			continue
+		}
+		l.jobs <- l.prepareFlush(immutable)
+	}
+	// 手动合并优先，与进行中的合并冲突时留在队列中，等合并结束后重试
+	for _, m := range l.manualCompactions {
+		if len(l.runningCompactions) >= l.conf.MaxBackgroundCompactions {
+			return
+		}
+		if m.running || m.done {
+			continue
+		}
+		if m.cf.dropped {
+			m.done = true
+			m.err = ErrColumnFamilyDropped
+			l.flushCond.Broadcast()
+			continue
+		}
+		c, ok := l.pickManualCompaction(m)
+		if !ok {
+			continue
+		}
+		if c == nil {
+			// 该层没有需要合并的文件
+			m.done = true
+			l.flushCond.Broadcast()
+			continue
+		}
+		m.running = true
+		l.submitCompaction(c)
+	}
+	for len(l.runningCompactions) < l.conf.MaxBackgroundCompactions {
+		c := l.pickCompaction()
+		if c == nil {
+			break
+		}
+		l.submitCompaction(c)
+	}
+}
 
-			if immCount > 0 && !compactionInProgress.Load() {
-				if compactionInProgress.CompareAndSwap(false, true) {
-					fmt.Printf("[DEBUG] 辅助线程检测到有 %d 个未合并的不可变内存表，触发合并\n", immCount)
-					l.compactMemTables()
-					compactionInProgress.Store(false)
-				}
-			}
+// submitCompaction 标记输入文件正在合并并提交合并任务。调用方需持有写锁
+func (l *LSM) submitCompaction(c *compaction) {
+	for _, node := range c.inputs {
+		node.compacting = true
+	}
+	l.runningCompactions = append(l.runningCompactions, c)
+	l.jobs <- func() { l.runCompaction(c) }
+}
 
-			time.Sleep(500 * time.Millisecond)
+// prepareFlush 标记内存表正在刷盘并返回刷盘任务。各列族的0层文件编号在第一次调度时按内存表的先后分配，
+// 重试时沿用，保证重新打开后0层文件的顺序与写入顺序一致，已删除的列族不再刷盘。调用方需持有写锁
+func (l *LSM) prepareFlush(immutable *immutableMemtable) func() {
+	for _, table := range immutable.tables {
+		if table.cf.dropped {
+			table.skip = true
 		}
-	}()
+		if !table.hasFileNum && !table.skip {
+			table.fileNum = table.cf.levelId[0].Add(1) - 1
+			table.hasFileNum = true
+		}
+	}
+	immutable.flushing = true
+	l.runningFlushes++
+	return func() { l.flushImmutable(immutable) }
+}
 
-	for {
-		select {
-		case _, ok := <-l.compactChan:
-			if !ok {
-				fmt.Println("[DEBUG] compactChan已关闭，合并工作线程退出")
-				return
-			}
-			if !l.isRunning.Load() {
-				fmt.Println("[DEBUG] LSM已经停止运行，合并工作线程退出")
-				return
-			}
+// flushImmutable 将不可变内存表中各列族的数据分别写入列族的0层SST文件。内存表在它之前的内存表都刷盘后
+// 才移出队列，失败时删除已写入的文件并进入只读状态，等待Resume后重试
+func (l *LSM) flushImmutable(immutable *immutableMemtable) {
+	startTime := time.Now()
 
-			// 避免并发合并
-			if compactionInProgress.CompareAndSwap(false, true) {
-				fmt.Println("[DEBUG] 收到内存表合并信号，开始合并...")
-				l.compactMemTables()
-				compactionInProgress.Store(false)
-			} else {
-				fmt.Println("[DEBUG] 正在进行合并，忽略本次合并请求")
-			}
+	infos := make([]config.FlushInfo, 0, len(immutable.tables))
+	nodes := make([]*Node, len(immutable.tables))
+	var entries int
+	for i, table := range immutable.tables {
+		if table.skip {
+			continue
+		}
+		// 检查memtable中的数据
+		iter := table.memtable.Iterator()
+		dataCount := 0
+		for iter.Next() {
+			dataCount++
+		}
+		empty := dataCount == 0 && len(table.memtable.rangeDels) == 0
+		// 其余列族没有数据时不产生刷盘事件
+		if empty && table.cf != l.defaultCF {
+			continue
+		}
+		entries += dataCount
+		info := config.FlushInfo{ColumnFamily: table.cf.name, Reason: immutable.reason, Entries: dataCount,
+			Table: config.TableFileInfo{ColumnFamily: table.cf.name, Reason: "flush"}}
+		if immutable.wal != nil {
+			info.WalNum = immutable.wal.LogNum()
+		}
+		l.notify(func(listener config.EventListener) { listener.OnFlushBegin(info) })
 
-		case _, ok := <-l.sstChan:
-			if !ok {
-				fmt.Println("[DEBUG] sstChan已关闭，合并工作线程退出")
-				return
-			}
-			if !l.isRunning.Load() {
-				fmt.Println("[DEBUG] LSM已经停止运行，合并工作线程退出")
+		if empty {
+			l.logger.Debug("内存表中没有数据，跳过SST创建")
+		} else {
+			node, err := l.writeTable(table.cf, table.memtable, 0, table.fileNum)
+			if err != nil {
+				info.Duration = time.Since(startTime)
+				info.Err = err
+				l.notify(func(listener config.EventListener) { listener.OnFlushEnd(info) })
+				// 重试时所有列族重新刷盘，删除本次已写入的文件
+				for _, written := range nodes {
+					if written == nil {
+						continue
+					}
+					table := written.TableInfo("flush")
+					written.Close()
+					if os.Remove(written.path) == nil {
+						l.notify(func(listener config.EventListener) { listener.OnTableFileDeleted(table) })
+					}
+				}
+				l.mu.Lock()
+				immutable.flushing = false
+				l.runningFlushes--
+				l.flushCond.Broadcast()
+				l.setBackgroundError(BackgroundOpFlush, err, true)
+				l.mu.Unlock()
+				l.fireEvents()
 				return
 			}
-			fmt.Println("[DEBUG] 收到SST合并信号，开始合并...")
-			l.compactSSTables()
+			nodes[i] = node
+			info.Table = node.TableInfo("flush")
+			l.notify(func(listener config.EventListener) { listener.OnTableFileCreated(info.Table) })
+		}
+		infos = append(infos, info)
+	}
 
-		case <-time.After(1 * time.Second): // 添加超时检查，确保线程没有永久阻塞
-			if !l.isRunning.Load() {
-				fmt.Println("[DEBUG] LSM已经停止运行，合并工作线程退出")
-				return
+	l.mu.Lock()
+	immutable.flushing = false
+	immutable.flushed = true
+	for i, table := range immutable.tables {
+		table.node = nodes[i]
+	}
+	l.runningFlushes--
+	// 唤醒等待该内存表刷盘结束的DropColumnFamily
+	l.flushCond.Broadcast()
+	installed := l.installFlushes()
+	if len(installed) > 0 {
+		if err := l.saveManifest(); err != nil {
+			// 清单未记录新文件，对应的WAL必须保留，重新打开时重放
+			l.setBackgroundError(BackgroundOpManifest, err, true)
+			l.mu.Unlock()
+			l.fireEvents()
+			for _, info := range infos {
+				info.Duration = time.Since(startTime)
+				info.Err = err
+				l.notify(func(listener config.EventListener) { listener.OnFlushEnd(info) })
 			}
+			return
+		}
+	}
+	// 清单已记录更大的最早未刷盘WAL编号，在安装时按日志编号的顺序处理对应的WAL。
+	// 处理失败时WAL留在磁盘上，重新打开时按清单跳过，不影响写入
+	for _, done := range installed {
+		if done.wal == nil {
+			continue
+		}
+		if err := l.retireWal(done.wal); err != nil {
+			l.logger.Warn("处理已刷盘的WAL失败", "wal", done.wal.LogNum(), "error", err)
+		}
+	}
+	level0Count := len(l.defaultCF.nodes[0])
+	l.maybeSchedule()
+	l.mu.Unlock()
 
-			// 主动检查是否有需要合并的内存表
-			l.mu.RLock()
-			immCount := len(l.immutableMemtables)
-			l.mu.RUnlock()
+	// 安装后文件可能随时被合并关闭，只使用安装前记录的文件信息
+	duration := time.Since(startTime)
+	var files int
+	var bytes int64
+	for _, info := range infos {
+		if info.Table.Path != "" {
+			files++
+			bytes += info.Table.Bytes
+		}
+	}
+	l.conf.Statistics.Add(utils.TickerFlushes, 1)
+	l.conf.Statistics.Record(utils.HistogramFlushTime, duration)
+	l.conf.Statistics.Add(utils.TickerFlushBytes, uint64(bytes))
+	for _, info := range infos {
+		info.Duration = duration
+		l.notify(func(listener config.EventListener) { listener.OnFlushEnd(info) })
+	}
+
+	attrs := []any{"level", 0, "entries", entries, "l0_files", level0Count}
+	if files > 0 {
+		// file为默认列族的文件编号，多个列族同时刷盘时另外记录文件数
+		if len(infos) > 0 && infos[0].ColumnFamily == DefaultColumnFamilyName && infos[0].Table.Path != "" {
+			attrs = append(attrs, "file", infos[0].Table.FileNum)
+		}
+		if files > 1 {
+			attrs = append(attrs, "files", files)
+		}
+		attrs = append(attrs, "bytes", bytes)
+	}
+	if immutable.wal != nil {
+		attrs = append(attrs, "wal", immutable.wal.LogNum())
+	}
+	l.logger.Info("内存表刷盘完成", append(attrs, "duration", duration)...)
+	// 安装时登记的WAL事件在刷盘结束的事件之后回调
+	l.fireEvents()
+}
 
-			if immCount > 0 && !compactionInProgress.Load() {
-				if compactionInProgress.CompareAndSwap(false, true) {
-					fmt.Printf("[DEBUG] 定时检测到有 %d 个未合并的不可变内存表，触发合并\n", immCount)
-					l.compactMemTables()
-					compactionInProgress.Store(false)
+// installFlushes 从队首开始把已刷盘的内存表替换为各列族的0层文件，较早的内存表未完成时较新的继续等待，
+// 读取在同一把锁内切换，不会错过这部分数据。刷盘期间被删除的列族的文件直接删除。
+// 返回移出队列的内存表。调用方需持有写锁
+func (l *LSM) installFlushes() []*immutableMemtable {
+	var installed []*immutableMemtable
+	for len(l.immutableMemtables) > 0 && l.immutableMemtables[0].flushed {
+		immutable := l.immutableMemtables[0]
+		for _, table := range immutable.tables {
+			if table.node == nil {
+				continue
+			}
+			if table.cf.dropped {
+				table.node.Close()
+				// 列族目录可能已随DropColumnFamily删除
+				if err := os.Remove(table.node.path); err != nil && !os.IsNotExist(err) {
+					l.logger.Warn("删除已删除列族的SST文件失败", "path", table.node.path, "error", err)
 				}
+				continue
 			}
+			table.cf.nodes[0] = append(table.cf.nodes[0], table.node)
 		}
+		l.immutableMemtables = l.immutableMemtables[1:]
+		installed = append(installed, immutable)
+	}
+	if len(installed) > 0 {
+		l.flushCond.Broadcast()
 	}
+	return installed
 }
 
-// compactMemTables 将不可变memtable转换为SST文件
-func (l *LSM) compactMemTables() {
-	fmt.Println("[DEBUG] 开始执行 compactMemTables")
-	startTime := time.Now()
+// maxBytesForLevel 返回level层(level>=1)的大小上限
+func (l *LSM) maxBytesForLevel(level int) int64 {
+	limit := l.conf.MaxBytesForLevelBase
+	for i := 1; i < level; i++ {
+		limit *= int64(l.conf.LevelSizeMultiplier)
+	}
+	return limit
+}
 
-	l.mu.Lock()
-	if len(l.immutableMemtables) == 0 {
-		fmt.Println("[DEBUG] 没有不可变内存表需要合并，退出")
-		l.mu.Unlock()
-		return
+// levelBytes 返回列族level层文件的总大小。调用方需持有锁
+func (l *LSM) levelBytes(cf *ColumnFamily, level int) int64 {
+	var total int64
+	for _, node := range cf.nodes[level] {
+		total += node.Size()
 	}
+	return total
+}
 
-	// 取出第一个不可变memtable
-	immutable := l.immutableMemtables[0]
-	l.immutableMemtables = l.immutableMemtables[1:]
-	immCount := len(l.immutableMemtables)
-	fmt.Printf("[DEBUG] 取出一个不可变内存表，剩余 %d 个\n", immCount)
-	l.mu.Unlock()
+// pickCompaction 依次为各列族选择下一个可以执行的合并任务，没有时返回nil。调用方需持有写锁
+func (l *LSM) pickCompaction() *compaction {
+	for _, cf := range l.columnFamilies {
+		if cf.dropped {
+			continue
+		}
+		if c := l.pickColumnFamilyCompaction(cf); c != nil {
+			return c
+		}
+	}
+	return nil
+}
 
-	// 检查memtable是否为空
-	if immutable == nil || immutable.memtable == nil {
-		fmt.Println("[ERROR] 不可变内存表或内存表为空")
-		return
+// pickColumnFamilyCompaction 选择列族的下一个合并任务，没有时返回nil。
+// 输入文件不能正在被合并，输出范围也不能与同一层进行中的合并重叠，
+// 因此同时进行的合并总是作用于不同的层级或不相交的键范围。调用方需持有写锁
+func (l *LSM) pickColumnFamilyCompaction(cf *ColumnFamily) *compaction {
+	if len(cf.nodes) < 2 && l.conf.CompactionStyle != config.CompactionStyleFIFO {
+		return nil
+	}
+	switch l.conf.CompactionStyle {
+	case config.CompactionStyleUniversal:
+		return l.pickUniversalCompaction(cf)
+	case config.CompactionStyleFIFO:
+		return l.pickFIFOCompaction(cf)
 	}
 
-	// 检查memtable中的数据
-	iter := immutable.memtable.Iterator()
-	fmt.Println("[DEBUG] 开始遍历内存表数据")
-	dataCount := 0
-	for iter.Next() {
-		dataCount++
+	// 0层文件之间键范围重叠，一次合并全部文件，同一时间只能有一个0层合并
+	level0 := cf.nodes[0]
+	if len(level0) >= l.conf.Level0CompactionTrigger && !anyCompacting(level0) {
+		inputs := make([]*Node, 0, len(level0))
+		for i := len(level0) - 1; i >= 0; i-- {
+			inputs = append(inputs, level0[i])
+		}
+		if c := l.newCompaction(cf, 0, 1, inputs); c != nil {
+			c.reason = compactionReasonLevel0
+			return c
+		}
 	}
-	fmt.Printf("[DEBUG] 内存表中有 %d 条数据\n", dataCount)
-	if dataCount == 0 {
-		fmt.Println("[WARN] 内存表中没有数据，跳过SST创建")
-		// 仍需关闭并删除WAL
-		if immutable.wal != nil {
-			walPath := immutable.wal.FilePath()
-			if err := immutable.wal.Delete(); err != nil {
-				fmt.Printf("[ERROR] 删除空内存表的WAL文件失败: %v\n", err)
-			} else {
-				fmt.Printf("[DEBUG] 成功删除空内存表的WAL文件: %s\n", filepath.Base(walPath))
+
+	// 其余层级超出大小上限时，从上次合并的位置开始选一个文件合并到下一层
+	for level := 1; level < len(cf.nodes)-1; level++ {
+		nodes := cf.nodes[level]
+		if len(nodes) == 0 || l.levelBytes(cf, level) <= l.maxBytesForLevel(level) {
+			continue
+		}
+		start := sort.Search(len(nodes), func(i int) bool {
+			return utils.CompareBytes(nodes[i].SmallestKey(), cf.compactPointer[level]) > 0
+		})
+		for i := 0; i < len(nodes); i++ {
+			node := nodes[(start+i)%len(nodes)]
+			if node.compacting {
+				continue
+			}
+			if c := l.newCompaction(cf, level, level+1, []*Node{node}); c != nil {
+				c.reason = compactionReasonSize
+				cf.compactPointer[level] = node.LargestKey()
+				return c
 			}
 		}
-		return
 	}
+	return nil
+}
 
-	// 将memtable转换为SST文件
-	seq := l.levelId[0].Add(1) - 1
-	sstPath := fmt.Sprintf("%s/0_%d.sst", l.getSSTDir(), seq)
+// newCompaction 为列族level层的输入文件加上输出层中键范围重叠的文件，存在冲突时返回nil
+func (l *LSM) newCompaction(cf *ColumnFamily, level, outputLevel int, inputs []*Node) *compaction {
+	if outputLevel != level {
+		smallest, largest := keyRange(inputs)
+		for _, node := range cf.nodes[outputLevel] {
+			if !node.overlaps(smallest, largest) {
+				continue
+			}
+			if node.compacting {
+				return nil
+			}
+			inputs = append(inputs, node)
+		}
+	}
+	c := &compaction{cf: cf, level: level, outputLevel: outputLevel, inputs: inputs}
+	c.smallest, c.largest = keyRange(inputs)
+	for _, running := range l.runningCompactions {
+		if running.cf == cf && running.outputLevel == c.outputLevel &&
+			utils.CompareBytes(running.largest, c.smallest) >= 0 &&
+			utils.CompareBytes(running.smallest, c.largest) <= 0 {
+			return nil
+		}
+	}
 
-	fmt.Printf("[DEBUG] 开始将内存表转换为SST文件: %s\n", sstPath)
+	c.bottommost = isBottommost(cf, outputLevel, c.smallest, c.largest)
+	return c
+}
 
-	// 确保目录存在
-	sstDir := filepath.Dir(sstPath)
-	if err := os.MkdirAll(sstDir, 0755); err != nil {
-		fmt.Printf("[ERROR] 创建SST目录失败: %v\n", err)
-		return
+// isBottommost 列族中比outputLevel更低的层级中是否没有与[smallest, largest]重叠的文件。
+// 更低层级的数据只会来自与键范围重叠的输入文件，合并期间不会变化。调用方需持有锁
+func isBottommost(cf *ColumnFamily, outputLevel int, smallest, largest []byte) bool {
+	for lower := outputLevel + 1; lower < len(cf.nodes); lower++ {
+		for _, node := range cf.nodes[lower] {
+			if node.overlaps(smallest, largest) {
+				return false
+			}
+		}
 	}
-	fmt.Printf("[DEBUG] 确认目录存在: %s\n", sstDir)
+	return true
+}
 
-	// 创建SST Writer
-	writer, err := sstable.NewSSTWriter(sstPath, l.conf)
-	if err != nil {
-		fmt.Printf("[ERROR] 创建SST Writer失败: %v\n", err)
-		return
+// keyRange 返回一组文件的键范围
+func keyRange(nodes []*Node) (smallest, largest []byte) {
+	for i, node := range nodes {
+		if i == 0 || utils.CompareBytes(node.SmallestKey(), smallest) < 0 {
+			smallest = node.SmallestKey()
+		}
+		if i == 0 || utils.CompareBytes(node.LargestKey(), largest) > 0 {
+			largest = node.LargestKey()
+		}
 	}
-	fmt.Println("[DEBUG] 成功创建SST Writer")
+	return smallest, largest
+}
 
-	// 将memtable数据写入SST
-	fmt.Println("[DEBUG] 开始将内存表数据写入SST")
-	if err := writer.Write(immutable.memtable); err != nil {
-		fmt.Printf("[ERROR] 写入SST文件失败: %v\n", err)
-		writer.Close()
-		// 如果写入失败，删除可能已部分创建的文件
-		os.Remove(sstPath)
-		return
+func anyCompacting(nodes []*Node) bool {
+	for _, node := range nodes {
+		if node.compacting {
+			return true
+		}
 	}
-	fmt.Println("[DEBUG] 成功将内存表数据写入SST")
+	return false
+}
 
-	// 关闭SST写入器
-	if err := writer.Close(); err != nil {
-		fmt.Printf("[ERROR] 关闭SST文件失败: %v\n", err)
-		// 如果关闭失败，删除可能已部分创建的文件
-		os.Remove(sstPath)
-		return
+// runCompaction 执行合并任务，成功后用输出文件替换输入文件并删除输入文件，
+// 失败时删除已生成的输出文件并进入只读状态
+func (l *LSM) runCompaction(c *compaction) {
+	startTime := time.Now()
+	info := config.CompactionInfo{ColumnFamily: c.cf.name, Level: c.level, OutputLevel: c.outputLevel, Reason: c.reason}
+	for _, node := range c.inputs {
+		info.Inputs = append(info.Inputs, node.TableInfo("compaction"))
+		if !c.dropOnly {
+			info.ReadBytes += node.Size()
+		}
+	}
+	l.notify(func(listener config.EventListener) { listener.OnCompactionBegin(info) })
+	l.logger.Debug("开始合并", "cf", c.cf.name, "level", c.level, "output_level", c.outputLevel, "reason", c.reason,
+		"inputs", len(c.inputs), "bytes", info.ReadBytes)
+
+	var outputs []*Node
+	var err error
+	if !c.dropOnly {
+		outputs, err = l.doCompaction(c)
+	}
+	// 安装后输出文件可能随时被下一次合并关闭，先记录文件信息
+	for _, node := range outputs {
+		table := node.TableInfo("compaction")
+		info.Outputs = append(info.Outputs, table)
+		info.WriteBytes += table.Bytes
 	}
-	fmt.Println("[DEBUG] 成功关闭SST Writer")
-
-	fmt.Printf("[INFO] 成功创建SST文件: %s\n", sstPath)
 
-	// 添加到0级
-	node, err := NewNode(l.conf, 0, seq)
+	l.mu.Lock()
+	for _, node := range c.inputs {
+		node.compacting = false
+	}
+	for i, running := range l.runningCompactions {
+		if running == c {
+			l.runningCompactions = append(l.runningCompactions[:i], l.runningCompactions[i+1:]...)
+			break
+		}
+	}
+	// 唤醒等待该列族合并结束的DropColumnFamily
+	l.flushCond.Broadcast()
+	if c.manual != nil {
+		c.manual.done = true
+		c.manual.err = err
+		c.manual.outputs = outputs
+		l.flushCond.Broadcast()
+	}
 	if err != nil {
-		fmt.Printf("[ERROR] 创建SST节点失败: %v\n", err)
-		os.Remove(sstPath)
+		l.setBackgroundError(BackgroundOpCompaction, err, true)
+		l.mu.Unlock()
+		l.fireEvents()
+		info.Duration = time.Since(startTime)
+		info.Err = err
+		l.notify(func(listener config.EventListener) { listener.OnCompactionEnd(info) })
 		return
 	}
-	fmt.Println("[DEBUG] 成功创建SST节点")
-
-	l.mu.Lock()
-	l.nodes[0] = append(l.nodes[0], node)
-	level0Count := len(l.nodes[0])
-	fmt.Printf("[DEBUG] 成功将SST节点添加到0级，现在0级有 %d 个节点\n", level0Count)
+	l.installCompaction(c, outputs)
+	if err := l.saveManifest(); err != nil {
+		// 清单中仍是输入文件，重新打开时输出文件作为残留文件删除，输入文件必须保留
+		l.setBackgroundError(BackgroundOpManifest, err, true)
+		l.mu.Unlock()
+		l.fireEvents()
+		for _, node := range c.inputs {
+			node.Close()
+		}
+		info.Duration = time.Since(startTime)
+		info.Err = err
+		l.notify(func(listener config.EventListener) { listener.OnCompactionEnd(info) })
+		return
+	}
+	l.maybeSchedule()
 	l.mu.Unlock()
 
-	// 获取WAL文件路径并关闭WAL
-	if immutable.wal != nil {
-		// 使用 WAL 的 Delete 方法一步完成关闭和删除
-		walPath := immutable.wal.FilePath()
-		fmt.Printf("[DEBUG] 准备删除WAL文件: %s\n", walPath)
-		if err := immutable.wal.Delete(); err != nil {
-			fmt.Printf("[ERROR] 删除WAL文件失败: %v\n", err)
-		} else {
-			fmt.Printf("[INFO] 成功删除WAL文件: %s\n", filepath.Base(walPath))
+	// 输入文件已不再可见，读取都在锁内完成，可以安全关闭并删除
+	var removeErr error
+	for _, node := range c.inputs {
+		table := node.TableInfo("compaction")
+		if err := node.Close(); err != nil {
+			l.logger.Warn("关闭SSTable节点失败", "level", node.level, "file", node.seq, "error", err)
 		}
-	} else {
-		fmt.Println("[WARN] 没有WAL文件，跳过删除")
+		if err := os.Remove(node.path); err != nil {
+			l.logger.Error("删除合并输入文件失败", "path", node.path, "error", err)
+			if removeErr == nil {
+				removeErr = err
+			}
+			continue
+		}
+		l.notify(func(listener config.EventListener) { listener.OnTableFileDeleted(table) })
 	}
 
-	// 检查是否需要继续压缩
-	l.mu.RLock()
-	immCount = len(l.immutableMemtables)
-	l.mu.RUnlock()
-
-	if immCount > 0 {
-		fmt.Printf("[DEBUG] 还有 %d 个不可变内存表需要合并，继续合并操作\n", immCount)
-		// 不需要发送信号，直接在当前线程继续处理
-		l.compactMemTables()
-	} else {
-		fmt.Println("[DEBUG] 没有更多不可变内存表需要合并")
+	duration := time.Since(startTime)
+	for _, table := range info.Outputs {
+		l.notify(func(listener config.EventListener) { listener.OnTableFileCreated(table) })
 	}
+	l.conf.Statistics.Add(utils.TickerCompactions, 1)
+	l.conf.Statistics.Add(utils.TickerCompactionReadBytes, uint64(info.ReadBytes))
+	l.conf.Statistics.Add(utils.TickerCompactionWriteBytes, uint64(info.WriteBytes))
+	l.conf.Statistics.Record(utils.HistogramCompactionTime, duration)
+	info.Duration = duration
+	l.notify(func(listener config.EventListener) { listener.OnCompactionEnd(info) })
+	l.logger.Info("合并完成", "cf", c.cf.name, "level", c.level, "output_level", c.outputLevel, "reason", c.reason, "inputs", len(c.inputs),
+		"outputs", len(outputs), "read_bytes", info.ReadBytes, "write_bytes", info.WriteBytes, "duration", duration)
+
+	// 残留的输入文件在重新打开时会与输出文件重叠，需要人工处理后再恢复写入
+	if removeErr != nil {
+		l.mu.Lock()
+		l.setBackgroundError(BackgroundOpCompaction, removeErr, true)
+		l.mu.Unlock()
+		l.fireEvents()
+	}
+}
 
-	// 检查L0是否需要压缩到L1
-	l.mu.RLock()
-	level0Count = len(l.nodes[0])
-	l.mu.RUnlock()
+// doCompaction 归并输入文件并应用合并过滤器，按TargetFileSize切分写入输出层，输出层是最底层时丢弃删除标记。
+// 整个键范围被较新的输入文件中的范围删除标记覆盖的文件不读取，被覆盖的键不写入输出文件
+func (l *LSM) doCompaction(c *compaction) (outputs []*Node, err error) {
+	defer func() {
+		if err != nil {
+			for _, node := range outputs {
+				node.Close()
+				os.Remove(node.path)
+			}
+			outputs = nil
+		}
+	}()
 
-	if level0Count > defaultLevel0CompactThreshold {
-		fmt.Printf("[DEBUG] L0级节点数量(%d)超过阈值(%d)，需要进行SST合并\n",
-			level0Count, defaultLevel0CompactThreshold)
-		select {
-		case l.sstChan <- struct{}{}:
-			fmt.Println("[DEBUG] 成功发送SST合并信号")
-		default:
-			fmt.Println("[WARN] SST合并通道已满，跳过发送信号")
+	iters := make([]sstable.Iterator, 0, len(c.inputs))
+	rangeDels := make([][]sstable.RangeTombstone, 0, len(c.inputs))
+	var newer, tombstones []sstable.RangeTombstone
+	var dropped int
+	for _, node := range c.inputs {
+		if rangeCovers(newer, node.SmallestKey(), node.LargestKey()) {
+			dropped++
+			continue
 		}
+		iters = append(iters, node.Iterator())
+		rangeDels = append(rangeDels, node.reader.RangeTombstones())
+		newer = append(newer, node.reader.RangeTombstones()...)
+		tombstones = append(tombstones, node.reader.RangeTombstones()...)
 	}
+	if dropped > 0 {
+		l.logger.Debug("跳过被范围删除覆盖的文件", "level", c.level, "files", dropped)
+	}
+	merged := newMergingIterator(iters, rangeDels)
 
-	elapsedTime := time.Since(startTime)
-	fmt.Printf("[DEBUG] compactMemTables 执行完成，耗时: %v\n", elapsedTime)
+	// 输出层不是最底层时保留范围删除标记，合并重叠的标记后各自完整地写入一个输出文件，
+	// 不在标记的范围内切分文件，保证同一层的文件互不重叠
+	if c.bottommost {
+		tombstones = nil
+	}
+	tombstones = mergeRangeTombstones(tombstones)
+	var writer *sstable.SSTWriter // 当前的输出文件
+	var seq uint32
+	var lastKey []byte
+	defer func() {
+		if writer != nil {
+			writer.Abandon()
+		}
+	}()
+	finishOutput := func(final bool) error {
+		if writer == nil {
+			if writer, seq, err = l.createTable(c.cf, c.outputLevel); err != nil {
+				return err
+			}
+		}
+		n := len(tombstones)
+		if !final {
+			n = sort.Search(len(tombstones), func(i int) bool {
+				return utils.CompareBytes(tombstones[i].Start, lastKey) > 0
+			})
+		}
+		for _, t := range tombstones[:n] {
+			writer.AddRangeTombstone(t.Start, t.End)
+		}
+		tombstones = tombstones[n:]
+		node, err := l.finishTable(c.cf, writer, c.outputLevel, seq)
+		writer = nil
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, node)
+		return nil
+	}
+	filter := l.conf.CompactionFilter
+	now := l.now()
+	var removed, changed, cancelled int
+	for ; merged.Valid(); merged.Next() {
+		value := merged.Value()
+		if kind, _ := decodeValue(value); kind == kindSingleDeletion {
+			// 单删除标记与紧接着的一次写入相互抵消，两者都不输出；没有遇到写入时按删除标记处理
+			if versions := merged.Versions(); len(versions) > 1 {
+				if next, _ := decodeValue(versions[1]); next == kindValue || next == kindExpiringValue {
+					cancelled++
+					continue
+				}
+			}
+		}
+		if kind, _ := decodeValue(value); kind == kindMerge {
+			// 输出层是最底层时更低的层级中没有基础值，可以完全解析，否则只合并相邻的操作数
+			value, err = l.resolveVersions(merged.Key(), merged.Versions(), c.bottommost)
+			if err != nil {
+				return outputs, fmt.Errorf("解析合并操作数失败: %w", err)
+			}
+		}
+		kind, userValue, expiresAt := decodeEntry(value, now)
+		if kind == kindDeletion {
+			// 已过期的值与删除标记相同，需要遮蔽更低层级中的旧值
+			value = encodeValue(kindDeletion, nil)
+		}
+		if kind == kindValue && filter != nil {
+			switch decision, newValue := filter.Filter(c.level, merged.Key(), userValue); decision {
+			case config.CompactionDecisionRemove:
+				// 更低的层级中可能还有旧值，写入删除标记遮蔽，到最底层时再丢弃
+				kind, value = kindDeletion, encodeValue(kindDeletion, nil)
+				removed++
+			case config.CompactionDecisionChangeValue:
+				value = encodeEntry(newValue, expiresAt)
+				changed++
+			}
+		}
+		if isDeletion(kind) && c.bottommost {
+			continue
+		}
+		if writer != nil && writer.FileSize() >= l.conf.TargetFileSize && !rangeCovers(tombstones, lastKey, merged.Key()) {
+			if err := finishOutput(false); err != nil {
+				return outputs, err
+			}
+		}
+		if writer == nil {
+			if writer, seq, err = l.createTable(c.cf, c.outputLevel); err != nil {
+				return outputs, err
+			}
+		}
+		if err := addTableEntry(writer, merged.Key(), value); err != nil {
+			return outputs, fmt.Errorf("写入合并输出文件失败: %w", err)
+		}
+		lastKey = merged.Key()
+	}
+	if err := merged.Err(); err != nil {
+		return outputs, fmt.Errorf("读取合并输入文件失败: %w", err)
+	}
+	if writer != nil || len(tombstones) > 0 {
+		if err := finishOutput(true); err != nil {
+			return outputs, err
+		}
+	}
+	if cancelled > 0 {
+		l.logger.Debug("单删除标记与写入相互抵消", "level", c.level, "keys", cancelled)
+	}
+	if removed > 0 || changed > 0 {
+		l.logger.Debug("合并过滤器处理完成", "filter", filter.Name(), "level", c.level,
+			"removed", removed, "changed", changed)
+	}
+	return outputs, nil
 }
 
-// compactSSTables 合并SST文件到下一层
-func (l *LSM) compactSSTables() {
-	fmt.Println("[DEBUG] 开始执行 compactSSTables")
+// installCompaction 用输出文件替换输入文件，输出层的文件按最小键排序。调用方需持有写锁
+func (l *LSM) installCompaction(c *compaction, outputs []*Node) {
+	removed := make(map[*Node]bool, len(c.inputs))
+	levels := make(map[int]bool)
+	for _, node := range c.inputs {
+		removed[node] = true
+		levels[node.level] = true
+	}
+	nodes := c.cf.nodes
+	for level := range levels {
+		kept := nodes[level][:0]
+		for _, node := range nodes[level] {
+			if !removed[node] {
+				kept = append(kept, node)
+			}
+		}
+		nodes[level] = kept
+	}
+	if len(outputs) > 0 {
+		nodes[c.outputLevel] = append(nodes[c.outputLevel], outputs...)
+		sortBySmallestKey(nodes[c.outputLevel])
+	}
+}
 
-	// 简单实现，仅检查L0是否超过阈值
-	l.mu.Lock()
-	defer l.mu.Unlock()
+// sortBySmallestKey 按最小键排序同一层的文件
+func sortBySmallestKey(nodes []*Node) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return utils.CompareBytes(nodes[i].SmallestKey(), nodes[j].SmallestKey()) < 0
+	})
+}
 
-	level0Count := len(l.nodes[0])
-	if level0Count <= defaultLevel0CompactThreshold {
-		fmt.Printf("[DEBUG] L0级节点数量(%d)未超过阈值(%d)，无需合并\n",
-			level0Count, defaultLevel0CompactThreshold)
-		return
+// writeTable 将内存表和其中的范围删除标记写入列族level层编号为seq的SST文件并打开对应的节点，失败时删除残留文件
+func (l *LSM) writeTable(cf *ColumnFamily, mem *memTable, level int, seq uint32) (*Node, error) {
+	writer, err := sstable.NewSSTWriter(tablePath(cf, level, seq), cf.conf)
+	if err != nil {
+		return nil, fmt.Errorf("创建SST Writer失败: %w", err)
+	}
+	for _, t := range mem.rangeDels {
+		writer.AddRangeTombstone(t.Start, t.End)
 	}
+	iter := mem.Iterator()
+	for iter.Next() {
+		if err := addTableEntry(writer, iter.Key(), iter.Value()); err != nil {
+			writer.Abandon()
+			return nil, fmt.Errorf("写入SST文件失败: %w", err)
+		}
+	}
+	return l.finishTable(cf, writer, level, seq)
+}
 
-	// 这里应该实现复杂的合并逻辑，但本示例仅空实现
-	fmt.Printf("[INFO] 进行SST合并操作，当前L0有%d个文件\n", level0Count)
+// addTableEntry 向SST文件添加编码后的值，删除标记计入文件属性中的删除数量
+func addTableEntry(writer *sstable.SSTWriter, key, value []byte) error {
+	if kind, _ := decodeValue(value); isDeletion(kind) {
+		return writer.AddDeletion(key, value)
+	}
+	return writer.Add(key, value)
+}
 
-	// TODO: 实现SST文件的合并逻辑
+// createTable 在列族level层分配文件编号并创建SST文件，返回增量写入器
+func (l *LSM) createTable(cf *ColumnFamily, level int) (*sstable.SSTWriter, uint32, error) {
+	seq := cf.levelId[level].Add(1) - 1
+	writer, err := sstable.NewSSTWriter(tablePath(cf, level, seq), cf.conf)
+	if err != nil {
+		return nil, 0, fmt.Errorf("创建SST Writer失败: %w", err)
+	}
+	return writer, seq, nil
+}
 
-	fmt.Println("[DEBUG] compactSSTables 执行完成")
+// finishTable 完成SST文件的写入并打开对应的节点，失败时删除文件
+func (l *LSM) finishTable(cf *ColumnFamily, writer *sstable.SSTWriter, level int, seq uint32) (*Node, error) {
+	if err := writer.Finish(); err != nil {
+		writer.Abandon()
+		return nil, fmt.Errorf("写入SST文件失败: %w", err)
+	}
+	node, err := NewNode(cf.conf, level, seq)
+	if err != nil {
+		os.Remove(tablePath(cf, level, seq))
+		return nil, fmt.Errorf("创建SST节点失败: %w", err)
+	}
+	node.cf = cf
+	node.createdAt = l.conf.Clock.Now()
+	return node, nil
 }
 
-// createSSTFromMemtable 从memtable创建SST文件
-func createSSTFromMemtable(memtable interface{}, conf *config.Config, path string) (interface{}, error) {
-	// 根据实际实现来创建SST文件
-	// 这里是一个简化的空实现
-	return nil, nil
+// tablePath 返回列族level层编号为seq的SST文件的路径
+func tablePath(cf *ColumnFamily, level int, seq uint32) string {
+	return fmt.Sprintf("%s/%d_%d.sst", cf.sstDir(), level, seq)
 }
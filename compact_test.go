@@ -0,0 +1,330 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+// waitForBackgroundWork 等待刷盘和合并全部完成，并且没有需要继续合并的层级
+func waitForBackgroundWork(t *testing.T, l *LSM) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		l.mu.Lock()
+		idle := len(l.immutableMemtables) == 0 && l.runningFlushes == 0 &&
+			len(l.runningCompactions) == 0 && l.pickCompaction() == nil
+		l.mu.Unlock()
+		if idle {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("background work did not finish")
+}
+
+// checkLevels 检查1层及以上的文件按键排序且互不重叠
+func checkLevels(t *testing.T, l *LSM) {
+	t.Helper()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for level := 1; level < len(l.defaultCF.nodes); level++ {
+		nodes := l.defaultCF.nodes[level]
+		for i := 1; i < len(nodes); i++ {
+			if utils.CompareBytes(nodes[i-1].LargestKey(), nodes[i].SmallestKey()) >= 0 {
+				t.Fatalf("level %d files overlap: %s > %s", level, nodes[i-1].LargestKey(), nodes[i].SmallestKey())
+			}
+		}
+	}
+}
+
+func TestCompaction_MultipleInstances(t *testing.T) {
+	dataCount := 200
+	instances := make([]*LSM, 2)
+	for i := range instances {
+		conf := config.NewConfig()
+		conf.DataDir = t.TempDir()
+		conf.MemTableCapSize = 256
+		l, err := NewLSM(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		instances[i] = l
+	}
+
+	// 两个实例并发写入，互不阻塞对方的刷盘和合并
+	var wg sync.WaitGroup
+	errs := make(chan error, len(instances))
+	for n, l := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < dataCount; i++ {
+				if err := l.Put(utils.GenerateKey(i), []byte(fmt.Sprintf("db%d-%d", n, i))); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for n, l := range instances {
+		waitForBackgroundWork(t, l)
+		checkLevels(t, l)
+		if stats := l.Stats(); stats.Flushes == 0 || stats.Compactions == 0 {
+			t.Fatalf("db%d: expected flushes and compactions, got %d and %d", n, stats.Flushes, stats.Compactions)
+		}
+		for i := 0; i < dataCount; i++ {
+			value, found, err := l.Get(utils.GenerateKey(i))
+			if err != nil || !found || string(value) != fmt.Sprintf("db%d-%d", n, i) {
+				t.Fatalf("db%d: key %d: value=%q, found=%v, err=%v", n, i, value, found, err)
+			}
+		}
+	}
+}
+
+func TestCompaction_Leveled(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+	conf.Level0CompactionTrigger = 2
+	conf.MaxBytesForLevelBase = 1024
+	conf.TargetFileSize = 512
+	conf.MaxBackgroundFlushes = 2
+	conf.MaxBackgroundCompactions = 2
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 多轮覆盖写入，合并后每个键只保留最后一轮的值
+	dataCount, rounds := 100, 3
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < dataCount; i++ {
+			if err := lsm.Put(utils.GenerateKey(i), []byte(fmt.Sprintf("round-%d-%d", round, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	waitForBackgroundWork(t, lsm)
+	checkLevels(t, lsm)
+
+	stats := lsm.Stats()
+	if stats.Levels[2].Files == 0 {
+		t.Fatalf("expected compaction into level 2: %+v", stats.Levels)
+	}
+	if stats.CompactionReadBytes == 0 || stats.CompactionTime.Count != stats.Compactions {
+		t.Fatalf("unexpected compaction stats: %+v", stats)
+	}
+
+	verify := func() {
+		t.Helper()
+		for i := 0; i < dataCount; i++ {
+			want := fmt.Sprintf("round-%d-%d", rounds-1, i)
+			value, found, err := lsm.Get(utils.GenerateKey(i))
+			if err != nil || !found || string(value) != want {
+				t.Fatalf("key %d: value=%q, found=%v, err=%v, want %q", i, value, found, err, want)
+			}
+		}
+	}
+	verify()
+
+	// 重新打开后层级结构和数据保持不变
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	checkLevels(t, lsm)
+	verify()
+}
+
+func TestCompaction_Universal(t *testing.T) {
+	listener := &recordingListener{}
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+	conf.CompactionStyle = config.CompactionStyleUniversal
+	conf.UniversalMaxSortedRuns = 2
+	conf.MaxBackgroundFlushes = 2
+	conf.MaxBackgroundCompactions = 2
+	conf.Listeners = []config.EventListener{listener}
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 多轮覆盖写入并删除部分键，较新的有序段必须始终位于较旧的之上
+	dataCount, rounds := 100, 3
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < dataCount; i++ {
+			if err := lsm.Put(utils.GenerateKey(i), []byte(fmt.Sprintf("round-%d-%d", round, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < dataCount; i += 3 {
+		if err := lsm.Delete(utils.GenerateKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	waitForBackgroundWork(t, lsm)
+	checkLevels(t, lsm)
+
+	lsm.mu.RLock()
+	runs := len(lsm.sortedRuns(lsm.defaultCF))
+	lsm.mu.RUnlock()
+	if runs > conf.UniversalMaxSortedRuns {
+		t.Fatalf("expected at most %d sorted runs, got %d", conf.UniversalMaxSortedRuns, runs)
+	}
+	listener.mu.Lock()
+	if len(listener.compactions) == 0 {
+		t.Fatal("expected compactions")
+	}
+	for _, info := range listener.compactions {
+		if !strings.HasPrefix(info.Reason, "universal-") || info.Err != nil {
+			t.Fatalf("unexpected compaction: %+v", info)
+		}
+	}
+	listener.mu.Unlock()
+
+	verify := func() {
+		t.Helper()
+		for i := 0; i < dataCount; i++ {
+			value, found, err := lsm.Get(utils.GenerateKey(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i%3 == 0 {
+				if found {
+					t.Fatalf("deleted key %d found: %q", i, value)
+				}
+				continue
+			}
+			if want := fmt.Sprintf("round-%d-%d", rounds-1, i); !found || string(value) != want {
+				t.Fatalf("key %d: value=%q, found=%v, want %q", i, value, found, want)
+			}
+		}
+	}
+	verify()
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	verify()
+}
+
+// tenantFilter 删除指定租户的键，并把其余的值改写为大写
+type tenantFilter struct {
+	prefix []byte
+}
+
+func (f *tenantFilter) Name() string { return "tenant-filter" }
+
+func (f *tenantFilter) Filter(level int, key, value []byte) (config.CompactionDecision, []byte) {
+	if bytes.HasPrefix(key, f.prefix) {
+		return config.CompactionDecisionRemove, nil
+	}
+	return config.CompactionDecisionChangeValue, bytes.ToUpper(value)
+}
+
+func TestCompaction_Filter(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+	conf.Level0CompactionTrigger = 1000
+	conf.CompactionFilter = &tenantFilter{prefix: []byte("tenant-a/")}
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	dataCount := 50
+	for _, tenant := range []string{"tenant-a/", "tenant-b/"} {
+		for i := 0; i < dataCount; i++ {
+			if err := lsm.Put([]byte(fmt.Sprintf("%s%03d", tenant, i)), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 合并前过滤器不生效
+	if value, found, err := lsm.Get([]byte("tenant-a/000")); err != nil || !found || string(value) != "value-0" {
+		t.Fatalf("before compaction: value=%q, found=%v, err=%v", value, found, err)
+	}
+	if err := lsm.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < dataCount; i++ {
+		if value, found, err := lsm.Get([]byte(fmt.Sprintf("tenant-a/%03d", i))); err != nil || found {
+			t.Fatalf("tenant-a key %d: value=%q, found=%v, err=%v", i, value, found, err)
+		}
+		want := fmt.Sprintf("VALUE-%d", i)
+		if value, found, err := lsm.Get([]byte(fmt.Sprintf("tenant-b/%03d", i))); err != nil || !found || string(value) != want {
+			t.Fatalf("tenant-b key %d: value=%q, found=%v, err=%v, want %q", i, value, found, err, want)
+		}
+	}
+}
+
+func TestFlush_RetiresWalsOnInstall(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 512
+	conf.MaxBackgroundFlushes = 4
+	conf.WalRecycleNum = 0
+	conf.Level0CompactionTrigger = 1000
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 300; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// 已刷盘的WAL在安装时按顺序删除，刷盘返回时只剩当前的WAL
+	lsm.mu.RLock()
+	current := lsm.currWal.FilePath()
+	lsm.mu.RUnlock()
+	wals, err := filepath.Glob(filepath.Join(lsm.getWalDir(), "*.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wals) != 1 || wals[0] != filepath.Clean(current) {
+		t.Fatalf("expected only the current WAL %s, got %v", current, wals)
+	}
+}
@@ -0,0 +1,29 @@
+package config
+
+import "github.com/aixiasang/sqldb/memtable"
+
+// ColumnFamilyOptions 列族的独立选项，创建列族时记录在清单中。
+// BlockSize和布隆过滤器参数为0时沿用LSM的配置，MemTableType的零值即默认的B树内存表
+type ColumnFamilyOptions struct {
+	MemTableType         memtable.MemTableType `json:"memtable_type"`
+	BlockSize            int64                 `json:"block_size,omitempty"`
+	BloomFilterSize      uint64                `json:"bloom_filter_size,omitempty"`
+	BloomFilterHashCount uint                  `json:"bloom_filter_hash_count,omitempty"`
+}
+
+// ForColumnFamily 返回列族使用的配置：复制当前配置，SST文件放在sstDir中，并应用列族的选项
+func (c *Config) ForColumnFamily(sstDir string, opts ColumnFamilyOptions) *Config {
+	conf := *c
+	conf.SSTDir = sstDir
+	conf.MemTableType = opts.MemTableType
+	if opts.BlockSize > 0 {
+		conf.BlockSize = opts.BlockSize
+	}
+	if opts.BloomFilterSize > 0 {
+		conf.BloomFilterSize = opts.BloomFilterSize
+	}
+	if opts.BloomFilterHashCount > 0 {
+		conf.BloomFilterHashCount = opts.BloomFilterHashCount
+	}
+	return &conf
+}
@@ -0,0 +1,19 @@
+package config
+
+// CompactionDecision 合并过滤器对一个键值对的处理方式
+type CompactionDecision int
+
+const (
+	CompactionDecisionKeep        CompactionDecision = iota // 保留原值
+	CompactionDecisionRemove                                // 删除该键
+	CompactionDecisionChangeValue                           // 用newValue替换原值
+)
+
+// CompactionFilter 在合并时检查每个键参与合并的最新值，决定保留、删除或改写，
+// 用于过期会话、清理整个租户的键空间等不便逐个调用Delete的场景。
+// 只对有效值调用，不会看到删除标记；内存表和未参与合并的文件中的数据在下次合并前仍然可见。
+// Filter在后台合并线程中并发调用，需要并发安全，不能调用LSM的方法
+type CompactionFilter interface {
+	Name() string                                                                       // 过滤器名称，用于日志
+	Filter(level int, key, value []byte) (decision CompactionDecision, newValue []byte) // level为合并的输入层级
+}
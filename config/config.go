@@ -1,23 +1,61 @@
 package config
 
 import (
+	"time"
+
 	"github.com/aixiasang/sqldb/filter"
 	"github.com/aixiasang/sqldb/memtable"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+const (
+	DefaultBlockSize                = 4096
+	DefaultBloomFilterSize          = 1024
+	DefaultBloomFilterHashCount     = 3
+	DefaultMemTableType             = memtable.MemTableTypeBTree
+	DefaultWalDir                   = "wal"
+	DefaultSSTDir                   = "sst"
+	DefaultAutoSync                 = false
+	DefaultIsDebug                  = false
+	DefaultMemTableCapSize          = 4096
+	DefaultMaxLevel                 = 7
+	DefaultWalPreallocate           = true
+	DefaultWalRecycleNum            = 4
+	DefaultMaxBackgroundFlushes     = 1
+	DefaultMaxBackgroundCompactions = 1
+	DefaultLevel0CompactionTrigger  = 4
+	DefaultMaxBytesForLevelBase     = 10 << 20
+	DefaultLevelSizeMultiplier      = 10
+	DefaultTargetFileSize           = 2 << 20
+)
+
+// CompactionStyle 合并策略
+type CompactionStyle int
+
+const (
+	CompactionStyleLeveled   CompactionStyle = iota // 分层合并：每层大小按倍数递增，读放大和空间放大小
+	CompactionStyleUniversal                        // 通用合并：合并大小相近的有序段，写放大小
+	CompactionStyleFIFO                             // FIFO合并：不归并，按创建时间整体删除最旧的文件，适合时序和缓存数据
 )
 
 const (
-	DefaultBlockSize            = 4096
-	DefaultBloomFilterSize      = 1024
-	DefaultBloomFilterHashCount = 3
-	DefaultMemTableType         = memtable.MemTableTypeBTree
-	DefaultWalDir               = "wal"
-	DefaultSSTDir               = "sst"
-	DefaultAutoSync             = false
-	DefaultIsDebug              = false
-	DefaultMemTableCapSize      = 4096
-	DefaultMaxLevel             = 7
+	DefaultCompactionStyle                      = CompactionStyleLeveled
+	DefaultUniversalSizeRatio                   = 1
+	DefaultUniversalMaxSortedRuns               = 4
+	DefaultUniversalMaxSizeAmplificationPercent = 200
+	DefaultFIFOMaxTableFilesSize                = 1 << 30
 )
 
+// Clock 时间来源，测试中可以替换为手动推进的时钟
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock 使用系统时间
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time { return time.Now() }
+
 type Config struct {
 	DataDir         string // 数据目录
 	BlockSize       int64  // 块大小
@@ -27,6 +65,47 @@ type Config struct {
 	MemTableCapSize int64  // 内存表容量
 	SSTDir          string // SST目录
 	MaxLevel        int    // LSM树最大层级数
+	WalPreallocate  bool   // 是否为WAL文件预分配空间
+	WalRecycleNum   int    // 保留用于复用的WAL文件数量，0表示不复用
+
+	MemTableType         memtable.MemTableType // 内存表类型
+	BloomFilterSize      uint64                // 布隆过滤器的位数，0表示使用默认值
+	BloomFilterHashCount uint                  // 布隆过滤器的哈希函数数量，0表示使用默认值
+
+	WalArchiveDir       string        // WAL归档目录(相对DataDir)，为空表示不归档；开启归档后不再复用WAL
+	WalArchiveTTL       time.Duration // 归档WAL的保留时长，0表示不限
+	WalArchiveSizeLimit int64         // 归档WAL的总大小上限，0表示不限
+
+	Logger Logger // 日志器，为nil时丢弃日志(IsDebug为true时输出调试日志到标准错误)
+
+	Statistics            *utils.Statistics // 统计信息，为nil时由NewLSM创建；多个实例共享时统计会合并
+	BlockCache            *utils.BlockCache // SST数据块缓存，默认为nil即不缓存，可用utils.NewBlockCache创建
+	MaxImmutableMemtables int               // 等待刷盘的不可变内存表达到该数量时阻塞写入，默认为0即不限制
+
+	Listeners []EventListener // 事件监听器，按顺序同步回调
+
+	MaxBackgroundFlushes     int   // 同时进行的刷盘任务数上限，小于1时按1处理
+	MaxBackgroundCompactions int   // 同时进行的合并任务数上限，小于1时按1处理
+	Level0CompactionTrigger  int   // 0层文件数达到该值时合并到1层
+	MaxBytesForLevelBase     int64 // 1层的大小上限，超出时合并到下一层
+	LevelSizeMultiplier      int   // 相邻层级大小上限的倍数
+	TargetFileSize           int64 // 合并输出的单个SST文件大小
+
+	CompactionStyle CompactionStyle // 合并策略
+	// 通用合并：0层的每个文件和1层及以上每个非空层级各为一个有序段
+	UniversalSizeRatio                   int // 有序段的大小不超过前面已选有序段总大小的(100+该值)%时一起合并
+	UniversalMaxSortedRuns               int // 有序段数量超过该值时触发合并
+	UniversalMaxSizeAmplificationPercent int // 除最旧有序段外的总大小超过最旧有序段的该百分比时全部合并
+	// FIFO合并：所有文件都留在0层
+	FIFOMaxTableFilesSize int64         // SST文件的总大小上限，超出时删除最旧的文件
+	FIFOTTL               time.Duration // 文件创建后的保留时长，0表示不限
+
+	CompactionFilter CompactionFilter // 合并时过滤或改写键值对，为nil时不过滤
+	MergeOperator    MergeOperator    // 解析Merge写入的操作数，为nil时不支持Merge
+
+	Clock Clock // 时间来源，用于判断键是否过期和记录SST的创建时间，为nil时使用系统时间
+
+	FlushOnClose bool // 关闭时将可变内存表刷盘，重新打开时无需重放WAL
 }
 
 func NewConfig() *Config {
@@ -39,8 +118,42 @@ func NewConfig() *Config {
 		MemTableCapSize: DefaultMemTableCapSize,
 		SSTDir:          DefaultSSTDir,
 		MaxLevel:        DefaultMaxLevel,
+		WalPreallocate:  DefaultWalPreallocate,
+		WalRecycleNum:   DefaultWalRecycleNum,
+
+		MemTableType:         DefaultMemTableType,
+		BloomFilterSize:      DefaultBloomFilterSize,
+		BloomFilterHashCount: DefaultBloomFilterHashCount,
+
+		Statistics: utils.NewStatistics(),
+
+		MaxBackgroundFlushes:     DefaultMaxBackgroundFlushes,
+		MaxBackgroundCompactions: DefaultMaxBackgroundCompactions,
+		Level0CompactionTrigger:  DefaultLevel0CompactionTrigger,
+		MaxBytesForLevelBase:     DefaultMaxBytesForLevelBase,
+		LevelSizeMultiplier:      DefaultLevelSizeMultiplier,
+		TargetFileSize:           DefaultTargetFileSize,
+
+		CompactionStyle:                      DefaultCompactionStyle,
+		UniversalSizeRatio:                   DefaultUniversalSizeRatio,
+		UniversalMaxSortedRuns:               DefaultUniversalMaxSortedRuns,
+		UniversalMaxSizeAmplificationPercent: DefaultUniversalMaxSizeAmplificationPercent,
+		FIFOMaxTableFilesSize:                DefaultFIFOMaxTableFilesSize,
+
+		Clock: SystemClock{},
 	}
 }
+
+// NewMemTable 按MemTableType创建内存表
+func (c *Config) NewMemTable() memtable.MemTable {
+	return memtable.NewMemTable(c.MemTableType, DefaultMemTableCapSize)
+}
+
+// NewFilter 按布隆过滤器参数创建过滤器
+func (c *Config) NewFilter() filter.Filter {
+	return filter.NewBloomFilter(c.BloomFilterSize, c.BloomFilterHashCount)
+}
+
 func NewMemTableConstructor() memtable.MemTable {
 	return memtable.NewMemTable(DefaultMemTableType, DefaultMemTableCapSize)
 }
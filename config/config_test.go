@@ -1,9 +1,33 @@
 package config
 
-import "testing"
+import (
+	"io"
+	"log/slog"
+	"testing"
+)
 
 func TestConfig(t *testing.T) {
 	conf := NewConfig()
 	t.Log(conf)
 
 }
+
+func TestGetLogger(t *testing.T) {
+	var conf *Config
+	if conf.GetLogger() != discardLogger {
+		t.Fatal("expected discard logger for nil config")
+	}
+	conf = NewConfig()
+	if conf.GetLogger() != discardLogger {
+		t.Fatal("expected discard logger by default")
+	}
+	conf.IsDebug = true
+	if conf.GetLogger() != debugLogger {
+		t.Fatal("expected debug logger when IsDebug is set")
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	conf.Logger = logger
+	if conf.GetLogger() != logger {
+		t.Fatal("expected configured logger")
+	}
+}
@@ -0,0 +1,94 @@
+package config
+
+import "time"
+
+// EventListener 接收引擎后台事件的回调。回调在触发事件的线程中、释放LSM的内部锁之后同步执行，
+// 回调中可以调用LSM的方法，但不应长时间阻塞。
+// 只关心部分事件时可以嵌入NoopEventListener
+type EventListener interface {
+	OnFlushBegin(info FlushInfo)                // 内存表开始刷盘
+	OnFlushEnd(info FlushInfo)                  // 内存表刷盘结束，失败时Err非nil
+	OnCompactionBegin(info CompactionInfo)      // SST开始合并
+	OnCompactionEnd(info CompactionInfo)        // SST合并结束，失败时Err非nil
+	OnTableFileCreated(info TableFileInfo)      // 生成了新的SST文件
+	OnTableFileDeleted(info TableFileInfo)      // 删除了SST文件
+	OnWALCreated(info WALFileInfo)              // 创建或复用了WAL文件
+	OnWALDeleted(info WALFileInfo)              // WAL文件被回收、归档或删除
+	OnBackgroundError(info BackgroundErrorInfo) // 后台出错，LSM进入只读状态
+	OnWriteStall(info WriteStallInfo)           // 写入开始或结束停顿
+}
+
+// NoopEventListener 忽略所有事件，用于嵌入只实现部分回调的监听器
+type NoopEventListener struct{}
+
+func (NoopEventListener) OnFlushBegin(FlushInfo)                {}
+func (NoopEventListener) OnFlushEnd(FlushInfo)                  {}
+func (NoopEventListener) OnCompactionBegin(CompactionInfo)      {}
+func (NoopEventListener) OnCompactionEnd(CompactionInfo)        {}
+func (NoopEventListener) OnTableFileCreated(TableFileInfo)      {}
+func (NoopEventListener) OnTableFileDeleted(TableFileInfo)      {}
+func (NoopEventListener) OnWALCreated(WALFileInfo)              {}
+func (NoopEventListener) OnWALDeleted(WALFileInfo)              {}
+func (NoopEventListener) OnBackgroundError(BackgroundErrorInfo) {}
+func (NoopEventListener) OnWriteStall(WriteStallInfo)           {}
+
+// TableFileInfo SST文件信息
+type TableFileInfo struct {
+	ColumnFamily string    // 文件所属的列族
+	Level        int       // 层级
+	FileNum      uint32    // 文件在层级中的编号
+	Path         string    // 文件路径
+	SmallestKey  []byte    // 最小键
+	LargestKey   []byte    // 最大键
+	Bytes        int64     // 文件大小
+	CreatedAt    time.Time // 文件的创建时间
+	Reason       string    // 创建或删除的原因，例如"flush"、"compaction"
+}
+
+// FlushInfo 内存表刷盘信息
+type FlushInfo struct {
+	ColumnFamily string        // 刷盘的列族，每个有数据的列族各产生一次事件
+	WalNum       uint32        // 内存表对应的WAL编号
+	Reason       string        // 刷盘的原因："memtable-full"、"manual"、"recovery"、"wal-error"、"close"
+	Entries      int           // 键值对数量
+	Table        TableFileInfo // 生成的SST文件，内存表为空时FileNum和Path为零值
+	Duration     time.Duration // 耗时，仅在OnFlushEnd中有效
+	Err          error         // 刷盘失败的原因
+}
+
+// CompactionInfo SST合并信息
+type CompactionInfo struct {
+	ColumnFamily string          // 合并的列族
+	Level        int             // 输入层级
+	OutputLevel  int             // 输出层级
+	Reason       string          // 合并的原因："level0-files"、"level-size"、"manual"
+	Inputs       []TableFileInfo // 输入文件
+	Outputs      []TableFileInfo // 输出文件，仅在OnCompactionEnd中有效
+	ReadBytes    int64           // 读取的字节数
+	WriteBytes   int64           // 写入的字节数
+	Duration     time.Duration   // 耗时，仅在OnCompactionEnd中有效
+	Err          error           // 合并失败的原因
+}
+
+// WALFileInfo WAL文件信息
+type WALFileInfo struct {
+	LogNum uint32 // 日志编号
+	Path   string // 文件路径
+	Bytes  int64  // 有效数据的大小
+	Reason string // 创建或删除的原因，例如"create"、"reuse"、"recycle"、"archive"、"delete"、"purge"
+}
+
+// BackgroundErrorInfo 后台错误信息
+type BackgroundErrorInfo struct {
+	Op          string // 出错的操作
+	Err         error  // 原始错误
+	Recoverable bool   // 是否可以通过Resume恢复
+}
+
+// WriteStallInfo 写入停顿信息
+type WriteStallInfo struct {
+	Stalled            bool          // 开始停顿时为true，结束时为false
+	ImmutableMemtables int           // 等待刷盘的不可变内存表数量
+	Limit              int           // 触发停顿的数量上限
+	Duration           time.Duration // 停顿时长，仅在结束时有效
+}
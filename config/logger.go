@@ -0,0 +1,34 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+)
+
+// Logger 日志接口，*slog.Logger 直接满足该接口。
+// args 为交替出现的键和值，例如 logger.Info("刷盘完成", "file", 3, "bytes", 4096)
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+var (
+	discardLogger Logger = slog.New(slog.DiscardHandler)
+	debugLogger   Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+)
+
+// GetLogger 返回配置的日志器。未配置时丢弃所有日志，开启IsDebug则输出到标准错误
+func (c *Config) GetLogger() Logger {
+	if c == nil {
+		return discardLogger
+	}
+	if c.Logger != nil {
+		return c.Logger
+	}
+	if c.IsDebug {
+		return debugLogger
+	}
+	return discardLogger
+}
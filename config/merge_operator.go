@@ -0,0 +1,15 @@
+package config
+
+// MergeOperator 定义Merge写入的操作数如何作用在已有的值上，用于计数器、追加列表等
+// 读-改-写场景，写入时无需先读取旧值。操作数在Get和SST合并时按需解析。
+// 方法可能在多个线程中并发调用，需要并发安全，并且对相同的输入总是返回相同的结果
+type MergeOperator interface {
+	Name() string // 合并操作的名称，用于日志
+
+	// FullMerge 把按从旧到新排列的操作数依次作用在existing上，返回新的值。
+	// 键不存在或已被删除时existing为nil。返回false表示操作数无法解析
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, bool)
+
+	// PartialMerge 把两个相邻的操作数合并为一个，left较旧。无法合并时返回false，两个操作数都保留
+	PartialMerge(key, left, right []byte) ([]byte, bool)
+}
@@ -0,0 +1,46 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrClosed              = errors.New("lsm: closed")                                    // LSM已关闭
+	ErrReadOnly            = errors.New("lsm: read-only due to background error")         // 后台出错后拒绝写入
+	ErrUpdatesUnavailable  = errors.New("lsm: requested updates are no longer available") // 请求的序列号所在的WAL已被删除或回收
+	ErrNoMergeOperator     = errors.New("lsm: merge operator not configured")             // 未配置MergeOperator时写入或读取合并操作数
+	ErrMergeFailed         = errors.New("lsm: merge operator failed")                     // MergeOperator无法解析操作数
+	ErrColumnFamilyDropped = errors.New("lsm: column family dropped")                     // 列族已被删除
+)
+
+// BackgroundOp 产生后台错误的操作
+type BackgroundOp string
+
+const (
+	BackgroundOpWal        BackgroundOp = "wal"        // 写入、创建或回收WAL
+	BackgroundOpFlush      BackgroundOp = "flush"      // 内存表刷盘
+	BackgroundOpCompaction BackgroundOp = "compaction" // SST合并
+	BackgroundOpManifest   BackgroundOp = "manifest"   // 写入清单
+)
+
+// BackgroundError 后台I/O错误。发生后LSM进入只读状态，所有写入都返回该错误，
+// 可恢复的错误在排除故障后可通过Resume清除
+type BackgroundError struct {
+	Op          BackgroundOp // 出错的操作
+	Err         error        // 原始错误
+	Recoverable bool         // 是否可以通过Resume恢复
+}
+
+func (e *BackgroundError) Error() string {
+	return fmt.Sprintf("lsm: background %s error: %v", e.Op, e.Err)
+}
+
+func (e *BackgroundError) Unwrap() error {
+	return e.Err
+}
+
+// Is 使errors.Is(err, ErrReadOnly)对所有后台错误成立
+func (e *BackgroundError) Is(target error) bool {
+	return target == ErrReadOnly
+}
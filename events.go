@@ -0,0 +1,47 @@
+package lsm
+
+import (
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/wal"
+)
+
+// notify 按顺序回调所有事件监听器。调用方不能持有锁，持有锁时使用queueEvent
+func (l *LSM) notify(fn func(listener config.EventListener)) {
+	for _, listener := range l.conf.Listeners {
+		fn(listener)
+	}
+}
+
+// queueEvent 在持有锁时登记事件，由调用方解锁后通过fireEvents回调，监听器中可以再调用LSM的方法
+func (l *LSM) queueEvent(fn func(listener config.EventListener)) {
+	if len(l.conf.Listeners) == 0 {
+		return
+	}
+	l.eventMu.Lock()
+	l.pendingEvents = append(l.pendingEvents, fn)
+	l.eventMu.Unlock()
+}
+
+// fireEvents 按登记顺序回调queueEvent登记的事件。调用方不能持有锁
+func (l *LSM) fireEvents() {
+	if len(l.conf.Listeners) == 0 {
+		return
+	}
+	l.eventMu.Lock()
+	events := l.pendingEvents
+	l.pendingEvents = nil
+	l.eventMu.Unlock()
+	for _, fn := range events {
+		l.notify(fn)
+	}
+}
+
+// walInfo 返回用于事件通知的WAL文件信息
+func walInfo(w *wal.Wal, reason string) config.WALFileInfo {
+	return config.WALFileInfo{
+		LogNum: w.LogNum(),
+		Path:   w.FilePath(),
+		Bytes:  w.Size(),
+		Reason: reason,
+	}
+}
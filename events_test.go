@@ -0,0 +1,309 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+// recordingListener 记录收到的事件
+type recordingListener struct {
+	config.NoopEventListener
+	mu          sync.Mutex
+	flushBegins []config.FlushInfo
+	flushEnds   []config.FlushInfo
+	tables      []config.TableFileInfo
+	deleted     []config.TableFileInfo
+	compactions []config.CompactionInfo
+	walsCreated []config.WALFileInfo
+	walsDeleted []config.WALFileInfo
+	bgErrors    []config.BackgroundErrorInfo
+	stalls      []config.WriteStallInfo
+}
+
+func (r *recordingListener) OnFlushBegin(info config.FlushInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushBegins = append(r.flushBegins, info)
+}
+
+func (r *recordingListener) OnFlushEnd(info config.FlushInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushEnds = append(r.flushEnds, info)
+}
+
+func (r *recordingListener) OnTableFileCreated(info config.TableFileInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tables = append(r.tables, info)
+}
+
+func (r *recordingListener) OnTableFileDeleted(info config.TableFileInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deleted = append(r.deleted, info)
+}
+
+func (r *recordingListener) OnCompactionEnd(info config.CompactionInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.compactions = append(r.compactions, info)
+}
+
+func (r *recordingListener) OnWALCreated(info config.WALFileInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.walsCreated = append(r.walsCreated, info)
+}
+
+func (r *recordingListener) OnWALDeleted(info config.WALFileInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.walsDeleted = append(r.walsDeleted, info)
+}
+
+func (r *recordingListener) OnBackgroundError(info config.BackgroundErrorInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bgErrors = append(r.bgErrors, info)
+}
+
+func (r *recordingListener) OnWriteStall(info config.WriteStallInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stalls = append(r.stalls, info)
+}
+
+func TestEventListener_Flush(t *testing.T) {
+	listener := &recordingListener{}
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+	conf.MaxImmutableMemtables = 1
+	conf.Level0CompactionTrigger = 1000 // 只观察刷盘事件
+	conf.Listeners = []config.EventListener{listener}
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	if len(listener.flushBegins) == 0 || len(listener.flushBegins) != len(listener.flushEnds) {
+		t.Fatalf("unexpected flush events: begin=%d, end=%d", len(listener.flushBegins), len(listener.flushEnds))
+	}
+	if len(listener.tables) != len(listener.flushEnds) {
+		t.Fatalf("expected %d table files, got %d", len(listener.flushEnds), len(listener.tables))
+	}
+	for i, end := range listener.flushEnds {
+		if end.Err != nil || end.Entries == 0 || end.Duration <= 0 {
+			t.Fatalf("unexpected flush end: %+v", end)
+		}
+		table := end.Table
+		if table.Path == "" || table.Path != listener.tables[i].Path {
+			t.Fatalf("unexpected table path: %+v", table)
+		}
+		if table.Level != 0 || table.Bytes == 0 || table.Reason != "flush" {
+			t.Fatalf("unexpected table info: %+v", table)
+		}
+		if _, err := os.Stat(table.Path); err != nil {
+			t.Fatal(err)
+		}
+		if utils.CompareBytes(table.SmallestKey, table.LargestKey) > 0 {
+			t.Fatalf("unexpected key range: %s > %s", table.SmallestKey, table.LargestKey)
+		}
+	}
+	if len(listener.walsCreated) < len(listener.flushEnds) {
+		t.Fatalf("expected at least %d created wals, got %d", len(listener.flushEnds), len(listener.walsCreated))
+	}
+	if len(listener.walsDeleted) != len(listener.flushEnds) {
+		t.Fatalf("expected %d deleted wals, got %d", len(listener.flushEnds), len(listener.walsDeleted))
+	}
+	if len(listener.stalls) == 0 || len(listener.stalls)%2 != 0 {
+		t.Fatalf("expected paired stall events, got %d", len(listener.stalls))
+	}
+	if !listener.stalls[0].Stalled || listener.stalls[1].Stalled {
+		t.Fatalf("unexpected stall events: %+v", listener.stalls[:2])
+	}
+}
+
+func TestEventListener_Compaction(t *testing.T) {
+	listener := &recordingListener{}
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+	conf.Level0CompactionTrigger = 2
+	conf.Listeners = []config.EventListener{listener}
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForBackgroundWork(t, lsm)
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	if len(listener.compactions) == 0 {
+		t.Fatal("expected compaction events")
+	}
+	inputs := 0
+	for _, info := range listener.compactions {
+		if info.Err != nil || info.OutputLevel != info.Level+1 || len(info.Inputs) == 0 || len(info.Outputs) == 0 {
+			t.Fatalf("unexpected compaction info: %+v", info)
+		}
+		if info.ReadBytes == 0 || info.WriteBytes == 0 || info.Duration <= 0 {
+			t.Fatalf("unexpected compaction bytes: %+v", info)
+		}
+		for _, output := range info.Outputs {
+			if output.Level != info.OutputLevel || output.Reason != "compaction" {
+				t.Fatalf("unexpected output: %+v", output)
+			}
+		}
+		inputs += len(info.Inputs)
+	}
+	// 输入文件在合并完成后全部删除
+	if len(listener.deleted) != inputs {
+		t.Fatalf("expected %d deleted tables, got %d", inputs, len(listener.deleted))
+	}
+	for _, table := range listener.deleted {
+		if _, err := os.Stat(table.Path); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be deleted: %v", table.Path, err)
+		}
+	}
+}
+
+func TestEventListener_BackgroundError(t *testing.T) {
+	listener := &recordingListener{}
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+	conf.Listeners = []config.EventListener{listener}
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	if err := os.RemoveAll(lsm.getWalDir()); err != nil {
+		t.Fatal(err)
+	}
+	var putErr error
+	for i := 0; i < 100 && putErr == nil; i++ {
+		putErr = lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i))
+	}
+	if !errors.Is(putErr, ErrReadOnly) {
+		t.Fatalf("expected read only error, got %v", putErr)
+	}
+
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	if len(listener.bgErrors) != 1 {
+		t.Fatalf("expected 1 background error, got %d", len(listener.bgErrors))
+	}
+	if info := listener.bgErrors[0]; info.Op != string(BackgroundOpWal) || !info.Recoverable || info.Err == nil {
+		t.Fatalf("unexpected background error info: %+v", info)
+	}
+}
+
+// reentrantListener 在回调中调用LSM的方法
+type reentrantListener struct {
+	config.NoopEventListener
+	lsm      atomic.Pointer[LSM]
+	wals     atomic.Int32
+	bgErrors atomic.Int32
+}
+
+func (r *reentrantListener) OnWALCreated(info config.WALFileInfo) {
+	if lsm := r.lsm.Load(); lsm != nil {
+		lsm.Stats()
+		r.wals.Add(1)
+	}
+}
+
+func (r *reentrantListener) OnBackgroundError(info config.BackgroundErrorInfo) {
+	if lsm := r.lsm.Load(); lsm != nil {
+		if lsm.BackgroundError() == nil {
+			panic("expected background error")
+		}
+		lsm.Get(utils.GenerateKey(0))
+		r.bgErrors.Add(1)
+	}
+}
+
+func TestEventListener_Reentrant(t *testing.T) {
+	listener := &reentrantListener{}
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+	conf.Listeners = []config.EventListener{listener}
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.lsm.Store(lsm)
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 20; i++ {
+			if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+				done <- err
+				return
+			}
+		}
+		// 删除WAL目录使切换内存表失败，进入只读状态
+		if err := os.RemoveAll(lsm.getWalDir()); err != nil {
+			done <- err
+			return
+		}
+		var putErr error
+		for i := 20; i < 120 && putErr == nil; i++ {
+			putErr = lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i))
+		}
+		if !errors.Is(putErr, ErrReadOnly) {
+			done <- fmt.Errorf("expected read only error, got %v", putErr)
+			return
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		// 死锁时Close也会阻塞，不关闭直接失败
+		t.Fatal("listener calling into the LSM deadlocked")
+	}
+	defer lsm.Close()
+	if listener.wals.Load() == 0 || listener.bgErrors.Load() != 1 {
+		t.Fatalf("wals=%d, background errors=%d", listener.wals.Load(), listener.bgErrors.Load())
+	}
+}
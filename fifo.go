@@ -0,0 +1,75 @@
+package lsm
+
+import (
+	"time"
+
+	"github.com/aixiasang/sqldb/config"
+)
+
+const (
+	compactionReasonFIFOSize = "fifo-size"
+	compactionReasonFIFOTTL  = "fifo-ttl"
+)
+
+// pickFIFOCompaction 整体删除0层最旧的文件，不做归并：先删除超过FIFOTTL的文件，
+// 再删除最旧的文件直到总大小不超过FIFOMaxTableFilesSize。每个列族同一时间只有一个删除任务。调用方需持有写锁
+func (l *LSM) pickFIFOCompaction(cf *ColumnFamily) *compaction {
+	level0 := cf.nodes[0]
+	if len(level0) == 0 || l.hasRunningCompaction(cf) {
+		return nil
+	}
+
+	// 0层按写入顺序排列，最旧的文件在前
+	var inputs []*Node
+	reason := compactionReasonFIFOTTL
+	if l.conf.FIFOTTL > 0 {
+		for _, node := range level0 {
+			if l.conf.Clock.Now().Sub(node.createdAt) < l.conf.FIFOTTL {
+				break
+			}
+			inputs = append(inputs, node)
+		}
+	}
+	if len(inputs) == 0 && l.conf.FIFOMaxTableFilesSize > 0 {
+		reason = compactionReasonFIFOSize
+		total := l.levelBytes(cf, 0)
+		for _, node := range level0 {
+			if total <= l.conf.FIFOMaxTableFilesSize {
+				break
+			}
+			inputs = append(inputs, node)
+			total -= node.Size()
+		}
+	}
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	c := &compaction{cf: cf, level: 0, outputLevel: 0, reason: reason, inputs: inputs, dropOnly: true}
+	c.smallest, c.largest = keyRange(inputs)
+	return c
+}
+
+// startFIFOTTLChecker 没有写入时文件也会过期，定期检查是否有需要删除的文件，bgDone关闭后退出
+func (l *LSM) startFIFOTTLChecker() {
+	if l.conf.CompactionStyle != config.CompactionStyleFIFO || l.conf.FIFOTTL <= 0 {
+		return
+	}
+	interval := min(l.conf.FIFOTTL, time.Minute)
+	l.bgWg.Add(1)
+	go func() {
+		defer l.bgWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.bgDone:
+				return
+			case <-ticker.C:
+				l.mu.Lock()
+				l.maybeSchedule()
+				l.mu.Unlock()
+			}
+		}
+	}()
+}
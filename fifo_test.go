@@ -0,0 +1,101 @@
+package lsm
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+func TestCompaction_FIFOSize(t *testing.T) {
+	listener := &recordingListener{}
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+	conf.CompactionStyle = config.CompactionStyleFIFO
+	conf.FIFOMaxTableFilesSize = 2048
+	conf.Listeners = []config.EventListener{listener}
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	dataCount := 300
+	for i := 0; i < dataCount; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	waitForBackgroundWork(t, lsm)
+
+	stats := lsm.Stats()
+	if stats.Levels[0].Bytes > conf.FIFOMaxTableFilesSize || stats.Levels[0].Files == 0 {
+		t.Fatalf("unexpected level 0: %+v", stats.Levels[0])
+	}
+	if stats.TotalFiles() != stats.Levels[0].Files {
+		t.Fatalf("expected all files in level 0: %+v", stats.Levels)
+	}
+
+	// 最旧的数据被整体删除，最新的数据保留
+	if _, found, err := lsm.Get(utils.GenerateKey(0)); err != nil || found {
+		t.Fatalf("oldest key: found=%v, err=%v", found, err)
+	}
+	if value, found, err := lsm.Get(utils.GenerateKey(dataCount - 1)); err != nil || !found || string(value) != fmt.Sprintf("value-%d", dataCount-1) {
+		t.Fatalf("newest key: value=%q, found=%v, err=%v", value, found, err)
+	}
+
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	if len(listener.compactions) == 0 {
+		t.Fatal("expected compactions")
+	}
+	for _, info := range listener.compactions {
+		if info.Reason != "fifo-size" || len(info.Outputs) != 0 || info.ReadBytes != 0 || info.Err != nil {
+			t.Fatalf("unexpected compaction: %+v", info)
+		}
+	}
+}
+
+func TestCompaction_FIFOTTL(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.CompactionStyle = config.CompactionStyleFIFO
+	conf.FIFOTTL = 100 * time.Millisecond
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	if files := lsm.Stats().Levels[0].Files; files != 1 {
+		t.Fatalf("expected 1 file, got %d", files)
+	}
+
+	// 没有新的写入，过期的文件也由定时检查删除
+	deadline := time.Now().Add(5 * time.Second)
+	for lsm.Stats().Levels[0].Files > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expired file was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, found, err := lsm.Get(utils.GenerateKey(0)); err != nil || found {
+		t.Fatalf("expired key: found=%v, err=%v", found, err)
+	}
+}
@@ -0,0 +1,300 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/sstable"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+const tableReasonIngest = "ingest"
+
+// IngestOptions 导入外部SST文件的选项
+type IngestOptions struct {
+	// MoveFiles 把文件移动到SST目录而不是复制，导入失败时移回原处。
+	// 移动失败(例如跨文件系统)时退回到复制
+	MoveFiles bool
+}
+
+// externalFile 待导入的外部文件
+type externalFile struct {
+	path     string
+	smallest []byte
+	largest  []byte
+	entries  int
+	tmpPath  string // SST目录中的临时文件
+	moved    bool   // 临时文件是由原文件移动而来的
+	node     *Node
+}
+
+// IngestExternalFiles 把sstable.Writer生成的文件导入默认列族，见IngestExternalFilesCF
+func (l *LSM) IngestExternalFiles(paths []string, opts *IngestOptions) error {
+	return l.IngestExternalFilesCF(l.defaultCF, paths, opts)
+}
+
+// IngestExternalFilesCF 把sstable.Writer生成的文件导入列族，导入的数据比列族中已有的数据新。
+// 文件内的键必须有序，文件之间的键范围不能重叠。内存表中有范围内的数据时先刷盘，
+// 每个文件放入不与其上各层级重叠的最低层级，全部文件在一次清单更新中生效
+func (l *LSM) IngestExternalFilesCF(cf *ColumnFamily, paths []string, opts *IngestOptions) error {
+	if l.closed.Load() {
+		return ErrClosed
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	if opts == nil {
+		opts = &IngestOptions{}
+	}
+
+	files := make([]*externalFile, 0, len(paths))
+	for _, path := range paths {
+		file, err := inspectExternalFile(cf.conf, path)
+		if err != nil {
+			return fmt.Errorf("外部文件 %s 无效: %w", path, err)
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return utils.CompareBytes(files[i].smallest, files[j].smallest) < 0
+	})
+	for i := 1; i < len(files); i++ {
+		if utils.CompareBytes(files[i-1].largest, files[i].smallest) >= 0 {
+			return fmt.Errorf("外部文件 %s 与 %s 的键范围重叠", files[i-1].path, files[i].path)
+		}
+	}
+
+	// 复制文件时不持有锁，未生效的临时文件在返回时删除
+	defer func() {
+		for _, file := range files {
+			if file.node == nil {
+				file.discard()
+			}
+		}
+	}()
+	for _, file := range files {
+		if err := file.prepare(cf.sstDir(), opts.MoveFiles); err != nil {
+			return fmt.Errorf("复制外部文件 %s 失败: %w", file.path, err)
+		}
+		if opts.MoveFiles && !file.moved {
+			l.logger.Warn("移动外部文件失败，已改为复制", "path", file.path)
+		}
+	}
+
+	smallest, largest := files[0].smallest, files[len(files)-1].largest
+	l.mu.Lock()
+	for {
+		if l.closed.Load() {
+			l.mu.Unlock()
+			return ErrClosed
+		}
+		if cf.dropped {
+			l.mu.Unlock()
+			return ErrColumnFamilyDropped
+		}
+		if l.bgErr != nil {
+			err := l.bgErr
+			l.mu.Unlock()
+			return err
+		}
+		if !l.memtablesOverlap(cf, smallest, largest) {
+			break
+		}
+		// 内存表中的数据比导入的文件旧，必须先刷盘
+		l.mu.Unlock()
+		if err := l.Flush(true); err != nil {
+			return err
+		}
+		l.mu.Lock()
+	}
+	defer l.fireEvents()
+	defer l.mu.Unlock()
+
+	var installed []*externalFile
+	rollback := func() {
+		for _, file := range installed {
+			nodes := cf.nodes[file.node.level]
+			for i, node := range nodes {
+				if node == file.node {
+					cf.nodes[file.node.level] = append(nodes[:i:i], nodes[i+1:]...)
+					break
+				}
+			}
+			file.node.Close()
+			if err := os.Rename(file.node.path, file.tmpPath); err != nil {
+				os.Remove(file.node.path)
+			}
+			file.node = nil
+		}
+	}
+	for _, file := range files {
+		level := l.ingestLevel(cf, file.smallest, file.largest)
+		seq := cf.levelId[level].Add(1) - 1
+		path := tablePath(cf, level, seq)
+		if err := os.Rename(file.tmpPath, path); err != nil {
+			rollback()
+			return fmt.Errorf("导入外部文件 %s 失败: %w", file.path, err)
+		}
+		node, err := NewNode(cf.conf, level, seq)
+		if err != nil {
+			os.Rename(path, file.tmpPath)
+			rollback()
+			return fmt.Errorf("导入外部文件 %s 失败: %w", file.path, err)
+		}
+		node.cf = cf
+		node.createdAt = l.conf.Clock.Now()
+		node.external = true
+		file.node = node
+		installed = append(installed, file)
+		cf.nodes[level] = append(cf.nodes[level], node)
+		if level > 0 {
+			sortBySmallestKey(cf.nodes[level])
+		}
+	}
+	if err := utils.SyncDir(cf.sstDir()); err != nil {
+		rollback()
+		return fmt.Errorf("同步SST目录失败: %w", err)
+	}
+	if err := l.saveManifest(); err != nil {
+		rollback()
+		return l.setBackgroundError(BackgroundOpManifest, err, true)
+	}
+
+	var entries int
+	for _, file := range files {
+		entries += file.entries
+		l.logger.Debug("导入外部文件", "cf", cf.name, "path", file.path, "level", file.node.level, "file", file.node.seq)
+	}
+	l.logger.Info("导入外部SST文件完成", "cf", cf.name, "files", len(files), "entries", entries)
+	for _, file := range files {
+		table := file.node.TableInfo(tableReasonIngest)
+		l.queueEvent(func(listener config.EventListener) { listener.OnTableFileCreated(table) })
+	}
+	l.maybeSchedule()
+	return nil
+}
+
+// inspectExternalFile 读取外部文件的全部键，检查其是否有序、非空且不含范围删除标记
+func inspectExternalFile(conf *config.Config, path string) (*externalFile, error) {
+	reader, err := sstable.NewSSTReader(path, conf)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if len(reader.RangeTombstones()) > 0 {
+		return nil, errors.New("不支持包含范围删除标记的文件")
+	}
+
+	file := &externalFile{path: path}
+	iter := reader.Iterator()
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if file.entries > 0 && utils.CompareBytes(key, file.largest) <= 0 {
+			return nil, fmt.Errorf("%w: %q after %q", sstable.ErrKeyOrder, key, file.largest)
+		}
+		if file.entries == 0 {
+			file.smallest = utils.CopyKey(key)
+		}
+		file.largest = utils.CopyKey(key)
+		file.entries++
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	if file.entries == 0 {
+		return nil, errors.New("文件为空")
+	}
+	return file, nil
+}
+
+// prepare 把外部文件移动或复制到SST目录中的临时文件
+func (f *externalFile) prepare(dir string, move bool) error {
+	tmp, err := os.CreateTemp(dir, "ingest-*"+tempFileSuffix)
+	if err != nil {
+		return err
+	}
+	f.tmpPath = tmp.Name()
+	tmp.Close()
+	if move && os.Rename(f.path, f.tmpPath) == nil {
+		f.moved = true
+		return nil
+	}
+	return utils.CopyFile(f.path, f.tmpPath)
+}
+
+// discard 删除临时文件，移动来的文件移回原处
+func (f *externalFile) discard() {
+	if f.tmpPath == "" {
+		return
+	}
+	if f.moved {
+		if err := os.Rename(f.tmpPath, f.path); err == nil {
+			return
+		}
+	}
+	os.Remove(f.tmpPath)
+}
+
+// ingestLevel 选择导入文件的层级：从1层开始向下，直到遇到与[smallest, largest]重叠的文件或进行中的合并的输出，
+// 放入其上的最低层级；0层有重叠时只能放入0层，作为最新的文件。FIFO合并只使用0层。调用方需持有锁
+func (l *LSM) ingestLevel(cf *ColumnFamily, smallest, largest []byte) int {
+	if l.conf.CompactionStyle == config.CompactionStyleFIFO {
+		return 0
+	}
+	overlaps := func(level int) bool {
+		for _, node := range cf.nodes[level] {
+			if node.overlaps(smallest, largest) {
+				return true
+			}
+		}
+		for _, c := range l.runningCompactions {
+			if c.cf == cf && c.outputLevel == level &&
+				utils.CompareBytes(c.largest, smallest) >= 0 && utils.CompareBytes(c.smallest, largest) <= 0 {
+				return true
+			}
+		}
+		return false
+	}
+	if overlaps(0) {
+		return 0
+	}
+	target := 0
+	for level := 1; level < len(cf.nodes) && !overlaps(level); level++ {
+		target = level
+	}
+	return target
+}
+
+// memtablesOverlap 列族的可变和不可变内存表中是否有[smallest, largest]内的数据。调用方需持有锁
+func (l *LSM) memtablesOverlap(cf *ColumnFamily, smallest, largest []byte) bool {
+	if cf.mutableMemtable.overlaps(smallest, largest) {
+		return true
+	}
+	for _, immutable := range l.immutableMemtables {
+		if mem := immutable.memtableFor(cf); mem != nil && mem.overlaps(smallest, largest) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlaps 内存表中是否有[start, end]内的键或与之相交的范围删除标记
+func (m *memTable) overlaps(start, end []byte) bool {
+	for _, t := range m.rangeDels {
+		if utils.CompareBytes(t.Start, end) <= 0 && utils.CompareBytes(t.End, start) >= 0 {
+			return true
+		}
+	}
+	var found bool
+	m.ForEach(func(key, _ []byte) bool {
+		if utils.CompareBytes(key, end) > 0 {
+			return false
+		}
+		found = utils.CompareBytes(key, start) >= 0
+		return !found
+	})
+	return found
+}
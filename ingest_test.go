@@ -0,0 +1,211 @@
+package lsm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/sstable"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+// writeExternalFile 用sstable.Writer生成包含[start, end)的外部文件
+func writeExternalFile(t *testing.T, conf *config.Config, path string, start, end int) {
+	t.Helper()
+	writer, err := sstable.NewWriter(path, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := start; i < end; i++ {
+		if err := writer.Add(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// levelOf 返回包含键的文件所在的层级，没有时返回-1
+func levelOf(lsm *LSM, key []byte) int {
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+	for level, nodes := range lsm.defaultCF.nodes {
+		for _, node := range nodes {
+			if node.overlaps(key, key) {
+				return level
+			}
+		}
+	}
+	return -1
+}
+
+func TestIngestExternalFiles(t *testing.T) {
+	listener := &recordingListener{}
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.Listeners = []config.EventListener{listener}
+	external := t.TempDir()
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// 内存表中与导入文件重叠的旧值，导入前先刷盘
+	if err := lsm.Put(utils.GenerateKey(150), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	a := filepath.Join(external, "a.sst")
+	b := filepath.Join(external, "b.sst")
+	writeExternalFile(t, conf, a, 100, 200)
+	writeExternalFile(t, conf, b, 200, 300)
+	if err := lsm.IngestExternalFiles([]string{b, a}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{a, b} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("copied file should be kept: %v", err)
+		}
+	}
+	// 与0层重叠的文件放入0层，其余放入最底层
+	if level := levelOf(lsm, utils.GenerateKey(150)); level != 0 {
+		t.Fatalf("expected overlapping file in level 0, got %d", level)
+	}
+	if level := levelOf(lsm, utils.GenerateKey(250)); level != conf.MaxLevel-1 {
+		t.Fatalf("expected file in level %d, got %d", conf.MaxLevel-1, level)
+	}
+	listener.mu.Lock()
+	var created int
+	for _, table := range listener.tables {
+		if table.Reason == tableReasonIngest {
+			created++
+		}
+	}
+	listener.mu.Unlock()
+	if created != 2 {
+		t.Fatalf("expected 2 table-created events, got %d", created)
+	}
+
+	check := func() {
+		t.Helper()
+		for i := 0; i < 300; i++ {
+			value, found, err := lsm.Get(utils.GenerateKey(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i >= 50 && i < 100 {
+				if found {
+					t.Fatalf("unexpected key %d", i)
+				}
+				continue
+			}
+			if !found || string(value) != string(utils.GenerateValue(i)) {
+				t.Fatalf("key %d: value=%q, found=%v", i, value, found)
+			}
+		}
+	}
+	check()
+
+	// 重新打开后从清单中恢复外部文件
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	check()
+
+	// 合并后外部文件被重写为普通文件
+	if err := lsm.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+	for _, nodes := range lsm.defaultCF.nodes {
+		for _, node := range nodes {
+			if node.external && node.overlaps(utils.GenerateKey(150), utils.GenerateKey(150)) {
+				t.Fatalf("external file %s should be rewritten by compaction", node.path)
+			}
+		}
+	}
+}
+
+func TestIngestExternalFiles_Invalid(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	external := t.TempDir()
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := filepath.Join(external, "a.sst")
+	b := filepath.Join(external, "b.sst")
+	empty := filepath.Join(external, "empty.sst")
+	writeExternalFile(t, conf, a, 0, 20)
+	writeExternalFile(t, conf, b, 10, 30)
+	writeExternalFile(t, conf, empty, 0, 0)
+
+	if err := lsm.IngestExternalFiles([]string{a, b}, &IngestOptions{MoveFiles: true}); err == nil {
+		t.Fatal("expected error for overlapping files")
+	}
+	if err := lsm.IngestExternalFiles([]string{empty}, nil); err == nil {
+		t.Fatal("expected error for empty file")
+	}
+	if err := lsm.IngestExternalFiles([]string{filepath.Join(external, "missing.sst")}, nil); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+	if _, found, _ := lsm.Get(utils.GenerateKey(1)); found {
+		t.Fatal("nothing should be ingested")
+	}
+
+	// 移动文件
+	if err := lsm.IngestExternalFiles([]string{a}, &IngestOptions{MoveFiles: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(a); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("moved file should be removed: %v", err)
+	}
+	if value, found, err := lsm.Get(utils.GenerateKey(1)); err != nil || !found || string(value) != string(utils.GenerateValue(1)) {
+		t.Fatalf("value=%q, found=%v, err=%v", value, found, err)
+	}
+
+	// 关闭后拒绝导入，移动的文件留在原处
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.IngestExternalFiles([]string{b}, &IngestOptions{MoveFiles: true}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if _, err := os.Stat(b); err != nil {
+		t.Fatalf("file should be kept: %v", err)
+	}
+
+	// 打开时删除未完成的导入留下的临时文件
+	tmp := filepath.Join(lsm.getSSTDir(), "ingest-1"+tempFileSuffix)
+	if err := os.WriteFile(tmp, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	if _, err := os.Stat(tmp); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("temporary file should be removed: %v", err)
+	}
+}
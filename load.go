@@ -1,8 +1,13 @@
 package lsm
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aixiasang/sqldb/config"
 	"github.com/aixiasang/sqldb/utils"
@@ -15,63 +20,205 @@ func (l *LSM) loadWal() error {
 	if err != nil {
 		return err
 	}
-	if len(files) == 0 {
-		curWal, err := wal.NewWal(l.conf, l.getWalPath(l.walId))
-		if err != nil {
-			return err
-		}
-		l.mutableMemtable = config.NewMemTableConstructor()
-		l.currWal = curWal
-		return nil
-	}
 	walFileIds := make([]uint32, 0)
+	var maxRecycledId uint32
 	for _, file := range files {
 		if file.IsDir() {
 			continue
 		}
-		fileId, err := utils.ParseWalPath(file.Name())
+		switch filepath.Ext(file.Name()) {
+		case ".wal":
+			fileId, err := utils.ParseWalPath(file.Name())
+			if err != nil {
+				return err
+			}
+			// 清单记录刷盘之后、WAL删除之前崩溃时留下的WAL，其中的数据已在SST中，再次重放会重复应用合并操作数
+			if fileId < l.logNumber {
+				if err := l.removeFlushedWal(fileId); err != nil {
+					return err
+				}
+				continue
+			}
+			walFileIds = append(walFileIds, fileId)
+		case ".recycle":
+			fileId, err := utils.ParseWalPath(file.Name())
+			if err != nil {
+				return err
+			}
+			l.recycledWals = append(l.recycledWals, filepath.Join(walDir, file.Name()))
+			maxRecycledId = max(maxRecycledId, fileId)
+		}
+	}
+	// 已归档的WAL中可能保存着最新的序列号
+	if err := l.loadArchive(); err != nil {
+		return err
+	}
+	if len(walFileIds) == 0 {
+		// 新日志的编号必须大于回收文件中残留记录的编号，且不小于清单中的编号，否则重新打开时被跳过
+		l.walId = l.logNumber
+		if len(l.recycledWals) > 0 {
+			l.walId = max(l.walId, maxRecycledId+1)
+		}
+		curWal, err := l.newWal(l.walId)
 		if err != nil {
 			return err
 		}
-		walFileIds = append(walFileIds, fileId)
+		l.currWal = curWal
+		return nil
 	}
 	sort.Slice(walFileIds, func(i, j int) bool {
 		return walFileIds[i] < walFileIds[j]
 	})
 	for i, fileId := range walFileIds {
-		wal, err := wal.NewWal(l.conf, l.getWalPath(fileId))
+		w, err := wal.NewWal(l.conf, l.getWalPath(fileId), fileId)
 		if err != nil {
 			return err
 		}
-		curMemtable := config.NewMemTableConstructor()
-		if err := wal.ReadAll(curMemtable); err != nil {
+		// 每个WAL重放到各列族的新内存表中，已删除的列族的记录被忽略
+		memtables := make(map[uint32]*memTable, len(l.columnFamilies))
+		for _, cf := range l.columnFamilies {
+			memtables[cf.id] = newMemTable(cf.conf)
+		}
+		if err := w.Replay(func(rec *wal.Record) error { return l.applyRecord(memtables, rec) }); err != nil {
+			w.Close()
 			return err
 		}
+		l.seq = max(l.seq, w.LastSeq())
+		l.logger.Debug("重放WAL", "wal", fileId, "bytes", w.Size(), "seq", w.LastSeq())
 		if i == len(walFileIds)-1 {
-			l.currWal = wal
-			l.mutableMemtable = curMemtable
+			l.currWal = w
+			for _, cf := range l.columnFamilies {
+				cf.mutableMemtable = memtables[cf.id]
+			}
+			l.walId = max(fileId, maxRecycledId)
 		} else {
-			l.immutableMemtables = append(l.immutableMemtables, &immutableMemtable{
-				memtable: curMemtable,
-				wal:      wal,
-			})
-			//发送合并信息号
-			go func() {
-				l.compactChan <- struct{}{}
-			}()
+			immutable := &immutableMemtable{wal: w, reason: flushReasonRecovery}
+			for _, cf := range l.columnFamilies {
+				immutable.tables = append(immutable.tables, &immutableTable{cf: cf, memtable: memtables[cf.id]})
+			}
+			l.immutableMemtables = append(l.immutableMemtables, immutable)
+		}
+	}
+	return nil
+}
+
+// newWal 创建编号为walId的WAL，优先复用已回收的WAL文件。创建事件在调用方解锁后回调
+func (l *LSM) newWal(walId uint32) (*wal.Wal, error) {
+	walPath := l.getWalPath(walId)
+	if n := len(l.recycledWals); n > 0 {
+		recycledPath := l.recycledWals[n-1]
+		l.recycledWals = l.recycledWals[:n-1]
+		w, err := wal.ReuseWal(l.conf, recycledPath, walPath, walId)
+		if err == nil {
+			l.queueEvent(func(listener config.EventListener) { listener.OnWALCreated(walInfo(w, "reuse")) })
+			return w, nil
+		}
+		l.logger.Warn("复用WAL文件失败", "path", recycledPath, "wal", walId, "error", err)
+	}
+	w, err := wal.NewWal(l.conf, walPath, walId)
+	if err != nil {
+		return nil, err
+	}
+	l.queueEvent(func(listener config.EventListener) { listener.OnWALCreated(walInfo(w, "create")) })
+	return w, nil
+}
+
+// removeFlushedWal 处理打开时发现的已刷盘的WAL：开启归档时移入归档目录，否则删除
+func (l *LSM) removeFlushedWal(fileId uint32) error {
+	path := l.getWalPath(fileId)
+	l.logger.Warn("跳过已刷盘的WAL", "wal", fileId, "log_number", l.logNumber)
+	if !l.archiveEnabled() {
+		return os.Remove(path)
+	}
+	archived := l.getArchivedWalPath(fileId)
+	if err := os.Rename(path, archived); err != nil {
+		return err
+	}
+	return l.touchArchived(archived)
+}
+
+// retireWal 处理已刷盘内存表对应的WAL：开启归档时移入归档目录，
+// 否则在回收文件未达上限时保留复用，超出上限的直接删除。调用方需持有写锁
+func (l *LSM) retireWal(w *wal.Wal) error {
+	info := walInfo(w, "delete")
+	switch {
+	case l.archiveEnabled():
+		if err := l.archiveWal(w); err != nil {
+			return err
+		}
+		info.Reason = "archive"
+	case len(l.recycledWals) < l.conf.WalRecycleNum:
+		recycledPath := l.getRecycledWalPath(w.LogNum())
+		if err := w.Recycle(recycledPath); err != nil {
+			return err
+		}
+		l.recycledWals = append(l.recycledWals, recycledPath)
+		l.logger.Debug("回收WAL", "wal", w.LogNum(), "recycled", len(l.recycledWals))
+		info.Reason = "recycle"
+	default:
+		if err := w.Delete(); err != nil {
+			return err
 		}
+		l.logger.Debug("删除WAL", "wal", w.LogNum())
 	}
+	l.queueEvent(func(listener config.EventListener) { listener.OnWALDeleted(info) })
 	return nil
 }
 
 type tempSST struct {
+	level     int
+	seq       uint32
+	path      string
+	createdAt time.Time
+	external  bool
+}
+
+// tableKey 列族、层级和编号确定一个SST文件
+type tableKey struct {
+	cf    uint32
 	level int
 	seq   uint32
-	path  string
 }
 
+// loadSST 按清单创建列族并加载各列族的SST文件，删除清单之外的残留文件和已删除列族的目录。
+// 没有清单时(旧版本创建的目录)只有默认列族，加载全部文件，以文件修改时间作为创建时间
 func (l *LSM) loadSST() error {
-	sstDir := l.getSSTDir()
+	m, err := l.readManifest()
+	if err != nil {
+		return err
+	}
+	live := make(map[tableKey]tableMeta)
+	if m != nil {
+		l.seq = m.LastSequence
+		l.logNumber = m.LogNumber
+		l.nextColumnFamilyID = max(m.NextColumnFamilyID, 1)
+		for _, meta := range m.ColumnFamilies {
+			cf := l.newColumnFamily(meta.ID, meta.Name, meta.Options)
+			if err := os.MkdirAll(cf.sstDir(), 0755); err != nil {
+				return err
+			}
+			l.columnFamilies = append(l.columnFamilies, cf)
+		}
+		for _, meta := range m.Tables {
+			live[tableKey{cf: meta.ColumnFamily, level: meta.Level, seq: meta.FileNum}] = meta
+		}
+	}
+
+	for _, cf := range l.columnFamilies {
+		if err := l.loadColumnFamilySST(cf, m != nil, live); err != nil {
+			return err
+		}
+	}
+	for key := range live {
+		return fmt.Errorf("清单中的SST文件 %d_%d.sst 不存在(列族%d)", key.level, key.seq, key.cf)
+	}
+	return nil
+}
+
+// loadColumnFamilySST 加载列族目录中的SST文件，hasManifest为true时删除不在live中的文件，
+// 默认列族的目录中不在清单中的列族子目录整体删除
+func (l *LSM) loadColumnFamilySST(cf *ColumnFamily, hasManifest bool, live map[tableKey]tableMeta) error {
+	sstDir := cf.sstDir()
 	files, err := os.ReadDir(sstDir)
 	if err != nil {
 		return err
@@ -80,18 +227,65 @@ func (l *LSM) loadSST() error {
 	sstFiles := make([]*tempSST, 0)
 	for _, file := range files {
 		if file.IsDir() {
+			if cf.id != 0 || !hasManifest {
+				continue
+			}
+			id, err := strconv.ParseUint(file.Name(), 10, 32)
+			if err != nil || l.columnFamilyByID(uint32(id)) != nil {
+				continue
+			}
+			path := filepath.Join(sstDir, file.Name())
+			l.logger.Warn("删除清单之外的列族目录", "path", path)
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			continue
+		}
+		// 崩溃时未完成的刷盘、合并或导入留下的临时文件
+		if strings.HasSuffix(file.Name(), tempFileSuffix) {
+			path := filepath.Join(sstDir, file.Name())
+			l.logger.Warn("删除残留的临时文件", "path", path)
+			if err := os.Remove(path); err != nil {
+				return err
+			}
 			continue
 		}
 		level, seq, err := utils.ParseSSTPath(file.Name())
 		if err != nil {
 			return err
 		}
-		sstFiles = append(sstFiles, &tempSST{
-			level: level,
-			seq:   seq,
-			path:  file.Name(),
-		})
+		if level >= len(cf.nodes) {
+			return fmt.Errorf("SST文件 %s 的层级超出MaxLevel", file.Name())
+		}
+		// 恢复层级ID，避免新生成的SST覆盖已有文件
+		if seq >= cf.levelId[level].Load() {
+			cf.levelId[level].Store(seq + 1)
+		}
+
+		sstFile := &tempSST{level: level, seq: seq, path: filepath.Join(sstDir, file.Name())}
+		if hasManifest {
+			key := tableKey{cf: cf.id, level: level, seq: seq}
+			meta, ok := live[key]
+			if !ok {
+				l.logger.Warn("删除清单之外的SST文件", "path", sstFile.path)
+				if err := os.Remove(sstFile.path); err != nil {
+					return err
+				}
+				continue
+			}
+			delete(live, key)
+			sstFile.createdAt = meta.CreatedAt
+			sstFile.external = meta.External
+		} else {
+			info, err := file.Info()
+			if err != nil {
+				return err
+			}
+			sstFile.createdAt = info.ModTime()
+		}
+		sstFiles = append(sstFiles, sstFile)
 	}
+
 	sort.Slice(sstFiles, func(i, j int) bool {
 		if sstFiles[i].level != sstFiles[j].level {
 			return sstFiles[i].level < sstFiles[j].level
@@ -99,11 +293,20 @@ func (l *LSM) loadSST() error {
 		return sstFiles[i].seq < sstFiles[j].seq
 	})
 	for _, sstFile := range sstFiles {
-		node, err := NewNode(l.conf, sstFile.level, sstFile.seq)
+		node, err := NewNode(cf.conf, sstFile.level, sstFile.seq)
 		if err != nil {
 			return err
 		}
-		l.nodes[sstFile.level] = append(l.nodes[sstFile.level], node)
+		node.cf = cf
+		node.createdAt = sstFile.createdAt
+		// 上一个发布版本写入的文件中的值没有类型前缀，与导入的外部文件相同处理，合并时改写为新格式
+		node.external = sstFile.external || node.reader.Legacy()
+		cf.nodes[sstFile.level] = append(cf.nodes[sstFile.level], node)
+		l.logger.Debug("加载SST文件", "cf", cf.name, "level", sstFile.level, "file", sstFile.seq, "bytes", node.Size())
+	}
+	// 0层按编号即写入顺序排列，其余层级的文件互不重叠，按键排序
+	for level := 1; level < len(cf.nodes); level++ {
+		sortBySmallestKey(cf.nodes[level])
 	}
 	return nil
 }
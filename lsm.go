@@ -1,6 +1,7 @@
 package lsm
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"sync"
@@ -8,32 +9,82 @@ import (
 	"time"
 
 	"github.com/aixiasang/sqldb/config"
-	"github.com/aixiasang/sqldb/memtable"
+	"github.com/aixiasang/sqldb/sstable"
 	"github.com/aixiasang/sqldb/utils"
 	"github.com/aixiasang/sqldb/wal"
 )
 
+// immutableMemtable 切换WAL时所有列族的可变内存表一起转为不可变内存表，一起刷盘，
+// 全部安装后才能回收对应的WAL
 type immutableMemtable struct {
-	memtable memtable.MemTable
-	wal      *wal.Wal
+	wal    *wal.Wal
+	reason string            // 刷盘的原因
+	tables []*immutableTable // 各列族的内存表，默认列族在最前
+
+	// 以下字段由LSM.mu保护
+	flushing bool // 是否正在刷盘
+	flushed  bool // 是否已刷盘，等待较早的内存表完成后移出队列
+}
+
+// immutableTable 不可变内存表中一个列族的数据
+type immutableTable struct {
+	cf       *ColumnFamily
+	memtable *memTable
+
+	// 以下字段由LSM.mu保护
+	fileNum    uint32 // 刷盘生成的0层文件编号
+	hasFileNum bool   // 是否已分配文件编号
+	skip       bool   // 列族已删除，不再刷盘
+	node       *Node  // 刷盘生成的文件，内存表为空时为nil
+}
+
+// memtableFor 返回列族在该不可变内存表中的数据，没有时返回nil
+func (immutable *immutableMemtable) memtableFor(cf *ColumnFamily) *memTable {
+	for _, table := range immutable.tables {
+		if table.cf == cf {
+			return table.memtable
+		}
+	}
+	return nil
+}
+
+// size 返回各列族内存表的总大小
+func (immutable *immutableMemtable) size() int {
+	var size int
+	for _, table := range immutable.tables {
+		size += table.memtable.Size()
+	}
+	return size
 }
+
 type LSM struct {
-	conf               *config.Config       // 配置
-	mutableMemtable    memtable.MemTable    // 可变内存表
-	immutableMemtables []*immutableMemtable // 不可变内存表
-	currWal            *wal.Wal             // 当前WAL
-	walId              uint32               // WAL ID
-	levelId            []*atomic.Uint32     // 层级ID
-	nodes              [][]*Node            // 节点
-	sstChan            chan struct{}        // 开启压缩的通道
-	compactChan        chan struct{}        // 开启压缩的通道
-	isRunning          atomic.Bool          // 是否运行
-	closed             atomic.Bool          // 是否关闭
-	mu                 sync.RWMutex         // 互斥锁
-}
-
-// NewLSM 创建并初始化一个新的LSM树实例
-func NewLSM(conf *config.Config) *LSM {
+	conf               *config.Config               // 配置
+	logger             config.Logger                // 日志
+	defaultCF          *ColumnFamily                // 默认列族
+	columnFamilies     []*ColumnFamily              // 所有未删除的列族，按ID排列，默认列族在最前
+	nextColumnFamilyID uint32                       // 下一个新建列族的ID
+	immutableMemtables []*immutableMemtable         // 不可变内存表
+	currWal            *wal.Wal                     // 当前WAL
+	walId              uint32                       // WAL ID
+	logNumber          uint32                       // 打开时清单中记录的最早的未刷盘WAL的编号
+	recycledWals       []string                     // 回收待复用的WAL文件
+	seq                uint64                       // 最后一次写入的序列号
+	bgErr              *BackgroundError             // 后台错误，非nil时拒绝写入
+	flushCond          *sync.Cond                   // 刷盘或合并结束、手动合并结束或出错时通知等待者
+	jobs               chan func()                  // 后台任务队列，容量等于刷盘和合并的并发上限之和
+	runningFlushes     int                          // 已提交的刷盘任务数
+	runningCompactions []*compaction                // 已提交的合并任务
+	manualCompactions  []*manualCompaction          // 等待调度的手动合并
+	bgWg               sync.WaitGroup               // 等待后台工作线程退出
+	bgDone             chan struct{}                // 关闭时通知后台定时任务退出
+	closed             atomic.Bool                  // 是否关闭
+	mu                 sync.RWMutex                 // 互斥锁
+	pendingEvents      []func(config.EventListener) // 持有锁时产生、等待解锁后回调的事件
+	eventMu            sync.Mutex                   // 保护pendingEvents
+}
+
+// NewLSM 创建并初始化一个新的LSM树实例，加载已有的SST和WAL文件
+func NewLSM(conf *config.Config) (*LSM, error) {
 	// 设置默认值以避免nil指针
 	if conf == nil {
 		conf = config.NewConfig()
@@ -42,49 +93,87 @@ func NewLSM(conf *config.Config) *LSM {
 	if conf.MaxLevel <= 0 {
 		conf.MaxLevel = 7 // 默认层级数
 	}
+	if conf.Statistics == nil {
+		conf.Statistics = utils.NewStatistics()
+	}
+	if conf.Clock == nil {
+		conf.Clock = config.SystemClock{}
+	}
+	conf.MaxBackgroundFlushes = max(conf.MaxBackgroundFlushes, 1)
+	conf.MaxBackgroundCompactions = max(conf.MaxBackgroundCompactions, 1)
+	if conf.Level0CompactionTrigger <= 0 {
+		conf.Level0CompactionTrigger = config.DefaultLevel0CompactionTrigger
+	}
+	if conf.MaxBytesForLevelBase <= 0 {
+		conf.MaxBytesForLevelBase = config.DefaultMaxBytesForLevelBase
+	}
+	if conf.LevelSizeMultiplier <= 1 {
+		conf.LevelSizeMultiplier = config.DefaultLevelSizeMultiplier
+	}
+	if conf.TargetFileSize <= 0 {
+		conf.TargetFileSize = config.DefaultTargetFileSize
+	}
+	if conf.UniversalMaxSortedRuns <= 0 {
+		conf.UniversalMaxSortedRuns = config.DefaultUniversalMaxSortedRuns
+	}
+	if conf.UniversalMaxSizeAmplificationPercent <= 0 {
+		conf.UniversalMaxSizeAmplificationPercent = config.DefaultUniversalMaxSizeAmplificationPercent
+	}
+	if conf.FIFOMaxTableFilesSize <= 0 {
+		conf.FIFOMaxTableFilesSize = config.DefaultFIFOMaxTableFilesSize
+	}
 
 	l := &LSM{
 		conf:               conf,
+		logger:             conf.GetLogger(),
 		immutableMemtables: make([]*immutableMemtable, 0),
-		levelId:            make([]*atomic.Uint32, conf.MaxLevel),
-		nodes:              make([][]*Node, conf.MaxLevel),
-		compactChan:        make(chan struct{}, 100), // 增大缓冲区
-		sstChan:            make(chan struct{}, 100), // 增大缓冲区
-		walId:              0,                        // 初始化walId
+		nextColumnFamilyID: 1,
+		jobs:               make(chan func(), conf.MaxBackgroundFlushes+conf.MaxBackgroundCompactions),
+		bgDone:             make(chan struct{}),
+		walId:              0, // 初始化walId
 	}
 
-	// 初始化memtable
-	l.mutableMemtable = config.NewMemTableConstructor()
+	l.flushCond = sync.NewCond(&l.mu)
+
+	// 初始化默认列族，其余列族从清单中加载
+	l.defaultCF = l.newColumnFamily(0, DefaultColumnFamilyName, config.ColumnFamilyOptions{})
+	l.columnFamilies = []*ColumnFamily{l.defaultCF}
 
-	// 初始化层级ID
-	for i := 0; i < conf.MaxLevel; i++ {
-		l.levelId[i] = &atomic.Uint32{}
-		l.nodes[i] = make([]*Node, 0)
-	}
 	// 创建必要的目录
 	if err := l.createDirs(); err != nil {
-		fmt.Printf("[ERROR] 创建目录失败: %v\n", err)
+		return nil, fmt.Errorf("创建目录失败: %w", err)
 	}
 
-	// 重置进行中的合并标记
-	compactionInProgress.Store(false)
-
-	// 标记为运行状态
-	l.isRunning.Store(true)
-
-	// 启动后台压缩线程
-	go l.compactionWorker()
-
 	// 加载SST文件
+	startTime := time.Now()
 	if err := l.loadSST(); err != nil {
-		fmt.Printf("[ERROR] 加载SST文件失败: %v\n", err)
+		l.abortOpen()
+		return nil, fmt.Errorf("加载SST文件失败: %w", err)
 	}
 	// 加载WAL文件
 	if err := l.loadWal(); err != nil {
-		fmt.Printf("[ERROR] 加载WAL文件失败: %v\n", err)
+		l.abortOpen()
+		return nil, fmt.Errorf("加载WAL文件失败: %w", err)
 	}
 
-	return l
+	// 记录恢复后的文件集合和序列号，没有清单的旧目录从此开始使用清单
+	if err := l.saveManifest(); err != nil {
+		l.abortOpen()
+		return nil, fmt.Errorf("写入清单失败: %w", err)
+	}
+
+	l.logger.Info("恢复完成", "wal", l.walId, "immutables", len(l.immutableMemtables),
+		"seq", l.seq, "duration", time.Since(startTime))
+
+	// 启动后台工作线程，刷盘重放出的不可变内存表并检查是否需要合并
+	l.startWorkers()
+	l.startFIFOTTLChecker()
+	l.mu.Lock()
+	l.maybeSchedule()
+	l.mu.Unlock()
+	l.fireEvents()
+
+	return l, nil
 }
 
 // createDirs 创建必要的目录
@@ -94,10 +183,13 @@ func (l *LSM) createDirs() error {
 		l.getWalDir(),
 		l.getSSTDir(),
 	}
+	if l.archiveEnabled() {
+		dirs = append(dirs, l.getArchiveDir())
+	}
 
 	for _, dir := range dirs {
 		if err := os.MkdirAll(dir, 0755); err != nil {
-			fmt.Printf("创建目录失败: %s - %v\n", dir, err)
+			return err
 		}
 	}
 
@@ -106,195 +198,571 @@ func (l *LSM) createDirs() error {
 
 // Put 写入键值对
 func (l *LSM) Put(key, value []byte) error {
+	return l.write([]batchOp{{rec: wal.NewRecord(key, value)}})
+}
+
+// PutWithTTL 写入键值对，ttl后过期。过期的键对Get不可见，合并时被清除
+func (l *LSM) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("TTL必须大于0: %v", ttl)
+	}
+	return l.write([]batchOp{{rec: wal.NewRecordWithTTL(key, value, l.conf.Clock.Now().Add(ttl).UnixNano())}})
+}
+
+// Merge 写入合并操作数，由配置的MergeOperator在读取和合并时作用在键已有的值上，写入时不读取旧值
+func (l *LSM) Merge(key, operand []byte) error {
+	batch := NewWriteBatch()
+	batch.Merge(nil, key, operand)
+	return l.Write(batch)
+}
+
+// Write 原子地提交批次中的全部操作，批次可以跨列族
+func (l *LSM) Write(batch *WriteBatch) error {
+	if batch == nil || len(batch.ops) == 0 {
+		return nil
+	}
+	for _, op := range batch.ops {
+		switch op.rec.RecordType {
+		case wal.RecordTypeMerge:
+			if l.conf.MergeOperator == nil {
+				return ErrNoMergeOperator
+			}
+		case wal.RecordTypeRangeDelete:
+			if err := validateRange(op.rec.Key, op.rec.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return l.write(batch.ops)
+}
+
+// pendingKey 批次中已计算出新值的键
+type pendingKey struct {
+	cf  uint32
+	key string
+}
+
+// write 写入一组操作：先写WAL，再写内存表。默认列族的单个操作写为普通记录，其余写为一条批次记录
+func (l *LSM) write(ops []batchOp) error {
+	_, err := l.writeIf(ops, nil)
+	return err
+}
+
+// writeIf 与write相同，cond不为nil时在持有写锁、写入之前调用，返回false时不写入。返回是否已写入
+func (l *LSM) writeIf(ops []batchOp, cond func() (bool, error)) (bool, error) {
+	if l.closed.Load() {
+		return false, ErrClosed
+	}
+	start := time.Now()
+	defer func() {
+		l.conf.Statistics.Record(utils.HistogramPutTime, time.Since(start))
+	}()
+
+	defer l.fireEvents()
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	// 写入WAL
-	if l.currWal != nil {
-		if err := l.currWal.Write(key, value); err != nil {
-			return fmt.Errorf("写入WAL失败: %v", err)
+	// 等待锁期间LSM可能已经关闭
+	if l.closed.Load() {
+		return false, ErrClosed
+	}
+	if l.bgErr != nil {
+		return false, l.bgErr
+	}
+
+	// 当前WAL已满时先切换内存表，切换失败则本次写入不生效
+	if l.currWal.Size() > l.getUpperMemtableSize() {
+		if err := l.stallWrites(); err != nil {
+			return false, err
+		}
+		if err := l.switchMemtable(flushReasonMemtableFull); err != nil {
+			return false, l.setBackgroundError(BackgroundOpWal, err, true)
+		}
+	}
+	if cond != nil {
+		if ok, err := cond(); err != nil || !ok {
+			return false, err
 		}
 	}
 
-	// 写入内存表
-	if err := l.mutableMemtable.Put(key, value); err != nil {
-		return fmt.Errorf("写入内存表失败: %v", err)
+	// 先计算内存表中的新值，合并操作数无法解析时不写入WAL，重放时也就不会失败。
+	// 批次中同一个键的多个操作依次作用，范围删除作用于批次中之前写入的键
+	cfs := make([]*ColumnFamily, len(ops))
+	entries := make([][]byte, len(ops))
+	pending := make(map[pendingKey][]byte)
+	rangeDels := make(map[uint32][]sstable.RangeTombstone)
+	for i, op := range ops {
+		cf := op.cf
+		if cf == nil {
+			cf = l.defaultCF
+		}
+		if cf.dropped {
+			return false, ErrColumnFamilyDropped
+		}
+		cfs[i] = cf
+		if op.rec.RecordType == wal.RecordTypeRangeDelete {
+			tombstone := sstable.RangeTombstone{Start: op.rec.Key, End: op.rec.Value}
+			rangeDels[cf.id] = append(rangeDels[cf.id], tombstone)
+			for key := range pending {
+				if key.cf == cf.id && tombstone.Contains([]byte(key.key)) {
+					delete(pending, key)
+				}
+			}
+			continue
+		}
+		get := func(key []byte) ([]byte, error) {
+			raw, ok := pending[pendingKey{cf: cf.id, key: string(key)}]
+			if ok && raw != nil {
+				return raw, nil
+			}
+			if rangeDeleted(rangeDels[cf.id], key) {
+				return encodeValue(kindDeletion, nil), nil
+			}
+			if ok {
+				// 批次中的单删除已与写入抵消，键将从内存表中移除
+				if cf.mutableMemtable.covers(key) {
+					return encodeValue(kindDeletion, nil), nil
+				}
+				return nil, errSingleDeleted
+			}
+			return cf.mutableMemtable.get(key)
+		}
+		entry, err := l.memtableEntry(get, op.rec)
+		if err != nil {
+			return false, err
+		}
+		entries[i] = entry
+		pending[pendingKey{cf: cf.id, key: string(op.rec.Key)}] = entry
 	}
 
-	// 检查是否需要切换内存表
-	if l.currWal != nil && l.currWal.Size() > l.getUpperMemtableSize() {
-		if err := l.switchMemtable(); err != nil {
-			return fmt.Errorf("切换内存表失败: %v", err)
+	rec := ops[0].rec
+	if len(ops) > 1 || cfs[0] != l.defaultCF {
+		records := make([]*wal.Record, len(ops))
+		for i, op := range ops {
+			op.rec.ColumnFamily = cfs[i].id
+			records[i] = op.rec
 		}
+		rec = wal.NewBatchRecord(records)
 	}
 
-	return nil
+	// 写入WAL
+	seq := l.seq + 1
+	rec.Seq = seq
+	if err := l.currWal.Write(rec); err != nil {
+		return false, l.setBackgroundError(BackgroundOpWal, err, true)
+	}
+	l.seq = seq
+
+	// 写入内存表，删除写入删除标记，与写入抵消的单删除移除该键
+	var bytes int
+	for i, op := range ops {
+		var err error
+		switch {
+		case op.rec.RecordType == wal.RecordTypeRangeDelete:
+			err = cfs[i].mutableMemtable.deleteRange(op.rec.Key, op.rec.Value)
+		case entries[i] == nil:
+			err = cfs[i].mutableMemtable.Delete(op.rec.Key)
+		default:
+			err = cfs[i].mutableMemtable.Put(op.rec.Key, entries[i])
+		}
+		if err != nil {
+			return false, fmt.Errorf("写入内存表失败: %v", err)
+		}
+		bytes += len(op.rec.Key) + len(op.rec.Value)
+	}
+	l.conf.Statistics.Add(utils.TickerKeysWritten, uint64(len(ops)))
+	l.conf.Statistics.Add(utils.TickerBytesWritten, uint64(bytes))
+
+	return true, nil
 }
 
-// switchMemtable 切换到新的内存表
-func (l *LSM) switchMemtable() error {
-	fmt.Println("[DEBUG] 开始切换内存表")
+// stallWrites 等待刷盘的不可变内存表达到上限时阻塞写入，直到后台刷盘跟上、出错或LSM关闭。调用方需持有写锁
+func (l *LSM) stallWrites() error {
+	limit := l.conf.MaxImmutableMemtables
+	if limit <= 0 || len(l.immutableMemtables) < limit {
+		return nil
+	}
+
+	start := time.Now()
+	l.logger.Warn("等待刷盘的内存表过多，暂停写入", "immutables", len(l.immutableMemtables), "limit", limit)
+	l.queueEvent(func(listener config.EventListener) {
+		listener.OnWriteStall(config.WriteStallInfo{Stalled: true, ImmutableMemtables: len(l.immutableMemtables), Limit: limit})
+	})
+	l.maybeSchedule()
+	// 停顿开始的事件不能等到写入结束，暂时解锁回调，与等待时释放锁相同，之后重新检查条件
+	l.mu.Unlock()
+	l.fireEvents()
+	l.mu.Lock()
+	for len(l.immutableMemtables) >= limit && l.bgErr == nil && !l.closed.Load() {
+		l.flushCond.Wait()
+	}
+	stall := time.Since(start)
+	l.conf.Statistics.Add(utils.TickerStalls, 1)
+	l.conf.Statistics.Add(utils.TickerStallMicros, uint64(stall.Microseconds()))
+	l.logger.Info("恢复写入", "immutables", len(l.immutableMemtables), "duration", stall)
+	l.queueEvent(func(listener config.EventListener) {
+		listener.OnWriteStall(config.WriteStallInfo{ImmutableMemtables: len(l.immutableMemtables), Limit: limit, Duration: stall})
+	})
+
+	if l.closed.Load() {
+		return ErrClosed
+	}
+	if l.bgErr != nil {
+		return l.bgErr
+	}
+	return nil
+}
 
-	// 创建不可变内存表
-	immutable := &immutableMemtable{
-		memtable: l.mutableMemtable,
-		wal:      l.currWal,
+// switchMemtable 切换到新的内存表，reason为刷盘的原因。新的WAL创建失败时保持当前内存表不变
+func (l *LSM) switchMemtable(reason string) error {
+	// 先创建新的WAL，失败时不做任何切换
+	newWal, err := l.newWal(l.walId + 1)
+	if err != nil {
+		l.logger.Error("创建新WAL失败", "wal", l.walId+1, "error", err)
+		return err
 	}
+	l.walId++
 
-	// 添加到不可变列表
+	// 创建不可变内存表并添加到不可变列表，各列族换上新的内存表
+	immutable := l.freezeMemtables(reason)
 	l.immutableMemtables = append(l.immutableMemtables, immutable)
-	fmt.Printf("[DEBUG] 添加新的不可变内存表，现在共有 %d 个\n", len(l.immutableMemtables))
+	l.currWal = newWal
+	l.logger.Debug("切换内存表", "wal", l.walId, "prev_wal", immutable.wal.LogNum(),
+		"bytes", immutable.wal.Size(), "immutables", len(l.immutableMemtables))
 
-	// 创建新的内存表
-	l.mutableMemtable = config.NewMemTableConstructor()
+	// 调度刷盘
+	l.maybeSchedule()
 
-	// 创建新的WAL
-	l.walId++
-	walPath := l.getWalPath(l.walId)
-	fmt.Printf("[DEBUG] 创建新的WAL文件: %s\n", walPath)
+	return nil
+}
 
-	newWal, err := wal.NewWal(l.conf, walPath)
-	if err != nil {
-		fmt.Printf("[ERROR] 创建新WAL失败: %v\n", err)
-		// 尝试临时目录
-		tempPath := fmt.Sprintf("%s/lsm_%d.wal", os.TempDir(), time.Now().UnixNano())
-		fmt.Printf("[DEBUG] 尝试在临时目录创建WAL: %s\n", tempPath)
+// freezeMemtables 把所有列族的可变内存表和当前WAL组成不可变内存表，并为各列族创建新的内存表。调用方需持有写锁
+func (l *LSM) freezeMemtables(reason string) *immutableMemtable {
+	immutable := &immutableMemtable{wal: l.currWal, reason: reason}
+	for _, cf := range l.columnFamilies {
+		immutable.tables = append(immutable.tables, &immutableTable{cf: cf, memtable: cf.mutableMemtable})
+		cf.mutableMemtable = newMemTable(cf.conf)
+	}
+	return immutable
+}
 
-		newWal, err = wal.NewWal(l.conf, tempPath)
-		if err != nil {
-			fmt.Printf("[ERROR] 在临时目录创建WAL也失败: %v\n", err)
-			// 继续运行，但没有WAL
-			l.currWal = nil
-			return nil
-		}
+// mutableSize 返回所有列族可变内存表的总大小。调用方需持有锁
+func (l *LSM) mutableSize() int {
+	var size int
+	for _, cf := range l.columnFamilies {
+		size += cf.mutableMemtable.Size()
 	}
+	return size
+}
 
-	l.currWal = newWal
-	fmt.Println("[DEBUG] 新的WAL创建成功")
+// setBackgroundError 记录后台错误使LSM进入只读状态，已有错误时保留最早的错误。调用方需持有写锁
+func (l *LSM) setBackgroundError(op BackgroundOp, err error, recoverable bool) error {
+	if l.bgErr == nil {
+		l.logger.Error("后台出错，进入只读状态", "op", op, "recoverable", recoverable, "error", err)
+		l.bgErr = &BackgroundError{Op: op, Err: err, Recoverable: recoverable}
+		l.flushCond.Broadcast()
+		l.queueEvent(func(listener config.EventListener) {
+			listener.OnBackgroundError(config.BackgroundErrorInfo{Op: string(op), Err: err, Recoverable: recoverable})
+		})
+	}
+	return l.bgErr
+}
 
-	// 触发压缩
-	fmt.Println("[DEBUG] 发送合并信号")
-	select {
-	case l.compactChan <- struct{}{}:
-		fmt.Println("[DEBUG] 成功发送内存表合并信号")
-	default:
-		fmt.Println("[WARN] 合并通道已满，使用goroutine发送")
-		go func() {
-			l.compactChan <- struct{}{}
-			fmt.Println("[DEBUG] 通过goroutine发送合并信号成功")
-		}()
+// BackgroundError 返回当前的后台错误，没有错误时为nil
+func (l *LSM) BackgroundError() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.bgErr == nil {
+		return nil
 	}
+	return l.bgErr
+}
 
+// Resume 清除可恢复的后台错误并恢复写入。WAL出错时切换到新的WAL，
+// 然后重新调度未完成的刷盘；不可恢复的错误原样返回
+func (l *LSM) Resume() error {
+	if l.closed.Load() {
+		return ErrClosed
+	}
+
+	defer l.fireEvents()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.bgErr == nil {
+		return nil
+	}
+	if !l.bgErr.Recoverable {
+		return l.bgErr
+	}
+	bgErr := l.bgErr
+	l.bgErr = nil
+
+	// 出错的WAL末尾可能有不完整的记录，不再继续写入
+	if bgErr.Op == BackgroundOpWal {
+		if err := l.switchMemtable(flushReasonWalError); err != nil {
+			return l.setBackgroundError(BackgroundOpWal, err, true)
+		}
+	}
+	l.maybeSchedule()
+	l.logger.Info("已从后台错误中恢复", "op", bgErr.Op)
 	return nil
 }
 
 // getUpperMemtableSize 获取内存表大小上限
-func (l *LSM) getUpperMemtableSize() uint32 {
-	return uint32(utils.GetCapSize(l.conf.MemTableCapSize))
+func (l *LSM) getUpperMemtableSize() int64 {
+	return utils.GetCapSize(l.conf.MemTableCapSize)
 }
 
-// Get 获取键对应的值
+// Get 获取默认列族中键对应的值
 func (l *LSM) Get(key []byte) ([]byte, bool, error) {
+	return l.GetCF(l.defaultCF, key)
+}
+
+// GetCF 获取列族中键对应的值
+func (l *LSM) GetCF(cf *ColumnFamily, key []byte) ([]byte, bool, error) {
 	if l.closed.Load() {
-		return nil, false, fmt.Errorf("LSM已关闭")
+		return nil, false, ErrClosed
+	}
+
+	start := time.Now()
+	value, found, err := l.get(cf, key)
+	l.conf.Statistics.Record(utils.HistogramGetTime, time.Since(start))
+	l.conf.Statistics.Add(utils.TickerKeysRead, 1)
+	if found {
+		l.conf.Statistics.Add(utils.TickerKeysFound, 1)
+		l.conf.Statistics.Add(utils.TickerBytesRead, uint64(len(value)))
 	}
+	return value, found, err
+}
 
+func (l *LSM) get(cf *ColumnFamily, key []byte) ([]byte, bool, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
+	if cf.dropped {
+		return nil, false, ErrColumnFamilyDropped
+	}
+	return l.getLocked(cf, key)
+}
+
+// getLocked 查找列族中键对应的值。调用方需持有锁
+func (l *LSM) getLocked(cf *ColumnFamily, key []byte) ([]byte, bool, error) {
+	// 从新到旧查找，遇到普通值或删除标记时停止，遇到合并操作数时继续向下查找基础值
+	var versions [][]byte
+	l.lookupVersions(cf, key, func(raw []byte) bool {
+		versions = append(versions, raw)
+		kind, _ := decodeValue(raw)
+		return kind == kindMerge
+	})
+	if len(versions) == 0 {
+		return nil, false, nil
+	}
+	raw, err := l.resolveVersions(key, versions, true)
+	if err != nil {
+		return nil, false, err
+	}
+	return l.lookupResult(raw)
+}
+
+// lookupVersions 从新到旧依次把键在列族的内存表和SST中的值交给fn，fn返回false时停止。
+// 每个内存表、0层文件或更高的层级中，键比范围删除标记新，先检查键再检查标记，
+// 键被标记覆盖时交给fn一个删除标记后停止。调用方需持有锁
+func (l *LSM) lookupVersions(cf *ColumnFamily, key []byte, fn func(raw []byte) bool) {
+	rangeDeletion := func() {
+		fn(encodeValue(kindDeletion, nil))
+	}
+
 	// 1. 从可变内存表中获取
-	if value, err := l.mutableMemtable.Get(key); err == nil {
-		return value, true, nil
+	if raw, err := cf.mutableMemtable.Get(key); err == nil && !fn(raw) {
+		return
+	}
+	if cf.mutableMemtable.covers(key) {
+		rangeDeletion()
+		return
 	}
 
-	// 2. 从不可变内存表中获取
+	// 2. 从不可变内存表中获取，列族在该内存表之后创建时没有数据
 	for i := len(l.immutableMemtables) - 1; i >= 0; i-- {
-		if value, err := l.immutableMemtables[i].memtable.Get(key); err == nil {
-			return value, true, nil
+		mem := l.immutableMemtables[i].memtableFor(cf)
+		if mem == nil {
+			continue
+		}
+		if raw, err := mem.Get(key); err == nil && !fn(raw) {
+			return
+		}
+		if mem.covers(key) {
+			rangeDeletion()
+			return
 		}
 	}
 
 	// 3. 从SSTable中获取
-	for level, nodes := range l.nodes {
+	for level, nodes := range cf.nodes {
 		// 对于0层，需要检查所有表
 		if level == 0 {
 			for i := len(nodes) - 1; i >= 0; i-- {
-				if value, found, err := nodes[i].Get(key); err == nil && found {
-					return value, true, nil
+				if raw, found, err := nodes[i].Get(key); err == nil && found && !fn(raw) {
+					return
+				}
+				if nodes[i].covers(key) {
+					rangeDeletion()
+					return
 				}
 			}
 		} else {
-			// 更高层级不会重叠
+			// 更高层级不会重叠，最多只有一个文件包含该键
 			for _, node := range nodes {
-				if value, found, err := node.Get(key); err == nil && found {
-					return value, true, nil
+				if raw, found, err := node.Get(key); err == nil && found && !fn(raw) {
+					return
+				}
+				if node.covers(key) {
+					rangeDeletion()
+					return
 				}
 			}
 		}
 	}
+}
 
-	return nil, false, nil
+// lookupResult 将找到的值转换为Get的返回值，删除标记、单删除标记和已过期的值视为不存在
+func (l *LSM) lookupResult(raw []byte) ([]byte, bool, error) {
+	kind, value, _ := decodeEntry(raw, l.now())
+	if isDeletion(kind) {
+		return nil, false, nil
+	}
+	return value, true, nil
 }
 
-// Delete 删除键值对
+// LatestSequenceNumber 返回最后一次写入的序列号
+func (l *LSM) LatestSequenceNumber() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.seq
+}
+
+// Delete 删除键值对，写入的删除标记在合并到最底层时清除
 func (l *LSM) Delete(key []byte) error {
 	// 删除等同于写入nil值
 	return l.Put(key, nil)
 }
 
-// Close 关闭LSM
+// Close 关闭LSM：拒绝新的写入，等待进行中的刷盘和合并结束，
+// 开启FlushOnClose时将内存表全部刷盘，最后释放所有文件。返回关闭过程中的全部错误
 func (l *LSM) Close() error {
-	fmt.Println("[DEBUG] 开始关闭LSM")
+	if !l.closed.CompareAndSwap(false, true) {
+		return nil
+	}
 
-	if l.closed.CompareAndSwap(false, true) {
-		// 停止后台线程
-		l.isRunning.Store(false)
-		fmt.Println("[DEBUG] 已将 isRunning 设置为 false")
+	// 唤醒停顿中的写入。closed已设置，持锁关闭jobs后不会再有新任务提交
+	l.mu.Lock()
+	l.flushCond.Broadcast()
+	close(l.jobs)
+	close(l.bgDone)
+	l.mu.Unlock()
+
+	// 等待已提交的刷盘和合并完成
+	l.bgWg.Wait()
+
+	var errs []error
+	if l.conf.FlushOnClose {
+		if err := l.flushOnClose(); err != nil {
+			errs = append(errs, err)
+		}
+	}
 
-		// 等待压缩完成
-		fmt.Println("[DEBUG] 等待压缩完成")
-		time.Sleep(100 * time.Millisecond)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	files, closeErrs := l.closeFiles()
+	l.logger.Info("LSM已关闭", "immutables", len(l.immutableMemtables), "files", files)
 
-		l.mu.Lock()
-		defer l.mu.Unlock()
+	return errors.Join(append(errs, closeErrs...)...)
+}
 
-		// 关闭WAL
-		if l.currWal != nil {
-			fmt.Println("[DEBUG] 关闭当前WAL")
-			if err := l.currWal.Close(); err != nil {
-				fmt.Printf("[ERROR] 关闭WAL失败: %v\n", err)
-			}
+// abortOpen 打开失败时释放已打开的文件。不能调用Close：开启FlushOnClose时只重放了一部分的内存表
+// 会被刷盘并删除对应的WAL，下次打开时丢失未重放的记录。后台工作线程此时尚未启动
+func (l *LSM) abortOpen() {
+	l.closed.Store(true)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeFiles()
+}
+
+// closeFiles 关闭WAL和所有SST文件，返回关闭的SST文件数和关闭失败的错误。调用方需持有写锁
+func (l *LSM) closeFiles() (int, []error) {
+	var errs []error
+
+	// 关闭WAL
+	if l.currWal != nil {
+		if err := l.currWal.Close(); err != nil {
+			l.logger.Error("关闭WAL失败", "wal", l.currWal.LogNum(), "error", err)
+			errs = append(errs, fmt.Errorf("关闭WAL %d 失败: %w", l.currWal.LogNum(), err))
 		}
+		l.currWal = nil
+	}
 
-		// 关闭不可变内存表WAL
-		immCount := len(l.immutableMemtables)
-		fmt.Printf("[DEBUG] 关闭 %d 个不可变内存表的WAL\n", immCount)
-		for i, immutable := range l.immutableMemtables {
-			if immutable.wal != nil {
-				if err := immutable.wal.Close(); err != nil {
-					fmt.Printf("[ERROR] 关闭第 %d 个不可变内存表WAL失败: %v\n", i, err)
+	// 关闭不可变内存表WAL，以及较早的内存表刷盘失败而未能加入0层的文件
+	for _, immutable := range l.immutableMemtables {
+		for _, table := range immutable.tables {
+			if table.node != nil {
+				if err := table.node.Close(); err != nil {
+					errs = append(errs, fmt.Errorf("关闭SST文件 %s 失败: %w", table.node.path, err))
 				}
 			}
 		}
+		if immutable.wal != nil {
+			if err := immutable.wal.Close(); err != nil {
+				l.logger.Error("关闭不可变内存表WAL失败", "wal", immutable.wal.LogNum(), "error", err)
+				errs = append(errs, fmt.Errorf("关闭WAL %d 失败: %w", immutable.wal.LogNum(), err))
+			}
+		}
+	}
 
-		// 关闭所有节点
-		nodeCount := 0
-		for level, nodes := range l.nodes {
-			levelCount := len(nodes)
-			nodeCount += levelCount
-			fmt.Printf("[DEBUG] 关闭第 %d 层的 %d 个节点\n", level, levelCount)
-			for i, node := range nodes {
+	// 关闭所有节点
+	nodeCount := 0
+	for _, cf := range l.columnFamilies {
+		for level, nodes := range cf.nodes {
+			nodeCount += len(nodes)
+			for _, node := range nodes {
 				if err := node.Close(); err != nil {
-					fmt.Printf("[ERROR] 关闭第 %d 层第 %d 个SSTable节点失败: %v\n", level, i, err)
+					l.logger.Error("关闭SSTable节点失败", "cf", cf.name, "level", level, "file", node.seq, "error", err)
+					errs = append(errs, fmt.Errorf("关闭SST文件 %s 失败: %w", node.path, err))
 				}
 			}
 		}
-		fmt.Printf("[DEBUG] 总共关闭了 %d 个SST节点\n", nodeCount)
+	}
+	return nodeCount, errs
+}
 
-		fmt.Println("[DEBUG] LSM关闭完成")
-	} else {
-		fmt.Println("[DEBUG] LSM已经关闭，无需重复操作")
+// flushOnClose 将可变内存表转为不可变内存表，并在当前线程中按顺序刷盘全部不可变内存表。
+// 调用时后台工作线程已经退出
+func (l *LSM) flushOnClose() error {
+	l.mu.Lock()
+	if l.bgErr != nil {
+		err := l.bgErr
+		l.mu.Unlock()
+		return err
+	}
+	if l.currWal != nil && l.mutableSize() > 0 {
+		l.immutableMemtables = append(l.immutableMemtables, l.freezeMemtables(flushReasonClose))
+		l.currWal = nil
+	}
+	var flushes []func()
+	for _, immutable := range l.immutableMemtables {
+		if !immutable.flushed {
+			flushes = append(flushes, l.prepareFlush(immutable))
+		}
 	}
+	l.mu.Unlock()
 
+	for _, flush := range flushes {
+		flush()
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.bgErr != nil {
+		return l.bgErr
+	}
 	return nil
 }
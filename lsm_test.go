@@ -1,23 +1,36 @@
 package lsm
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aixiasang/sqldb/config"
 	"github.com/aixiasang/sqldb/utils"
+	"github.com/aixiasang/sqldb/wal"
 )
 
 func TestLsmPut(t *testing.T) {
 	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
 	// 使用更小的内存表容量以更快触发合并
 	conf.MemTableCapSize = 64
 	fmt.Println("[TEST] 创建LSM实例，内存表容量:", conf.MemTableCapSize)
 
-	lsm := NewLSM(conf)
-	if lsm == nil {
-		t.Fatal("无法创建LSM实例")
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatalf("无法创建LSM实例: %v", err)
 	}
 
 	// 确保测试结束后资源被正确清理
@@ -87,7 +100,7 @@ func TestLsmPut(t *testing.T) {
 	// 打印LSM状态
 	lsm.mu.RLock()
 	fmt.Printf("[TEST] LSM状态: 不可变内存表=%d, L0节点=%d\n",
-		len(lsm.immutableMemtables), len(lsm.nodes[0]))
+		len(lsm.immutableMemtables), len(lsm.defaultCF.nodes[0]))
 	lsm.mu.RUnlock()
 
 	if failCount == 0 {
@@ -100,13 +113,14 @@ func TestLsmPut(t *testing.T) {
 // 专门测试合并功能
 func TestLsmCompaction(t *testing.T) {
 	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
 	// 使用更小的内存表容量和L0合并阈值以快速触发合并
 	conf.MemTableCapSize = 32
 	fmt.Println("[TEST] 创建LSM实例，内存表容量:", conf.MemTableCapSize)
 
-	lsm := NewLSM(conf)
-	if lsm == nil {
-		t.Fatal("无法创建LSM实例")
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatalf("无法创建LSM实例: %v", err)
 	}
 
 	// 确保测试结束后资源被正确清理
@@ -143,7 +157,7 @@ func TestLsmCompaction(t *testing.T) {
 		// 每写入一批后打印LSM状态并等待1秒观察合并
 		lsm.mu.RLock()
 		immCount := len(lsm.immutableMemtables)
-		l0Count := len(lsm.nodes[0])
+		l0Count := len(lsm.defaultCF.nodes[0])
 		lsm.mu.RUnlock()
 
 		fmt.Printf("[TEST] 当前LSM状态: 不可变内存表=%d, L0节点=%d\n", immCount, l0Count)
@@ -190,7 +204,7 @@ func TestLsmCompaction(t *testing.T) {
 	// 最终状态
 	lsm.mu.RLock()
 	immCount := len(lsm.immutableMemtables)
-	l0Count := len(lsm.nodes[0])
+	l0Count := len(lsm.defaultCF.nodes[0])
 	lsm.mu.RUnlock()
 
 	fmt.Printf("[TEST] 测试完成，最终LSM状态: 不可变内存表=%d, L0节点=%d, 验证错误=%d\n",
@@ -202,3 +216,1073 @@ func TestLsmCompaction(t *testing.T) {
 		t.Errorf("合并测试失败，有 %d 个键值对验证出错", errorCount)
 	}
 }
+
+func TestNewLSM_InvalidDataDir(t *testing.T) {
+	conf := config.NewConfig()
+	dataDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(dataDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf.DataDir = dataDir
+
+	if _, err := NewLSM(conf); err == nil {
+		t.Fatal("expected error when data dir is a file")
+	}
+}
+
+func TestLsmReopen(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataCount := 100
+	for i := 0; i < dataCount; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 等待内存表刷盘生成SST
+	time.Sleep(1500 * time.Millisecond)
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后继续写入，新生成的SST不能覆盖已有文件
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := dataCount; i < 2*dataCount; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 2*dataCount; i++ {
+		value, found, err := lsm.Get(utils.GenerateKey(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || string(value) != string(utils.GenerateValue(i)) {
+			t.Fatalf("key %s not match after reopen: found=%v, value=%s", utils.GenerateKey(i), found, value)
+		}
+	}
+}
+
+func TestLsmDeleteReopen(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := utils.GenerateKey(1)
+	if err := lsm.Put(key, utils.GenerateValue(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := lsm.Get(key); found {
+		t.Fatal("expected key to be deleted")
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重放WAL中的删除记录后，删除标记仍然遮蔽SST中的旧值
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	if _, found, _ := lsm.Get(key); found {
+		t.Fatal("deleted key reappeared after reopen")
+	}
+}
+
+func TestLsmReplayLegacyWal(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	walDir := filepath.Join(conf.DataDir, conf.WalDir)
+	if err := os.MkdirAll(walDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// 旧版本崩溃后留下的WAL：记录头部只有类型、key长度和value长度，写入为0，删除为1
+	legacy := func(recordType byte, key, value []byte) []byte {
+		data := []byte{recordType}
+		data = binary.BigEndian.AppendUint32(data, uint32(len(key)))
+		data = binary.BigEndian.AppendUint32(data, uint32(len(value)))
+		data = append(append(data, key...), value...)
+		return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+	}
+	var data []byte
+	for i := 0; i < 10; i++ {
+		data = append(data, legacy(0, utils.GenerateKey(i), utils.GenerateValue(i))...)
+	}
+	data = append(data, legacy(1, utils.GenerateKey(3), nil)...)
+	if err := os.WriteFile(filepath.Join(walDir, "0.wal"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		value, found, err := lsm.Get(utils.GenerateKey(i))
+		if err != nil || found != (i != 3) || (found && string(value) != string(utils.GenerateValue(i))) {
+			t.Fatalf("key %d: value=%q, found=%v, err=%v", i, value, found, err)
+		}
+	}
+	// 新记录追加在旧记录之后，重新打开后两者都能重放
+	if err := lsm.Put(utils.GenerateKey(10), utils.GenerateValue(10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for _, i := range []int{0, 9, 10} {
+		if _, found, err := lsm.Get(utils.GenerateKey(i)); err != nil || !found {
+			t.Fatalf("key %d: found=%v, err=%v", i, found, err)
+		}
+	}
+}
+
+func TestLsmBackgroundError(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+	conf.WalRecycleNum = 0
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	// 删除WAL目录，使切换内存表时无法创建新的WAL
+	walDir := lsm.getWalDir()
+	if err := os.RemoveAll(walDir); err != nil {
+		t.Fatal(err)
+	}
+	var putErr error
+	for i := 0; i < 100 && putErr == nil; i++ {
+		putErr = lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i))
+	}
+	if !errors.Is(putErr, ErrReadOnly) {
+		t.Fatalf("expected read only error, got %v", putErr)
+	}
+	var bgErr *BackgroundError
+	if !errors.As(lsm.BackgroundError(), &bgErr) || bgErr.Op != BackgroundOpWal || !bgErr.Recoverable {
+		t.Fatalf("unexpected background error: %v", lsm.BackgroundError())
+	}
+	// 只读状态下拒绝所有写入
+	if err := lsm.Put([]byte("key"), []byte("value")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected read only error, got %v", err)
+	}
+
+	// 修复目录后恢复写入
+	if err := os.MkdirAll(walDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if lsm.BackgroundError() != nil {
+		t.Fatalf("expected background error cleared, got %v", lsm.BackgroundError())
+	}
+	if err := lsm.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	value, found, err := lsm.Get([]byte("key"))
+	if err != nil || !found || string(value) != "value" {
+		t.Fatalf("unexpected get result: %s, %v, %v", value, found, err)
+	}
+}
+
+func TestLsmLogger(t *testing.T) {
+	buf := &syncBuffer{}
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+	conf.Logger = slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	flushed := false
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		if entry["msg"] != "内存表刷盘完成" {
+			continue
+		}
+		flushed = true
+		for _, key := range []string{"level", "file", "bytes", "duration", "wal"} {
+			if _, ok := entry[key]; !ok {
+				t.Fatalf("flush log missing %q: %s", key, line)
+			}
+		}
+	}
+	if !flushed {
+		t.Fatal("expected flush log")
+	}
+}
+
+// syncBuffer 并发安全的日志缓冲区
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLsmFailedOpenKeepsWal(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 较新的WAL中第一条记录损坏(不是末尾)，0.wal重放后打开失败
+	walPath := lsm.getWalPath(1)
+	w, err := wal.NewWal(conf, walPath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := uint64(11); seq <= 12; seq++ {
+		if err := w.Write(&wal.Record{RecordType: wal.RecordTypePut, Seq: seq, Key: []byte("key"), Value: []byte("value")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 翻转value的最后一个字节，CRC校验失败
+	data[len("key")+25] ^= 0xff
+	if err := os.WriteFile(walPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf.FlushOnClose = true
+	if _, err := NewLSM(conf); err == nil {
+		t.Fatal("expected open to fail on corrupted WAL")
+	}
+	// 打开失败时不刷盘，也不删除已重放的WAL
+	ssts, err := filepath.Glob(filepath.Join(lsm.getSSTDir(), "*.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ssts) != 0 {
+		t.Fatalf("expected no tables after failed open, got %v", ssts)
+	}
+	if _, err := os.Stat(lsm.getWalPath(0)); err != nil {
+		t.Fatalf("expected replayed WAL to be kept: %v", err)
+	}
+
+	if err := os.Remove(walPath); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 10; i++ {
+		if _, found, err := lsm.Get(utils.GenerateKey(i)); err != nil || !found {
+			t.Fatalf("key %d: found=%v, err=%v", i, found, err)
+		}
+	}
+}
+
+func TestLsmFlushOnClose(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.FlushOnClose = true
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataCount := 20
+	for i := 0; i < dataCount; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("expected second close to succeed, got %v", err)
+	}
+	if err := lsm.Put([]byte("key"), []byte("value")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected closed error, got %v", err)
+	}
+	if _, _, err := lsm.Get([]byte("key")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected closed error, got %v", err)
+	}
+
+	// 内存表已全部刷盘，重新打开时没有需要重放的WAL
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	if size := lsm.defaultCF.mutableMemtable.Size(); size != 0 {
+		t.Fatalf("expected empty memtable after reopen, got %d bytes", size)
+	}
+	if len(lsm.defaultCF.nodes[0]) != 1 {
+		t.Fatalf("expected 1 file at level 0, got %d", len(lsm.defaultCF.nodes[0]))
+	}
+	for i := 0; i < dataCount; i++ {
+		value, found, err := lsm.Get(utils.GenerateKey(i))
+		if err != nil || !found || string(value) != string(utils.GenerateValue(i)) {
+			t.Fatalf("key %d not match: found=%v, err=%v", i, found, err)
+		}
+	}
+}
+
+// blockingListener 在刷盘开始时阻塞，直到release被关闭
+type blockingListener struct {
+	config.NoopEventListener
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (b *blockingListener) OnFlushBegin(config.FlushInfo) {
+	b.once.Do(func() { close(b.started) })
+	<-b.release
+}
+
+func TestLsmCloseWaitsForFlush(t *testing.T) {
+	listener := &blockingListener{started: make(chan struct{}), release: make(chan struct{})}
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+	conf.Listeners = []config.EventListener{listener}
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-listener.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush not started")
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- lsm.Close()
+	}()
+	select {
+	case err := <-closed:
+		t.Fatalf("close returned before flush finished: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(listener.release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("close did not return after flush finished")
+	}
+}
+
+// counterOperator 把操作数作为整数累加到已有的值上
+type counterOperator struct{}
+
+func (counterOperator) Name() string { return "counter" }
+
+func (counterOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, bool) {
+	var sum int
+	if existing != nil {
+		n, err := strconv.Atoi(string(existing))
+		if err != nil {
+			return nil, false
+		}
+		sum = n
+	}
+	for _, operand := range operands {
+		n, err := strconv.Atoi(string(operand))
+		if err != nil {
+			return nil, false
+		}
+		sum += n
+	}
+	return []byte(strconv.Itoa(sum)), true
+}
+
+func (counterOperator) PartialMerge(key, left, right []byte) ([]byte, bool) {
+	l, err1 := strconv.Atoi(string(left))
+	r, err2 := strconv.Atoi(string(right))
+	if err1 != nil || err2 != nil {
+		return nil, false
+	}
+	return []byte(strconv.Itoa(l + r)), true
+}
+
+func TestLsmMerge(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Merge([]byte("counter"), []byte("1")); !errors.Is(err, ErrNoMergeOperator) {
+		t.Fatalf("expected ErrNoMergeOperator, got %v", err)
+	}
+	lsm.Close()
+
+	conf.MergeOperator = counterOperator{}
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 每个键先写入基础值或删除，再在多次刷盘之间累加，操作数分布在内存表和多个SST中
+	dataCount, rounds := 50, 5
+	want := make([]int, dataCount)
+	for i := 0; i < dataCount; i++ {
+		switch i % 3 {
+		case 0:
+			if err := lsm.Put(utils.GenerateKey(i), []byte("100")); err != nil {
+				t.Fatal(err)
+			}
+			want[i] = 100
+		case 1:
+			if err := lsm.Delete(utils.GenerateKey(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < dataCount; i++ {
+			if err := lsm.Merge(utils.GenerateKey(i), []byte(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+			want[i] += i
+		}
+		if round%2 == 0 {
+			if err := lsm.Flush(true); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	verify := func() {
+		t.Helper()
+		for i := 0; i < dataCount; i++ {
+			value, found, err := lsm.Get(utils.GenerateKey(i))
+			if err != nil || !found || string(value) != strconv.Itoa(want[i]) {
+				t.Fatalf("key %d: value=%q, found=%v, err=%v, want %d", i, value, found, err, want[i])
+			}
+		}
+	}
+	verify()
+
+	// 合并到最底层后操作数解析为普通值
+	if err := lsm.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	verify()
+	lsm.mu.RLock()
+	for _, nodes := range lsm.defaultCF.nodes {
+		for _, node := range nodes {
+			iter := node.Iterator()
+			for iter.First(); iter.Valid(); iter.Next() {
+				if kind, _ := decodeValue(iter.Value()); kind != kindValue {
+					t.Errorf("unexpected kind %d for key %s after compaction", kind, iter.Key())
+				}
+			}
+		}
+	}
+	lsm.mu.RUnlock()
+
+	// 重放WAL中的合并记录
+	if err := lsm.Merge(utils.GenerateKey(0), []byte("7")); err != nil {
+		t.Fatal(err)
+	}
+	want[0] += 7
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	verify()
+
+	// 内存表中有基础值时，无法解析的操作数在写入时拒绝，否则在读取时报错
+	if err := lsm.Put([]byte("bad"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Merge([]byte("bad"), []byte("x")); !errors.Is(err, ErrMergeFailed) {
+		t.Fatalf("expected ErrMergeFailed, got %v", err)
+	}
+	if err := lsm.Merge(utils.GenerateKey(1), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := lsm.Get(utils.GenerateKey(1)); !errors.Is(err, ErrMergeFailed) {
+		t.Fatalf("expected ErrMergeFailed, got %v", err)
+	}
+}
+
+func TestLsmMerge_PartialMerge(t *testing.T) {
+	conf := config.NewConfig()
+	conf.MergeOperator = counterOperator{}
+	l := &LSM{conf: conf}
+	key := []byte("counter")
+
+	// 没有基础值且更旧的数据中可能还有该键时只合并操作数
+	versions := [][]byte{encodeOperands([][]byte{[]byte("3")}), encodeOperands([][]byte{[]byte("1"), []byte("2")})}
+	raw, err := l.resolveVersions(key, versions, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kind, value := decodeValue(raw)
+	operands, err := decodeOperands(value)
+	if err != nil || kind != kindMerge || len(operands) != 1 || string(operands[0]) != "6" {
+		t.Fatalf("kind=%d, operands=%q, err=%v", kind, operands, err)
+	}
+
+	// 遇到基础值时完全解析，更旧的值被忽略
+	versions = append(versions, encodeValue(kindValue, []byte("10")), encodeValue(kindValue, []byte("1000")))
+	raw, err = l.resolveVersions(key, versions, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind, value := decodeValue(raw); kind != kindValue || string(value) != "16" {
+		t.Fatalf("kind=%d, value=%q", kind, value)
+	}
+}
+
+// manualClock 手动推进的时钟
+type manualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestLsmPutWithTTL(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1700000000, 0)}
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.Clock = clock
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.PutWithTTL([]byte("session"), []byte("token"), 0); err == nil {
+		t.Fatal("expected error for non-positive TTL")
+	}
+
+	// 先落盘一个旧值，过期的新值必须继续遮蔽它
+	if err := lsm.Put([]byte("cache"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.PutWithTTL([]byte("cache"), []byte("new"), 2*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.PutWithTTL([]byte("session"), []byte("token"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Put([]byte("user"), []byte("alice")); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(key, want string) {
+		t.Helper()
+		value, found, err := lsm.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want == "" {
+			if found {
+				t.Fatalf("expired key %s found: %q", key, value)
+			}
+			return
+		}
+		if !found || string(value) != want {
+			t.Fatalf("key %s: value=%q, found=%v, want %q", key, value, found, want)
+		}
+	}
+
+	// 过期时间随WAL重放恢复
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	check("session", "token")
+	check("cache", "new")
+
+	clock.Advance(time.Minute)
+	check("session", "")
+	check("cache", "new")
+	check("user", "alice")
+
+	clock.Advance(time.Minute)
+	check("cache", "")
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	check("cache", "")
+	check("user", "alice")
+
+	// 合并到最底层后过期的键被物理删除
+	if err := lsm.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	check("cache", "")
+	check("user", "alice")
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+	for _, nodes := range lsm.defaultCF.nodes {
+		for _, node := range nodes {
+			iter := node.Iterator()
+			for iter.First(); iter.Valid(); iter.Next() {
+				if key := string(iter.Key()); key != "user" {
+					t.Errorf("unexpected key %s after compaction", key)
+				}
+			}
+		}
+	}
+}
+
+func TestLsmDeleteRange(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.DeleteRange(utils.GenerateKey(5), utils.GenerateKey(1)); err == nil {
+		t.Fatal("expected error when start is greater than end")
+	}
+
+	// 0-49在SST中，50-99在内存表中
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			if err := lsm.Flush(true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.DeleteRange(utils.GenerateKey(40), utils.GenerateKey(59)); err != nil {
+		t.Fatal(err)
+	}
+	// 范围删除之后写入的键不受影响
+	if err := lsm.Put(utils.GenerateKey(45), []byte("rewritten")); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			value, found, err := lsm.Get(utils.GenerateKey(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case i == 45:
+				if !found || string(value) != "rewritten" {
+					t.Fatalf("key %d: value=%q, found=%v", i, value, found)
+				}
+			case i >= 40 && i <= 59:
+				if found {
+					t.Fatalf("key %d in deleted range found: %q", i, value)
+				}
+			default:
+				if !found || string(value) != string(utils.GenerateValue(i)) {
+					t.Fatalf("key %d: value=%q, found=%v", i, value, found)
+				}
+			}
+		}
+	}
+	check()
+
+	// 重放WAL
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	check()
+
+	// 标记写入SST后继续遮蔽更旧的文件
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	lsm.mu.RLock()
+	var tombstones int
+	for _, node := range lsm.defaultCF.nodes[0] {
+		tombstones += len(node.reader.RangeTombstones())
+	}
+	lsm.mu.RUnlock()
+	if tombstones != 1 {
+		t.Fatalf("expected 1 range tombstone in level 0, got %d", tombstones)
+	}
+
+	// 合并到最底层后清除被覆盖的键和标记
+	if err := lsm.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+	for _, nodes := range lsm.defaultCF.nodes {
+		for _, node := range nodes {
+			if n := len(node.reader.RangeTombstones()); n != 0 {
+				t.Fatalf("expected range tombstones to be dropped, found %d in %s", n, node.path)
+			}
+			iter := node.Iterator()
+			for iter.First(); iter.Valid(); iter.Next() {
+				if kind, _ := decodeValue(iter.Value()); kind == kindDeletion {
+					t.Fatalf("unexpected tombstone for %s after full compaction", iter.Key())
+				}
+			}
+		}
+	}
+}
+
+func TestLsmDeleteRange_DropsCoveredFiles(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 50; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// 破坏已有文件的数据块，合并时读取该文件就会失败
+	lsm.mu.RLock()
+	path := lsm.defaultCF.nodes[1][0].path
+	lsm.mu.RUnlock()
+	fp, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt(bytes.Repeat([]byte{0xff}, 8), 0); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	if err := lsm.DeleteRange(utils.GenerateKey(0), utils.GenerateKey(99)); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 被完整覆盖的文件不读取，合并后不留下任何文件
+	stats := lsm.Stats()
+	if stats.TotalFiles() != 0 {
+		t.Fatalf("expected no files after deleting everything, got %d", stats.TotalFiles())
+	}
+	lsm.mu.RLock()
+	level0 := lsm.defaultCF.nodes[0]
+	lsm.mu.RUnlock()
+	if len(level0) != 0 {
+		t.Fatalf("expected empty level 0, got %d files", len(level0))
+	}
+	if _, found, err := lsm.Get(utils.GenerateKey(10)); err != nil || found {
+		t.Fatalf("found=%v, err=%v", found, err)
+	}
+}
+
+func TestLsmSingleDelete(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.Level0CompactionTrigger = 100
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { lsm.Close() }()
+
+	// 0-9写入后刷盘，10-19在内存表中
+	for i := 0; i < 20; i++ {
+		if i == 10 {
+			if err := lsm.Flush(true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 删除0-4和10-14，同一批次中的写入和单删除相互抵消，30从未写入
+	for _, i := range []int{0, 1, 2, 3, 4, 10, 11, 12, 13, 14, 30} {
+		if err := lsm.SingleDelete(utils.GenerateKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch := NewWriteBatch()
+	batch.Put(nil, utils.GenerateKey(20), utils.GenerateValue(20))
+	batch.SingleDelete(nil, utils.GenerateKey(20))
+	if err := lsm.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		for i := 0; i <= 30; i++ {
+			value, found, err := lsm.Get(utils.GenerateKey(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			deleted := i%10 < 5 || i >= 20
+			if deleted && found {
+				t.Fatalf("key %d should be deleted, got %q", i, value)
+			}
+			if !deleted && (!found || string(value) != string(utils.GenerateValue(i))) {
+				t.Fatalf("key %d: value=%q, found=%v", i, value, found)
+			}
+		}
+	}
+	check()
+	// 内存表中的写入直接被移除，不留下标记
+	for _, i := range []int{10, 20} {
+		if _, err := lsm.defaultCF.mutableMemtable.Get(utils.GenerateKey(i)); err == nil {
+			t.Fatalf("key %d should be removed from memtable", i)
+		}
+	}
+
+	// 重放WAL
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// 输出层不是最底层时，与写入相遇的单删除标记一起消失，其余的保留
+	lsm.mu.Lock()
+	level0 := lsm.defaultCF.nodes[0]
+	if len(level0) != 2 {
+		lsm.mu.Unlock()
+		t.Fatalf("expected 2 files in level 0, got %d", len(level0))
+	}
+	c := lsm.newCompaction(lsm.defaultCF, 0, 1, []*Node{level0[1], level0[0]})
+	lsm.mu.Unlock()
+	c.bottommost = false
+	outputs, err := lsm.doCompaction(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]valueKind)
+	for _, node := range outputs {
+		iter := node.Iterator()
+		for iter.First(); iter.Valid(); iter.Next() {
+			kind, _ := decodeValue(iter.Value())
+			kinds[string(iter.Key())] = kind
+		}
+		node.Close()
+		os.Remove(node.path)
+	}
+	for i := 0; i < 5; i++ {
+		if kind, ok := kinds[string(utils.GenerateKey(i))]; ok {
+			t.Fatalf("key %d should cancel out with its put, got kind %d", i, kind)
+		}
+	}
+	if kind := kinds[string(utils.GenerateKey(30))]; kind != kindSingleDeletion {
+		t.Fatalf("expected single deletion for key 30 to be kept, got kind %d", kind)
+	}
+	if len(kinds) != 11 {
+		t.Fatalf("expected 11 entries in compaction output, got %d", len(kinds))
+	}
+
+	// 合并到最底层后不留下任何标记
+	if err := lsm.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+	for _, nodes := range lsm.defaultCF.nodes {
+		for _, node := range nodes {
+			iter := node.Iterator()
+			for iter.First(); iter.Valid(); iter.Next() {
+				if kind, _ := decodeValue(iter.Value()); isDeletion(kind) {
+					t.Fatalf("unexpected tombstone for %s after full compaction", iter.Key())
+				}
+			}
+		}
+	}
+}
+
+func TestLsmDeleteIfExists(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	key := utils.GenerateKey(1)
+	deleteIfExists := func(want bool) {
+		t.Helper()
+		existed, err := lsm.DeleteIfExists(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if existed != want {
+			t.Fatalf("expected existed=%v, got %v", want, existed)
+		}
+	}
+	seq := lsm.LatestSequenceNumber()
+	deleteIfExists(false)
+	if lsm.LatestSequenceNumber() != seq {
+		t.Fatal("nothing should be written for a missing key")
+	}
+
+	if err := lsm.Put(key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	deleteIfExists(true)
+	if _, found, _ := lsm.Get(key); found {
+		t.Fatal("key should be deleted")
+	}
+	deleteIfExists(false)
+
+	// 键只在SST中
+	if err := lsm.Put(key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	deleteIfExists(true)
+	deleteIfExists(false)
+
+	cf, err := lsm.CreateColumnFamily("tokens", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.PutCF(cf, key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.DropColumnFamily(cf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lsm.DeleteIfExistsCF(cf, key); !errors.Is(err, ErrColumnFamilyDropped) {
+		t.Fatalf("expected ErrColumnFamilyDropped, got %v", err)
+	}
+}
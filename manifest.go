@@ -0,0 +1,131 @@
+package lsm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+// manifestFileName 清单文件名，位于DataDir中
+const manifestFileName = "MANIFEST"
+
+// manifest 记录当前的列族、有效的SST文件、已持久化的最大序列号和最早的未刷盘WAL。每次文件集合变化后整体重写，
+// 不在清单中的SST文件是崩溃时未完成的刷盘或合并留下的，打开时删除；编号小于LogNumber的WAL已刷盘，打开时不再重放
+type manifest struct {
+	LastSequence       uint64             `json:"last_sequence"`
+	LogNumber          uint32             `json:"log_number,omitempty"` // 最早的未刷盘WAL的编号
+	NextColumnFamilyID uint32             `json:"next_column_family_id,omitempty"`
+	ColumnFamilies     []columnFamilyMeta `json:"column_families,omitempty"` // 默认列族之外的列族
+	Tables             []tableMeta        `json:"tables"`
+}
+
+// columnFamilyMeta 列族的元数据
+type columnFamilyMeta struct {
+	ID      uint32                     `json:"id"`
+	Name    string                     `json:"name"`
+	Options config.ColumnFamilyOptions `json:"options"`
+}
+
+// tableMeta 单个SST文件的元数据
+type tableMeta struct {
+	ColumnFamily uint32    `json:"column_family,omitempty"`
+	Level        int       `json:"level"`
+	FileNum      uint32    `json:"file_num"`
+	CreatedAt    time.Time `json:"created_at"`
+	External     bool      `json:"external,omitempty"` // 导入的外部文件
+}
+
+func (l *LSM) getManifestPath() string {
+	return filepath.Join(l.conf.DataDir, manifestFileName)
+}
+
+// readManifest 读取清单，清单不存在时返回nil
+func (l *LSM) readManifest() (*manifest, error) {
+	data, err := os.ReadFile(l.getManifestPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("解析清单失败: %w", err)
+	}
+	return m, nil
+}
+
+// saveManifest 将当前的文件集合和序列号写入临时文件，同步后原子替换清单。调用方需持有写锁
+func (l *LSM) saveManifest() error {
+	return writeManifest(l.getManifestPath(), l.currentManifest())
+}
+
+// currentManifest 返回当前的列族、文件集合、序列号和最早的未刷盘WAL的编号。调用方需持有锁
+func (l *LSM) currentManifest() *manifest {
+	m := &manifest{LastSequence: l.seq, LogNumber: l.minLogNumber(), NextColumnFamilyID: l.nextColumnFamilyID}
+	for _, cf := range l.columnFamilies {
+		if cf.id != 0 {
+			m.ColumnFamilies = append(m.ColumnFamilies, columnFamilyMeta{ID: cf.id, Name: cf.name, Options: cf.options})
+		}
+		for level, nodes := range cf.nodes {
+			for _, node := range nodes {
+				m.Tables = append(m.Tables, tableMeta{ColumnFamily: cf.id, Level: level, FileNum: node.seq,
+					CreatedAt: node.createdAt, External: node.external})
+			}
+		}
+	}
+	return m
+}
+
+// minLogNumber 返回最早的未刷盘WAL的编号。不可变内存表按WAL编号的顺序移出队列，队首的WAL最早；
+// 没有未刷盘的WAL时(关闭时已全部刷盘)返回下一个WAL的编号。调用方需持有锁
+func (l *LSM) minLogNumber() uint32 {
+	for _, immutable := range l.immutableMemtables {
+		if immutable.wal != nil {
+			return immutable.wal.LogNum()
+		}
+	}
+	if l.currWal != nil {
+		return l.currWal.LogNum()
+	}
+	return l.walId + 1
+}
+
+// writeManifest 将清单写入临时文件，同步后原子替换path，并同步所在目录
+func writeManifest(path string, m *manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	fp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return utils.SyncDir(filepath.Dir(path))
+}
@@ -0,0 +1,129 @@
+package lsm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+func TestManifest_Reopen(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 刷盘后WAL被删除，序列号只保存在清单中
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	seq := lsm.Stats().LatestSequence
+	lsm.mu.RLock()
+	createdAt := lsm.defaultCF.nodes[0][0].createdAt
+	lsm.mu.RUnlock()
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 崩溃时未记录到清单中的文件在重新打开时删除
+	orphan := filepath.Join(conf.DataDir, conf.SSTDir, "0_100.sst")
+	if err := os.WriteFile(orphan, []byte("orphan"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 刷盘中途崩溃只会留下不完整的临时文件
+	partial := filepath.Join(conf.DataDir, conf.SSTDir, "0_101.sst"+tempFileSuffix)
+	if err := os.WriteFile(partial, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for _, path := range []string{orphan, partial} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("file %s not removed: %v", path, err)
+		}
+	}
+	if got := lsm.Stats().LatestSequence; got != seq {
+		t.Fatalf("expected sequence %d after reopen, got %d", seq, got)
+	}
+	lsm.mu.RLock()
+	got := lsm.defaultCF.nodes[0][0].createdAt
+	lsm.mu.RUnlock()
+	if !got.Equal(createdAt) {
+		t.Fatalf("expected creation time %v, got %v", createdAt, got)
+	}
+	if value, found, err := lsm.Get(utils.GenerateKey(0)); err != nil || !found || string(value) != "value" {
+		t.Fatalf("value=%q, found=%v, err=%v", value, found, err)
+	}
+}
+
+func TestManifest_SkipFlushedWal(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MergeOperator = counterOperator{}
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := lsm.Merge([]byte("counter"), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walPath := lsm.getWalPath(0)
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟清单记录刷盘之后、WAL删除之前崩溃：已刷盘的WAL不能再次重放
+	if err := os.WriteFile(walPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, found, err := lsm.Get([]byte("counter")); err != nil || !found || string(value) != "3" {
+		t.Fatalf("value=%q, found=%v, err=%v", value, found, err)
+	}
+	if _, err := os.Stat(walPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected flushed WAL to be removed on open, err=%v", err)
+	}
+	if err := lsm.Merge([]byte("counter"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 之后新建的WAL编号不小于清单中的编号，重新打开时正常重放
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	if value, found, err := lsm.Get([]byte("counter")); err != nil || !found || string(value) != "4" {
+		t.Fatalf("value=%q, found=%v, err=%v", value, found, err)
+	}
+}
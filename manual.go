@@ -0,0 +1,186 @@
+package lsm
+
+import (
+	"slices"
+	"time"
+
+	"github.com/aixiasang/sqldb/config"
+)
+
+// manualCompaction 手动合并一层中与键范围相交的文件，由后台调度执行。字段由LSM.mu保护
+type manualCompaction struct {
+	cf          *ColumnFamily
+	level       int
+	outputLevel int
+	start       []byte         // 键范围的下界，nil表示不限
+	end         []byte         // 键范围的上界，nil表示不限
+	skip        map[*Node]bool // 不参与合并的文件
+	running     bool           // 是否已提交
+	done        bool           // 是否已结束
+	err         error          // 合并失败的原因
+	outputs     []*Node        // 生成的文件
+}
+
+// Flush 将所有列族的可变内存表切换为不可变内存表并调度刷盘，wait为true时等待刷盘完成。
+// 可变内存表为空时只等待已有的不可变内存表
+func (l *LSM) Flush(wait bool) error {
+	if l.closed.Load() {
+		return ErrClosed
+	}
+
+	defer l.fireEvents()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed.Load() {
+		return ErrClosed
+	}
+	if l.bgErr != nil {
+		return l.bgErr
+	}
+	if l.mutableSize() > 0 {
+		if err := l.switchMemtable(flushReasonManual); err != nil {
+			return l.setBackgroundError(BackgroundOpWal, err, true)
+		}
+	}
+	if !wait || len(l.immutableMemtables) == 0 {
+		return nil
+	}
+
+	// 内存表按顺序移出队列，最后一个移出时之前的也都已刷盘
+	start := time.Now()
+	last := l.immutableMemtables[len(l.immutableMemtables)-1]
+	l.logger.Info("等待手动刷盘完成", "immutables", len(l.immutableMemtables))
+	for slices.Contains(l.immutableMemtables, last) && l.bgErr == nil && !l.closed.Load() {
+		l.flushCond.Wait()
+	}
+	if slices.Contains(l.immutableMemtables, last) {
+		if l.bgErr != nil {
+			return l.bgErr
+		}
+		return ErrClosed
+	}
+	l.logger.Info("手动刷盘完成", "duration", time.Since(start))
+	return nil
+}
+
+// CompactRange 将默认列族中键范围[start, end]内的数据合并到最底层并清除删除标记，start或end为nil表示不限
+func (l *LSM) CompactRange(start, end []byte) error {
+	return l.CompactRangeCF(l.defaultCF, start, end)
+}
+
+// CompactRangeCF 将列族中键范围[start, end]内的数据合并到最底层并清除删除标记，start或end为nil表示不限。
+// 先刷盘内存表，再从0层开始逐层向下合并到含有该范围数据的最深层级，最后原地重写最底层中
+// 尚未重写的文件。每一步都经过后台调度执行，进度通过日志和事件监听器报告。FIFO合并时只刷盘
+func (l *LSM) CompactRangeCF(cf *ColumnFamily, start, end []byte) error {
+	if err := l.Flush(true); err != nil {
+		return err
+	}
+	// FIFO合并只按时间和大小删除整个文件，不归并数据
+	if l.conf.CompactionStyle == config.CompactionStyleFIFO {
+		return nil
+	}
+	startTime := time.Now()
+
+	l.mu.RLock()
+	if cf.dropped {
+		l.mu.RUnlock()
+		return ErrColumnFamilyDropped
+	}
+	target := -1
+	for level, nodes := range cf.nodes {
+		for _, node := range nodes {
+			if node.overlaps(start, end) {
+				target = level
+				break
+			}
+		}
+	}
+	l.mu.RUnlock()
+	if target < 0 || len(cf.nodes) < 2 {
+		return nil
+	}
+	target = max(target, 1)
+	l.logger.Info("开始手动合并", "cf", cf.name, "start", string(start), "end", string(end), "bottommost_level", target)
+
+	var outputs []*Node
+	for level := 0; level < target; level++ {
+		m := &manualCompaction{cf: cf, level: level, outputLevel: level + 1, start: start, end: end}
+		if err := l.runManualCompaction(m); err != nil {
+			return err
+		}
+		outputs = m.outputs
+	}
+
+	// 上一步写入最底层的文件已经丢弃了删除标记，无需重写
+	m := &manualCompaction{cf: cf, level: target, outputLevel: target, start: start, end: end, skip: make(map[*Node]bool)}
+	for _, node := range outputs {
+		m.skip[node] = true
+	}
+	if err := l.runManualCompaction(m); err != nil {
+		return err
+	}
+	l.logger.Info("手动合并完成", "cf", cf.name, "start", string(start), "end", string(end), "duration", time.Since(startTime))
+	return nil
+}
+
+// runManualCompaction 将手动合并加入队列并等待结束
+func (l *LSM) runManualCompaction(m *manualCompaction) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed.Load() {
+		return ErrClosed
+	}
+	if l.bgErr != nil {
+		return l.bgErr
+	}
+	l.manualCompactions = append(l.manualCompactions, m)
+	l.maybeSchedule()
+	for !m.done && l.bgErr == nil && !l.closed.Load() {
+		l.flushCond.Wait()
+	}
+	if i := slices.Index(l.manualCompactions, m); i >= 0 {
+		l.manualCompactions = slices.Delete(l.manualCompactions, i, i+1)
+	}
+
+	switch {
+	case m.done:
+		return m.err
+	case l.bgErr != nil:
+		return l.bgErr
+	default:
+		return ErrClosed
+	}
+}
+
+// pickManualCompaction 选择手动合并的输入文件。没有需要合并的文件时返回(nil, true)，
+// 与进行中的合并冲突时返回(nil, false)。调用方需持有写锁
+func (l *LSM) pickManualCompaction(m *manualCompaction) (*compaction, bool) {
+	var inputs []*Node
+	for _, node := range m.cf.nodes[m.level] {
+		if node.overlaps(m.start, m.end) && !m.skip[node] {
+			inputs = append(inputs, node)
+		}
+	}
+	if len(inputs) == 0 {
+		return nil, true
+	}
+	if m.level == 0 {
+		// 0层文件之间互相重叠，只合并部分文件可能让旧值越过新值，因此合并全部文件
+		inputs = inputs[:0]
+		for i := len(m.cf.nodes[0]) - 1; i >= 0; i-- {
+			inputs = append(inputs, m.cf.nodes[0][i])
+		}
+	}
+	if anyCompacting(inputs) {
+		return nil, false
+	}
+	c := l.newCompaction(m.cf, m.level, m.outputLevel, inputs)
+	if c == nil {
+		return nil, false
+	}
+	c.reason = compactionReasonManual
+	c.manual = m
+	return c, true
+}
@@ -0,0 +1,150 @@
+package lsm
+
+import (
+	"testing"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+func TestFlush(t *testing.T) {
+	listener := &recordingListener{}
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.Listeners = []config.EventListener{listener}
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	// 内存表为空时无需刷盘
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := lsm.Stats()
+	if stats.MemtableBytes != 0 || stats.ImmutableMemtables != 0 || stats.Levels[0].Files != 1 {
+		t.Fatalf("unexpected state after flush: %+v", stats)
+	}
+	listener.mu.Lock()
+	if len(listener.flushEnds) != 1 || listener.flushEnds[0].Reason != flushReasonManual || listener.flushEnds[0].Entries != 10 {
+		t.Fatalf("unexpected flush events: %+v", listener.flushEnds)
+	}
+	listener.mu.Unlock()
+	for i := 0; i < 10; i++ {
+		value, found, err := lsm.Get(utils.GenerateKey(i))
+		if err != nil || !found || string(value) != string(utils.GenerateValue(i)) {
+			t.Fatalf("key %d: value=%q, found=%v, err=%v", i, value, found, err)
+		}
+	}
+}
+
+func TestCompactRange(t *testing.T) {
+	listener := &recordingListener{}
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+	conf.Level0CompactionTrigger = 1000 // 只执行手动合并
+	conf.Listeners = []config.EventListener{listener}
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataCount := 100
+	for i := 0; i < dataCount; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+	// 删除标记与旧值位于不同的文件中
+	for i := 0; i < dataCount; i += 2 {
+		if err := lsm.Delete(utils.GenerateKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 只合并前一半的键
+	if err := lsm.CompactRange(nil, utils.GenerateKey(dataCount/2-1)); err != nil {
+		t.Fatal(err)
+	}
+	stats := lsm.Stats()
+	if stats.ImmutableMemtables != 0 || stats.Levels[1].Files == 0 {
+		t.Fatalf("expected data in level 1: %+v", stats.Levels)
+	}
+	// 0层文件互相重叠，全部合并到1层
+	if stats.Levels[0].Files != 0 {
+		t.Fatalf("expected level 0 to be empty: %+v", stats.Levels)
+	}
+
+	if err := lsm.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkLevels(t, lsm)
+
+	// 已经是最底层，删除标记被清除，只剩下未删除的键
+	entries := 0
+	lsm.mu.RLock()
+	for _, nodes := range lsm.defaultCF.nodes {
+		for _, node := range nodes {
+			iter := node.Iterator()
+			for iter.First(); iter.Valid(); iter.Next() {
+				if kind, _ := decodeValue(iter.Value()); kind == kindDeletion {
+					t.Errorf("tombstone for %s survived bottommost compaction", iter.Key())
+				}
+				entries++
+			}
+		}
+	}
+	lsm.mu.RUnlock()
+	if entries != dataCount/2 {
+		t.Fatalf("expected %d entries, got %d", dataCount/2, entries)
+	}
+
+	listener.mu.Lock()
+	if len(listener.compactions) == 0 {
+		t.Fatal("expected compaction events")
+	}
+	for _, info := range listener.compactions {
+		if info.Reason != compactionReasonManual || info.Err != nil {
+			t.Fatalf("unexpected compaction: %+v", info)
+		}
+	}
+	listener.mu.Unlock()
+
+	verify := func() {
+		t.Helper()
+		for i := 0; i < dataCount; i++ {
+			value, found, err := lsm.Get(utils.GenerateKey(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted := i%2 == 0; deleted == found {
+				t.Fatalf("key %d: found=%v, value=%q", i, found, value)
+			}
+		}
+	}
+	verify()
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	verify()
+}
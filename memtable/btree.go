@@ -23,6 +23,7 @@ func (i *KVItem) Less(than btree.Item) bool {
 // BTreeMemTable B树内存表实现
 type BTreeMemTable struct {
 	tree  *btree.BTree
+	size  int          // 键值对占用的字节数
 	mutex sync.RWMutex // 读写锁，用于并发控制
 }
 
@@ -55,7 +56,11 @@ func (bt *BTreeMemTable) Put(key, value []byte) error {
 	bt.mutex.Lock()         // 写操作加锁
 	defer bt.mutex.Unlock() // 确保操作完成后解锁
 
-	bt.tree.ReplaceOrInsert(item)
+	if old := bt.tree.ReplaceOrInsert(item); old != nil {
+		oldItem := old.(*KVItem)
+		bt.size -= len(oldItem.key) + len(oldItem.value)
+	}
+	bt.size += len(item.key) + len(item.value)
 	return nil
 }
 
@@ -94,10 +99,19 @@ func (bt *BTreeMemTable) Delete(key []byte) error {
 	if item == nil {
 		return errors.New("key not found")
 	}
+	kvItem := item.(*KVItem)
+	bt.size -= len(kvItem.key) + len(kvItem.value)
 
 	return nil
 }
 
+// Size 返回键值对占用的字节数
+func (bt *BTreeMemTable) Size() int {
+	bt.mutex.RLock()
+	defer bt.mutex.RUnlock()
+	return bt.size
+}
+
 // ForEach 遍历B树中的所有键值对
 func (bt *BTreeMemTable) ForEach(visitor func(key, value []byte) bool) {
 	bt.mutex.RLock()         // 读操作加读锁
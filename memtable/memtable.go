@@ -7,6 +7,7 @@ type MemTable interface {
 	Delete(key []byte) error                      // 删除
 	ForEach(visitor func(key, value []byte) bool) // 遍历
 	Iterator() Iterator
+	Size() int // 键值对占用的字节数
 }
 type Iterator interface {
 	First()
@@ -0,0 +1,142 @@
+package lsm
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+
+	"github.com/aixiasang/sqldb/sstable"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+// mergingIterator 按键的顺序归并多个有序迭代器。同一个键出现在多个迭代器中时
+// 只返回排在前面的迭代器中的值，因此调用方需按从新到旧的顺序传入。
+// rangeDels[i]是第i个迭代器中的范围删除标记，只作用于排在它后面的迭代器：
+// 最新的值被覆盖的键不返回，较旧的值被覆盖时在Versions中以删除标记结束。
+// 调用方需要保留这些标记以遮蔽更旧的数据
+type mergingIterator struct {
+	iters     []sstable.Iterator
+	rangeDels [][]sstable.RangeTombstone
+	h         iterHeap
+}
+
+func newMergingIterator(iters []sstable.Iterator, rangeDels [][]sstable.RangeTombstone) *mergingIterator {
+	m := &mergingIterator{iters: iters, rangeDels: rangeDels}
+	for i, iter := range iters {
+		iter.First()
+		if iter.Valid() {
+			m.h = append(m.h, heapItem{iter: iter, priority: i})
+		}
+	}
+	heap.Init(&m.h)
+	m.skipCovered()
+	return m
+}
+
+// covered 排在priority之前的迭代器中是否有覆盖key的范围删除标记
+func (m *mergingIterator) covered(priority int, key []byte) bool {
+	for i := 0; i < priority && i < len(m.rangeDels); i++ {
+		if rangeDeleted(m.rangeDels[i], key) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipCovered 跳过最新的值被范围删除标记覆盖的键
+func (m *mergingIterator) skipCovered() {
+	for len(m.h) > 0 && m.covered(m.h[0].priority, m.h[0].iter.Key()) {
+		m.advance()
+	}
+}
+
+// Valid 是否还有键值对
+func (m *mergingIterator) Valid() bool {
+	return len(m.h) > 0
+}
+
+// Key 返回当前的键
+func (m *mergingIterator) Key() []byte {
+	return m.h[0].iter.Key()
+}
+
+// Value 返回当前的值
+func (m *mergingIterator) Value() []byte {
+	return m.h[0].iter.Value()
+}
+
+// Versions 返回当前键在所有迭代器中的值，按从新到旧排列
+func (m *mergingIterator) Versions() [][]byte {
+	key := m.Key()
+	items := make([]heapItem, 0, len(m.h))
+	for _, item := range m.h {
+		if utils.CompareBytes(item.iter.Key(), key) == 0 {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].priority < items[j].priority
+	})
+	versions := make([][]byte, 0, len(items))
+	for _, item := range items {
+		if m.covered(item.priority, key) {
+			versions = append(versions, encodeValue(kindDeletion, nil))
+			break
+		}
+		versions = append(versions, item.iter.Value())
+	}
+	return versions
+}
+
+// Next 移动到下一个键，跳过较旧迭代器中的相同键和被范围删除标记覆盖的键
+func (m *mergingIterator) Next() {
+	m.advance()
+	m.skipCovered()
+}
+
+// advance 移动到下一个键
+func (m *mergingIterator) advance() {
+	key := m.Key()
+	for len(m.h) > 0 && utils.CompareBytes(m.h[0].iter.Key(), key) == 0 {
+		if m.h[0].iter.Next() {
+			heap.Fix(&m.h, 0)
+		} else {
+			heap.Pop(&m.h)
+		}
+	}
+}
+
+// Err 返回所有迭代器中出现的错误
+func (m *mergingIterator) Err() error {
+	var errs []error
+	for _, iter := range m.iters {
+		if err := iter.Err(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type heapItem struct {
+	iter     sstable.Iterator
+	priority int // 越小越新
+}
+
+// iterHeap 以当前键为序的最小堆，键相同时较新的迭代器在前
+type iterHeap []heapItem
+
+func (h iterHeap) Len() int { return len(h) }
+func (h iterHeap) Less(i, j int) bool {
+	if c := utils.CompareBytes(h[i].iter.Key(), h[j].iter.Key()); c != 0 {
+		return c < 0
+	}
+	return h[i].priority < h[j].priority
+}
+func (h iterHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *iterHeap) Push(x any)   { *h = append(*h, x.(heapItem)) }
+func (h *iterHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,235 @@
+// Package metrics 以Prometheus文本格式导出引擎的统计信息，不依赖第三方库
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	lsm "github.com/aixiasang/sqldb"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+// ContentType Prometheus文本格式的Content-Type
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+const namespace = "sqldb"
+
+// Source 提供统计信息的数据库，*lsm.LSM满足该接口
+type Source interface {
+	Stats() *lsm.Stats
+}
+
+// Exporter 汇总已注册数据库的统计信息，每个数据库以db标签区分
+type Exporter struct {
+	mu      sync.RWMutex
+	sources map[string]Source
+}
+
+// NewExporter 创建导出器
+func NewExporter() *Exporter {
+	return &Exporter{sources: make(map[string]Source)}
+}
+
+// Handler 创建只导出一个数据库的http.Handler
+func Handler(name string, db Source) http.Handler {
+	e := NewExporter()
+	e.Register(name, db)
+	return e
+}
+
+// Register 以名称name注册数据库，同名的数据库会被替换
+func (e *Exporter) Register(name string, db Source) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sources[name] = db
+}
+
+// Unregister 取消注册名为name的数据库
+func (e *Exporter) Unregister(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.sources, name)
+}
+
+// ServeHTTP 以Prometheus文本格式输出所有已注册数据库的指标
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	// 写入失败通常是客户端已断开，响应头已经发出，无法再返回错误
+	_, _ = e.WriteTo(w)
+}
+
+// snapshot 一个数据库的统计快照
+type snapshot struct {
+	name  string
+	stats *lsm.Stats
+}
+
+// WriteTo 将所有已注册数据库的指标写入w
+func (e *Exporter) WriteTo(w io.Writer) (int64, error) {
+	e.mu.RLock()
+	snapshots := make([]snapshot, 0, len(e.sources))
+	for name, db := range e.sources {
+		snapshots = append(snapshots, snapshot{name: name, stats: db.Stats()})
+	}
+	e.mu.RUnlock()
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].name < snapshots[j].name
+	})
+
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+	for _, m := range scalarMetrics {
+		cw.header(m.name, m.help, m.kind)
+		for _, s := range snapshots {
+			cw.sample(m.name, labels("db", s.name), m.value(s.stats))
+		}
+	}
+	for _, m := range levelMetrics {
+		cw.header(m.name, m.help, "gauge")
+		for _, s := range snapshots {
+			for _, level := range s.stats.Levels {
+				cw.sample(m.name, labels("db", s.name, "level", strconv.Itoa(level.Level)), m.value(level))
+			}
+		}
+	}
+	for _, m := range histogramMetrics {
+		cw.header(m.name, m.help, "histogram")
+		for _, s := range snapshots {
+			cw.histogram(m.name, s.name, m.value(s.stats))
+		}
+	}
+	if cw.err == nil {
+		cw.err = bw.Flush()
+	}
+	return cw.n, cw.err
+}
+
+type scalarMetric struct {
+	name  string
+	help  string
+	kind  string
+	value func(s *lsm.Stats) float64
+}
+
+type levelMetric struct {
+	name  string
+	help  string
+	value func(s lsm.LevelStats) float64
+}
+
+type histogramMetric struct {
+	name  string
+	help  string
+	value func(s *lsm.Stats) utils.HistogramSnapshot
+}
+
+func counter(name, help string, value func(s *lsm.Stats) float64) scalarMetric {
+	return scalarMetric{name: namespace + "_" + name, help: help, kind: "counter", value: value}
+}
+
+func gauge(name, help string, value func(s *lsm.Stats) float64) scalarMetric {
+	return scalarMetric{name: namespace + "_" + name, help: help, kind: "gauge", value: value}
+}
+
+var scalarMetrics = []scalarMetric{
+	counter("keys_written_total", "Number of keys written.", func(s *lsm.Stats) float64 { return float64(s.KeysWritten) }),
+	counter("bytes_written_total", "Bytes of user keys and values written.", func(s *lsm.Stats) float64 { return float64(s.BytesWritten) }),
+	counter("keys_read_total", "Number of point lookups.", func(s *lsm.Stats) float64 { return float64(s.KeysRead) }),
+	counter("keys_found_total", "Number of point lookups that found a value.", func(s *lsm.Stats) float64 { return float64(s.KeysFound) }),
+	counter("bytes_read_total", "Bytes of values returned by point lookups.", func(s *lsm.Stats) float64 { return float64(s.BytesRead) }),
+	counter("wal_bytes_total", "Bytes appended to the write-ahead log.", func(s *lsm.Stats) float64 { return float64(s.WalBytes) }),
+	counter("wal_syncs_total", "Number of write-ahead log syncs.", func(s *lsm.Stats) float64 { return float64(s.WalSyncs) }),
+	counter("flushes_total", "Number of memtable flushes.", func(s *lsm.Stats) float64 { return float64(s.Flushes) }),
+	counter("flush_bytes_total", "Bytes written to SST files by flushes.", func(s *lsm.Stats) float64 { return float64(s.FlushBytes) }),
+	counter("compactions_total", "Number of compactions.", func(s *lsm.Stats) float64 { return float64(s.Compactions) }),
+	counter("compaction_read_bytes_total", "Bytes read by compactions.", func(s *lsm.Stats) float64 { return float64(s.CompactionReadBytes) }),
+	counter("compaction_write_bytes_total", "Bytes written by compactions.", func(s *lsm.Stats) float64 { return float64(s.CompactionWriteBytes) }),
+	counter("bloom_useful_total", "Lookups excluded by bloom filters.", func(s *lsm.Stats) float64 { return float64(s.BloomUseful) }),
+	counter("bloom_false_positive_total", "Lookups that passed a bloom filter but found no key.", func(s *lsm.Stats) float64 { return float64(s.BloomFalsePositive) }),
+	counter("block_cache_hits_total", "Block cache hits.", func(s *lsm.Stats) float64 { return float64(s.BlockCacheHits) }),
+	counter("block_cache_misses_total", "Block cache misses.", func(s *lsm.Stats) float64 { return float64(s.BlockCacheMisses) }),
+	counter("block_read_bytes_total", "Bytes of data blocks read from SST files.", func(s *lsm.Stats) float64 { return float64(s.BlockReadBytes) }),
+	counter("stalls_total", "Number of write stalls.", func(s *lsm.Stats) float64 { return float64(s.Stalls) }),
+	counter("stall_seconds_total", "Time writes spent stalled.", func(s *lsm.Stats) float64 { return s.StallTime.Seconds() }),
+	gauge("block_cache_bytes", "Bytes held by the block cache.", func(s *lsm.Stats) float64 { return float64(s.BlockCacheBytes) }),
+	gauge("memtable_bytes", "Size of the active memtable.", func(s *lsm.Stats) float64 { return float64(s.MemtableBytes) }),
+	gauge("immutable_memtables", "Number of immutable memtables waiting to be flushed.", func(s *lsm.Stats) float64 { return float64(s.ImmutableMemtables) }),
+	gauge("immutable_memtable_bytes", "Size of immutable memtables waiting to be flushed.", func(s *lsm.Stats) float64 { return float64(s.ImmutableMemtableBytes) }),
+	gauge("pending_compaction_bytes", "Estimated bytes compaction has to rewrite to bring levels back within limits.", func(s *lsm.Stats) float64 { return float64(s.PendingCompactionBytes) }),
+	gauge("write_amplification", "Bytes written to SST files per byte written by users.", func(s *lsm.Stats) float64 { return s.WriteAmplification }),
+	gauge("latest_sequence_number", "Sequence number of the last write.", func(s *lsm.Stats) float64 { return float64(s.LatestSequence) }),
+}
+
+var levelMetrics = []levelMetric{
+	{name: namespace + "_level_files", help: "Number of SST files per level.", value: func(s lsm.LevelStats) float64 { return float64(s.Files) }},
+	{name: namespace + "_level_bytes", help: "Total size of SST files per level.", value: func(s lsm.LevelStats) float64 { return float64(s.Bytes) }},
+}
+
+var histogramMetrics = []histogramMetric{
+	{name: namespace + "_put_duration_seconds", help: "Latency of Put.", value: func(s *lsm.Stats) utils.HistogramSnapshot { return s.PutTime }},
+	{name: namespace + "_get_duration_seconds", help: "Latency of Get.", value: func(s *lsm.Stats) utils.HistogramSnapshot { return s.GetTime }},
+	{name: namespace + "_flush_duration_seconds", help: "Duration of memtable flushes.", value: func(s *lsm.Stats) utils.HistogramSnapshot { return s.FlushTime }},
+	{name: namespace + "_compaction_duration_seconds", help: "Duration of compactions.", value: func(s *lsm.Stats) utils.HistogramSnapshot { return s.CompactionTime }},
+	{name: namespace + "_wal_sync_duration_seconds", help: "Latency of write-ahead log syncs.", value: func(s *lsm.Stats) utils.HistogramSnapshot { return s.WalSyncTime }},
+}
+
+// countingWriter 记录写入的字节数和第一个错误
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) printf(format string, args ...any) {
+	if cw.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(cw.w, format, args...)
+	cw.n += int64(n)
+	cw.err = err
+}
+
+func (cw *countingWriter) header(name, help, kind string) {
+	cw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (cw *countingWriter) sample(name, labels string, value float64) {
+	cw.printf("%s{%s} %s\n", name, labels, formatFloat(value))
+}
+
+func (cw *countingWriter) histogram(name, db string, h utils.HistogramSnapshot) {
+	for _, bucket := range h.Buckets {
+		le := formatFloat(bucket.UpperBound.Seconds())
+		cw.sample(name+"_bucket", labels("db", db, "le", le), float64(bucket.Count))
+	}
+	cw.sample(name+"_bucket", labels("db", db, "le", "+Inf"), float64(h.Count))
+	cw.sample(name+"_sum", labels("db", db), h.Sum.Seconds())
+	cw.sample(name+"_count", labels("db", db), float64(h.Count))
+}
+
+// labels 将交替出现的标签名和值格式化为name="value"列表
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	lsm "github.com/aixiasang/sqldb"
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+type staticSource struct {
+	stats *lsm.Stats
+}
+
+func (s *staticSource) Stats() *lsm.Stats {
+	return s.stats
+}
+
+func TestExporter_Format(t *testing.T) {
+	stats := utils.NewStatistics()
+	stats.Record(utils.HistogramFlushTime, 2*time.Millisecond)
+	stats.Record(utils.HistogramFlushTime, 20*time.Millisecond)
+	source := &staticSource{stats: &lsm.Stats{
+		Levels:               []lsm.LevelStats{{Level: 0, Files: 3, Bytes: 4096}, {Level: 1}},
+		KeysWritten:          10,
+		CompactionWriteBytes: 512,
+		FlushTime:            stats.Histogram(utils.HistogramFlushTime),
+	}}
+
+	e := NewExporter()
+	e.Register(`a"b`, source)
+	var b strings.Builder
+	if _, err := e.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"# TYPE sqldb_keys_written_total counter\n",
+		`sqldb_keys_written_total{db="a\"b"} 10` + "\n",
+		`sqldb_compaction_write_bytes_total{db="a\"b"} 512` + "\n",
+		`sqldb_level_files{db="a\"b",level="0"} 3` + "\n",
+		`sqldb_level_bytes{db="a\"b",level="0"} 4096` + "\n",
+		"# TYPE sqldb_flush_duration_seconds histogram\n",
+		`sqldb_flush_duration_seconds_bucket{db="a\"b",le="0.005"} 1` + "\n",
+		`sqldb_flush_duration_seconds_bucket{db="a\"b",le="0.05"} 2` + "\n",
+		`sqldb_flush_duration_seconds_bucket{db="a\"b",le="+Inf"} 2` + "\n",
+		`sqldb_flush_duration_seconds_sum{db="a\"b"} 0.022` + "\n",
+		`sqldb_flush_duration_seconds_count{db="a\"b"} 2` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in output:\n%s", want, out)
+		}
+	}
+
+	e.Unregister(`a"b`)
+	b.Reset()
+	if _, err := e.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), `db="a\"b"`) {
+		t.Fatal("expected unregistered db to be removed")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	db, err := lsm.NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		if err := db.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(Handler("main", db))
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != ContentType {
+		t.Fatalf("unexpected content type: %s", resp.Header.Get("Content-Type"))
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`sqldb_keys_written_total{db="main"} 10`,
+		`sqldb_put_duration_seconds_count{db="main"} 10`,
+		`sqldb_level_files{db="main",level="0"}`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("missing %q in output:\n%s", want, body)
+		}
+	}
+}
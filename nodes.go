@@ -2,16 +2,24 @@ package lsm
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/aixiasang/sqldb/config"
 	"github.com/aixiasang/sqldb/sstable"
+	"github.com/aixiasang/sqldb/utils"
 )
 
 type Node struct {
+	cf     *ColumnFamily // 文件所属的列族
 	conf   *config.Config
 	reader *sstable.SSTReader
 	level  int
 	seq    uint32
+	path   string
+
+	createdAt  time.Time // 文件的创建时间，记录在清单中
+	external   bool      // 导入的外部文件或上一个发布版本写入的文件，值是没有类型前缀的普通值，记录在清单中
+	compacting bool      // 是否正在被合并，由LSM.mu保护
 }
 
 func NewNode(conf *config.Config, level int, seq uint32) (*Node, error) {
@@ -26,10 +34,66 @@ func NewNode(conf *config.Config, level int, seq uint32) (*Node, error) {
 		return nil, err
 	}
 	node.reader = reader
+	node.path = filePath
 	return node, nil
 }
 func (n *Node) Get(key []byte) ([]byte, bool, error) {
-	return n.reader.Get(key)
+	value, found, err := n.reader.Get(key)
+	if n.external && found {
+		value = encodeValue(kindValue, value)
+	}
+	return value, found, err
+}
+
+// Size 返回SST文件的大小
+func (n *Node) Size() int64 {
+	return n.reader.Size()
+}
+
+// SmallestKey 返回文件中的最小键
+func (n *Node) SmallestKey() []byte {
+	return n.reader.SmallestKey()
+}
+
+// LargestKey 返回文件中的最大键
+func (n *Node) LargestKey() []byte {
+	return n.reader.LargestKey()
+}
+
+// Properties 返回SST文件的属性
+func (n *Node) Properties() *sstable.Properties {
+	return n.reader.Properties()
+}
+
+// covers 键是否被文件中的范围删除标记覆盖
+func (n *Node) covers(key []byte) bool {
+	return rangeDeleted(n.reader.RangeTombstones(), key)
+}
+
+// overlaps 文件的键范围是否与[start, end]相交，start或end为nil表示不限
+func (n *Node) overlaps(start, end []byte) bool {
+	if start != nil && utils.CompareBytes(n.LargestKey(), start) < 0 {
+		return false
+	}
+	return end == nil || utils.CompareBytes(n.SmallestKey(), end) <= 0
+}
+
+// TableInfo 返回用于事件通知的文件信息
+func (n *Node) TableInfo(reason string) config.TableFileInfo {
+	info := config.TableFileInfo{
+		Level:       n.level,
+		FileNum:     n.seq,
+		Path:        n.path,
+		SmallestKey: n.SmallestKey(),
+		LargestKey:  n.LargestKey(),
+		Bytes:       n.Size(),
+		CreatedAt:   n.createdAt,
+		Reason:      reason,
+	}
+	if n.cf != nil {
+		info.ColumnFamily = n.cf.name
+	}
+	return info
 }
 func (n *Node) Close() error {
 	return n.reader.Close()
@@ -37,5 +101,17 @@ func (n *Node) Close() error {
 
 // Iterator 返回此SSTable节点的迭代器
 func (n *Node) Iterator() sstable.Iterator {
+	if n.external {
+		return externalIterator{n.reader.Iterator()}
+	}
 	return n.reader.Iterator()
 }
+
+// externalIterator 为外部文件中的值加上类型前缀
+type externalIterator struct {
+	sstable.Iterator
+}
+
+func (it externalIterator) Value() []byte {
+	return encodeValue(kindValue, it.Iterator.Value())
+}
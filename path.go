@@ -2,8 +2,13 @@ package lsm
 
 import (
 	"fmt"
+
+	"github.com/aixiasang/sqldb/sstable"
 )
 
+// tempFileSuffix SST目录中尚未生效的临时文件的后缀，包括写入中的SST文件和导入中的外部文件，打开时删除
+const tempFileSuffix = sstable.TempFileSuffix
+
 func (l *LSM) getWalPath(fileId uint32) string {
 	return fmt.Sprintf("%s/%s/%d.wal", l.conf.DataDir, l.conf.WalDir, fileId)
 }
@@ -14,3 +19,16 @@ func (l *LSM) getWalDir() string {
 func (l *LSM) getSSTDir() string {
 	return fmt.Sprintf("%s/%s", l.conf.DataDir, l.conf.SSTDir)
 }
+
+// getRecycledWalPath 回收待复用的WAL文件路径，文件名中的编号为其最后使用的日志编号
+func (l *LSM) getRecycledWalPath(fileId uint32) string {
+	return fmt.Sprintf("%s/%s/%d.recycle", l.conf.DataDir, l.conf.WalDir, fileId)
+}
+
+func (l *LSM) getArchiveDir() string {
+	return fmt.Sprintf("%s/%s", l.conf.DataDir, l.conf.WalArchiveDir)
+}
+
+func (l *LSM) getArchivedWalPath(fileId uint32) string {
+	return fmt.Sprintf("%s/%s/%d.wal", l.conf.DataDir, l.conf.WalArchiveDir, fileId)
+}
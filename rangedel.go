@@ -0,0 +1,132 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/memtable"
+	"github.com/aixiasang/sqldb/sstable"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+// memTable 内存表以及写入其中的范围删除标记。范围删除标记只作用于更旧的内存表和SST：
+// 写入标记时先从内存表中移除范围内已有的键，之后写入的键比标记新，不受影响。
+// 标记由LSM.mu保护，转为不可变内存表后不再变化
+type memTable struct {
+	memtable.MemTable
+	rangeDels []sstable.RangeTombstone // 按写入顺序排列
+}
+
+func newMemTable(conf *config.Config) *memTable {
+	return &memTable{MemTable: conf.NewMemTable()}
+}
+
+// Size 返回键值对和范围删除标记占用的字节数
+func (m *memTable) Size() int {
+	size := m.MemTable.Size()
+	for _, t := range m.rangeDels {
+		size += len(t.Start) + len(t.End)
+	}
+	return size
+}
+
+// deleteRange 移除内存表中[start, end]内的键并记录范围删除标记
+func (m *memTable) deleteRange(start, end []byte) error {
+	tombstone := sstable.RangeTombstone{Start: utils.CopyKey(start), End: utils.CopyKey(end)}
+	var keys [][]byte
+	iter := m.Iterator()
+	for iter.Next() {
+		if tombstone.Contains(iter.Key()) {
+			keys = append(keys, utils.CopyKey(iter.Key()))
+		}
+	}
+	for _, key := range keys {
+		if err := m.Delete(key); err != nil {
+			return err
+		}
+	}
+	m.rangeDels = append(m.rangeDels, tombstone)
+	return nil
+}
+
+// covers 键是否被内存表中的范围删除标记覆盖
+func (m *memTable) covers(key []byte) bool {
+	return rangeDeleted(m.rangeDels, key)
+}
+
+// get 返回内存表中键的值，不在内存表中但被范围删除标记覆盖的键返回删除标记
+func (m *memTable) get(key []byte) ([]byte, error) {
+	raw, err := m.Get(key)
+	if err == nil {
+		return raw, nil
+	}
+	if m.covers(key) {
+		return encodeValue(kindDeletion, nil), nil
+	}
+	return nil, err
+}
+
+// rangeDeleted 键是否被一组范围删除标记中的任意一个覆盖
+func rangeDeleted(tombstones []sstable.RangeTombstone, key []byte) bool {
+	for _, t := range tombstones {
+		if t.Contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeRangeTombstones 按起点排序并合并重叠的范围删除标记，返回互不重叠的标记
+func mergeRangeTombstones(tombstones []sstable.RangeTombstone) []sstable.RangeTombstone {
+	sorted := append([]sstable.RangeTombstone(nil), tombstones...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return utils.CompareBytes(sorted[i].Start, sorted[j].Start) < 0
+	})
+	var merged []sstable.RangeTombstone
+	for _, t := range sorted {
+		if n := len(merged); n > 0 && utils.CompareBytes(t.Start, merged[n-1].End) <= 0 {
+			if utils.CompareBytes(t.End, merged[n-1].End) > 0 {
+				merged[n-1].End = t.End
+			}
+			continue
+		}
+		merged = append(merged, t)
+	}
+	return merged
+}
+
+// validateRange 检查范围删除的起点和终点
+func validateRange(start, end []byte) error {
+	if len(start) == 0 || len(end) == 0 {
+		return errors.New("范围删除的起点和终点不能为空")
+	}
+	if utils.CompareBytes(start, end) > 0 {
+		return fmt.Errorf("范围删除的起点 %q 大于终点 %q", start, end)
+	}
+	return nil
+}
+
+// DeleteRange 删除默认列族中[start, end]内的所有键(包含两端)，只写入一个范围删除标记
+func (l *LSM) DeleteRange(start, end []byte) error {
+	return l.DeleteRangeCF(nil, start, end)
+}
+
+// DeleteRangeCF 删除列族中[start, end]内的所有键(包含两端)。标记随内存表刷盘写入SST的范围删除块，
+// 读取时遮蔽更旧的数据，合并时清除被覆盖的键和整个被覆盖的文件
+func (l *LSM) DeleteRangeCF(cf *ColumnFamily, start, end []byte) error {
+	batch := NewWriteBatch()
+	batch.DeleteRange(cf, start, end)
+	return l.Write(batch)
+}
+
+// rangeCovers 一组范围删除标记中是否有一个完整覆盖[start, end]
+func rangeCovers(tombstones []sstable.RangeTombstone, start, end []byte) bool {
+	for _, t := range tombstones {
+		if t.Contains(start) && t.Contains(end) {
+			return true
+		}
+	}
+	return false
+}
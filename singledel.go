@@ -0,0 +1,59 @@
+package lsm
+
+import (
+	"errors"
+
+	"github.com/aixiasang/sqldb/wal"
+)
+
+// errSingleDeleted 键已被批次中的单删除从内存表中移除
+var errSingleDeleted = errors.New("lsm: key removed by single delete")
+
+// singleDeleteEntry 计算单删除写入内存表后键的编码值。内存表中是该键唯一的写入时两者相互抵消，返回nil；
+// 内存表中没有该键时写入单删除标记，由合并与更低层级中的写入抵消；其余情况退化为普通的删除标记
+func singleDeleteEntry(get func(key []byte) ([]byte, error), key []byte) []byte {
+	raw, err := get(key)
+	if err != nil {
+		return encodeValue(kindSingleDeletion, nil)
+	}
+	switch kind, _ := decodeValue(raw); kind {
+	case kindValue, kindExpiringValue:
+		return nil
+	case kindSingleDeletion:
+		return raw
+	}
+	return encodeValue(kindDeletion, nil)
+}
+
+// SingleDelete 删除只写入过一次的键(例如幂等令牌)。单删除标记在合并时与该次写入相互抵消，
+// 不必像普通删除标记一样下沉到最底层。键被写入多次或与Merge混用时结果未定义
+func (l *LSM) SingleDelete(key []byte) error {
+	return l.SingleDeleteCF(nil, key)
+}
+
+// SingleDeleteCF 删除列族中只写入过一次的键
+func (l *LSM) SingleDeleteCF(cf *ColumnFamily, key []byte) error {
+	batch := NewWriteBatch()
+	batch.SingleDelete(cf, key)
+	return l.Write(batch)
+}
+
+// DeleteIfExists 键存在时删除并返回true，不存在(包括已删除或已过期)时不写入并返回false
+func (l *LSM) DeleteIfExists(key []byte) (bool, error) {
+	return l.DeleteIfExistsCF(nil, key)
+}
+
+// DeleteIfExistsCF 列族中的键存在时删除并返回true。检查与删除在同一次加锁中完成，
+// 其间不会有其他写入
+func (l *LSM) DeleteIfExistsCF(cf *ColumnFamily, key []byte) (bool, error) {
+	if cf == nil {
+		cf = l.defaultCF
+	}
+	return l.writeIf([]batchOp{{cf: cf, rec: wal.NewRecord(key, nil)}}, func() (bool, error) {
+		if cf.dropped {
+			return false, ErrColumnFamilyDropped
+		}
+		_, found, err := l.getLocked(cf, key)
+		return found, err
+	})
+}
@@ -90,7 +90,7 @@ type BloomBlock struct {
 func NewBloomBlock(conf *config.Config) *BloomBlock {
 	return &BloomBlock{
 		conf:     conf,
-		filter:   config.NewFilterConstructor(),
+		filter:   conf.NewFilter(),
 		bloomBuf: bytes.NewBuffer(nil),
 		mu:       &sync.RWMutex{},
 	}
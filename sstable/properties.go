@@ -0,0 +1,171 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+const (
+	WriterVersion   = 1                                     // 写入器版本，记录在属性块中，随文件格式的变化递增
+	ComparatorName  = "sqldb.LengthFirstBytewiseComparator" // 键的比较方式：先比较长度，再逐字节比较
+	CompressionNone = "none"                                // 数据块不压缩
+)
+
+// 属性块中各属性的名称
+const (
+	propNumEntries        = "sqldb.num.entries"
+	propNumDeletions      = "sqldb.num.deletions"
+	propNumRangeDeletions = "sqldb.num.range-deletions"
+	propNumDataBlocks     = "sqldb.num.data-blocks"
+	propRawKeySize        = "sqldb.raw.key.size"
+	propRawValueSize      = "sqldb.raw.value.size"
+	propDataSize          = "sqldb.data.size"
+	propIndexSize         = "sqldb.index.size"
+	propFilterSize        = "sqldb.filter.size"
+	propSmallestKey       = "sqldb.smallest.key"
+	propLargestKey        = "sqldb.largest.key"
+	propCreationTime      = "sqldb.creation.time"
+	propCompression       = "sqldb.compression"
+	propFilterPolicy      = "sqldb.filter.policy"
+	propComparator        = "sqldb.comparator"
+	propWriterVersion     = "sqldb.writer.version"
+)
+
+// Properties SST文件的属性，由SSTWriter写入属性块。没有属性块的旧文件只有能从索引和尾部得到的属性，WriterVersion为0
+type Properties struct {
+	NumEntries        uint64    // 键值对数量
+	NumDeletions      uint64    // 通过AddDeletion添加的删除标记数量
+	NumRangeDeletions uint64    // 范围删除标记数量
+	NumDataBlocks     uint64    // 数据块数量
+	RawKeySize        uint64    // 键的总字节数
+	RawValueSize      uint64    // 值的总字节数
+	DataSize          uint64    // 数据块的总字节数
+	IndexSize         uint64    // 索引块的字节数
+	FilterSize        uint64    // 过滤器块的字节数
+	SmallestKey       []byte    // 最小的键，不包括范围删除标记
+	LargestKey        []byte    // 最大的键，不包括范围删除标记
+	CreatedAt         time.Time // 文件的创建时间
+	Compression       string    // 数据块的压缩算法
+	FilterPolicy      string    // 过滤器及其参数
+	Comparator        string    // 键的比较方式
+	WriterVersion     uint32    // 写入器版本
+}
+
+// String 以单行文本输出属性，用于调试
+func (p *Properties) String() string {
+	return fmt.Sprintf("entries=%d deletions=%d range-deletions=%d blocks=%d raw-key=%d raw-value=%d "+
+		"data=%d index=%d filter=%d smallest=%q largest=%q created=%s compression=%s filter-policy=%s comparator=%s version=%d",
+		p.NumEntries, p.NumDeletions, p.NumRangeDeletions, p.NumDataBlocks, p.RawKeySize, p.RawValueSize,
+		p.DataSize, p.IndexSize, p.FilterSize, p.SmallestKey, p.LargestKey, p.CreatedAt.Format(time.RFC3339),
+		p.Compression, p.FilterPolicy, p.Comparator, p.WriterVersion)
+}
+
+// filterPolicy 返回配置的过滤器及其参数
+func filterPolicy(conf *config.Config) string {
+	return fmt.Sprintf("bloomfilter:%d:%d", conf.BloomFilterSize, conf.BloomFilterHashCount)
+}
+
+// encodeProperties 编码属性块，每个属性的格式与数据块中的键值对相同：名称长度、值长度、名称、值，数值使用变长编码
+func encodeProperties(p *Properties) []byte {
+	buf := bytes.NewBuffer(nil)
+	add := func(name string, value []byte) {
+		binary.Write(buf, binary.BigEndian, uint32(len(name)))
+		binary.Write(buf, binary.BigEndian, uint32(len(value)))
+		buf.WriteString(name)
+		buf.Write(value)
+	}
+	addUint := func(name string, value uint64) {
+		add(name, binary.AppendUvarint(nil, value))
+	}
+	addUint(propNumEntries, p.NumEntries)
+	addUint(propNumDeletions, p.NumDeletions)
+	addUint(propNumRangeDeletions, p.NumRangeDeletions)
+	addUint(propNumDataBlocks, p.NumDataBlocks)
+	addUint(propRawKeySize, p.RawKeySize)
+	addUint(propRawValueSize, p.RawValueSize)
+	addUint(propDataSize, p.DataSize)
+	addUint(propIndexSize, p.IndexSize)
+	addUint(propFilterSize, p.FilterSize)
+	add(propSmallestKey, p.SmallestKey)
+	add(propLargestKey, p.LargestKey)
+	addUint(propCreationTime, uint64(p.CreatedAt.UnixNano()))
+	add(propCompression, []byte(p.Compression))
+	add(propFilterPolicy, []byte(p.FilterPolicy))
+	add(propComparator, []byte(p.Comparator))
+	addUint(propWriterVersion, uint64(p.WriterVersion))
+	return buf.Bytes()
+}
+
+// decodeProperties 解析属性块，忽略不认识的属性
+func decodeProperties(block []byte) (*Properties, error) {
+	p := &Properties{}
+	for offset := uint64(0); offset < uint64(len(block)); {
+		name, value, next, err := decodeEntry(block, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = next
+
+		var number *uint64
+		switch string(name) {
+		case propNumEntries:
+			number = &p.NumEntries
+		case propNumDeletions:
+			number = &p.NumDeletions
+		case propNumRangeDeletions:
+			number = &p.NumRangeDeletions
+		case propNumDataBlocks:
+			number = &p.NumDataBlocks
+		case propRawKeySize:
+			number = &p.RawKeySize
+		case propRawValueSize:
+			number = &p.RawValueSize
+		case propDataSize:
+			number = &p.DataSize
+		case propIndexSize:
+			number = &p.IndexSize
+		case propFilterSize:
+			number = &p.FilterSize
+		case propSmallestKey:
+			p.SmallestKey = utils.CopyKey(value)
+		case propLargestKey:
+			p.LargestKey = utils.CopyKey(value)
+		case propCompression:
+			p.Compression = string(value)
+		case propFilterPolicy:
+			p.FilterPolicy = string(value)
+		case propComparator:
+			p.Comparator = string(value)
+		case propCreationTime, propWriterVersion:
+			var v uint64
+			if v, err = decodeUvarint(value); err != nil {
+				return nil, err
+			}
+			if string(name) == propCreationTime {
+				p.CreatedAt = time.Unix(0, int64(v))
+			} else {
+				p.WriterVersion = uint32(v)
+			}
+		}
+		if number != nil {
+			if *number, err = decodeUvarint(value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return p, nil
+}
+
+func decodeUvarint(data []byte) (uint64, error) {
+	v, n := binary.Uvarint(data)
+	if n != len(data) {
+		return 0, errors.New("corrupted properties block")
+	}
+	return v, nil
+}
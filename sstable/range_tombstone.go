@@ -0,0 +1,46 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/aixiasang/sqldb/utils"
+)
+
+// RangeTombstone 范围删除标记，删除[Start, End]内的键(包含两端)。
+// 标记只作用于比所在文件或内存表更旧的数据，同一个文件中的键总是比其中的标记更新
+type RangeTombstone struct {
+	Start []byte
+	End   []byte
+}
+
+// Contains 键是否在标记的范围内
+func (t RangeTombstone) Contains(key []byte) bool {
+	return utils.CompareBytes(t.Start, key) <= 0 && utils.CompareBytes(key, t.End) <= 0
+}
+
+// encodeRangeTombstones 编码范围删除块，每个标记的格式与数据块中的键值对相同：起点长度、终点长度、起点、终点
+func encodeRangeTombstones(tombstones []RangeTombstone) []byte {
+	buf := bytes.NewBuffer(nil)
+	for _, t := range tombstones {
+		binary.Write(buf, binary.BigEndian, uint32(len(t.Start)))
+		binary.Write(buf, binary.BigEndian, uint32(len(t.End)))
+		buf.Write(t.Start)
+		buf.Write(t.End)
+	}
+	return buf.Bytes()
+}
+
+// decodeRangeTombstones 解析范围删除块
+func decodeRangeTombstones(block []byte) ([]RangeTombstone, error) {
+	var tombstones []RangeTombstone
+	for offset := uint64(0); offset < uint64(len(block)); {
+		start, end, next, err := decodeEntry(block, offset)
+		if err != nil {
+			return nil, err
+		}
+		tombstones = append(tombstones, RangeTombstone{Start: utils.CopyKey(start), End: utils.CopyKey(end)})
+		offset = next
+	}
+	return tombstones, nil
+}
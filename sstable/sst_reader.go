@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"io"
 	"os"
 	"sync"
 
@@ -14,176 +13,296 @@ import (
 )
 
 const (
-	footerLength       = 24
-	filterHeaderLength = 8 + 4
-	indexHeaderLength  = 4 + 4 + 8 + 8
+	legacyFooterLength   = 24                         // 数据、索引、过滤器的长度
+	rangeDelFooterLength = 40                         // 数据、索引、过滤器、范围删除块的长度和魔数
+	footerLength         = 48                         // 数据、索引、过滤器、范围删除块、属性块的长度和魔数
+	rangeDelFooterMagic  = uint64(0x73716c6462737374) // "sqldbsst"，没有属性块的文件
+	footerMagic          = uint64(0x73716c6462737432) // "sqldbst2"，没有魔数的是只有前三个长度的旧格式文件
+	filterHeaderLength   = 8 + 4
+	indexHeaderLength    = 4 + 4 + 8 + 8
 )
 
 type SSTReader struct {
-	filename     string            // 文件名
-	mu           *sync.RWMutex     // 互斥锁
-	src          *os.File          // 文件描述符
-	conf         *config.Config    // 配置
-	indexs       []*Index          // 索引
-	dataLength   uint64            // 数据长度
-	indexLength  uint64            // 索引长度
-	filterLength uint64            // 过滤器长度
-	filterMap    map[uint64][]byte // 过滤器映射
-	bloomFilter  filter.Filter     // 布隆过滤器
+	filename       string                   // 文件名
+	mu             *sync.RWMutex            // 互斥锁
+	src            *os.File                 // 文件描述符
+	conf           *config.Config           // 配置
+	indexs         []*Index                 // 索引
+	dataLength     uint64                   // 数据长度
+	indexLength    uint64                   // 索引长度
+	filterLength   uint64                   // 过滤器长度
+	rangeDelLength uint64                   // 范围删除块长度
+	propsLength    uint64                   // 属性块长度
+	fileSize       int64                    // 文件大小
+	filters        map[uint64]filter.Filter // 各数据块的布隆过滤器，按数据块偏移量索引
+	rangeDels      []RangeTombstone         // 范围删除标记
+	props          *Properties              // 文件属性
+	cacheID        uint64                   // 块缓存中的文件ID
+	legacy         bool                     // 是否为只有三个长度的旧格式尾部
 }
 
+var errCorruptedBlock = errors.New("corrupted data block")
+
 func NewSSTReader(filename string, conf *config.Config) (*SSTReader, error) {
 	src, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	reader := &SSTReader{
-		filename:    filename,
-		src:         src,
-		conf:        conf,
-		filterMap:   make(map[uint64][]byte),
-		mu:          &sync.RWMutex{},
-		bloomFilter: config.NewFilterConstructor(),
+		filename: filename,
+		src:      src,
+		conf:     conf,
+		filters:  make(map[uint64]filter.Filter),
+		mu:       &sync.RWMutex{},
+	}
+	if conf.BlockCache != nil {
+		reader.cacheID = conf.BlockCache.NewID()
 	}
 	if err := reader.readFooter(); err != nil {
+		src.Close()
 		return nil, err
 	}
 	if err := reader.readIndex(); err != nil {
+		src.Close()
 		return nil, err
 	}
 	if err := reader.readFilter(); err != nil {
+		src.Close()
+		return nil, err
+	}
+	if err := reader.readRangeDels(); err != nil {
+		src.Close()
+		return nil, err
+	}
+	if err := reader.readProperties(); err != nil {
+		src.Close()
 		return nil, err
 	}
 	return reader, nil
 }
 
-func (r *SSTReader) readFooter() error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// Size 返回SST文件的大小
+func (r *SSTReader) Size() int64 {
+	return r.fileSize
+}
+
+// SmallestKey 返回文件中的最小键，包括范围删除标记的起点，空文件返回nil
+func (r *SSTReader) SmallestKey() []byte {
+	var smallest []byte
+	if len(r.indexs) > 0 {
+		smallest = r.indexs[0].minKey
+	}
+	for _, t := range r.rangeDels {
+		if smallest == nil || utils.CompareBytes(t.Start, smallest) < 0 {
+			smallest = t.Start
+		}
+	}
+	return utils.CopyKey(smallest)
+}
+
+// LargestKey 返回文件中的最大键，包括范围删除标记的终点，空文件返回nil
+func (r *SSTReader) LargestKey() []byte {
+	var largest []byte
+	if len(r.indexs) > 0 {
+		largest = r.indexs[len(r.indexs)-1].maxKey
+	}
+	for _, t := range r.rangeDels {
+		if largest == nil || utils.CompareBytes(t.End, largest) > 0 {
+			largest = t.End
+		}
+	}
+	return utils.CopyKey(largest)
+}
+
+// RangeTombstones 返回文件中的范围删除标记
+func (r *SSTReader) RangeTombstones() []RangeTombstone {
+	return r.rangeDels
+}
+
+// Properties 返回文件的属性
+func (r *SSTReader) Properties() *Properties {
+	return r.props
+}
 
-	footer := make([]byte, footerLength)
+// Legacy 文件是否由上一个发布版本写入，尾部只有数据、索引、过滤器三个长度
+func (r *SSTReader) Legacy() bool {
+	return r.legacy
+}
+
+func (r *SSTReader) readFooter() error {
 	fileInfo, err := r.src.Stat()
 	if err != nil {
 		return err
 	}
-	fileSize := fileInfo.Size()
-	if _, err := r.src.ReadAt(footer, fileSize-24); err != nil {
-		return err
-	}
-	var dataLength, indexLength, filterLength uint64
-	if err := binary.Read(bytes.NewBuffer(footer[:8]), binary.BigEndian, &dataLength); err != nil {
-		return err
+	r.fileSize = fileInfo.Size()
+	if r.fileSize < legacyFooterLength {
+		return errors.New("corrupted sst footer")
 	}
-	if err := binary.Read(bytes.NewBuffer(footer[8:16]), binary.BigEndian, &indexLength); err != nil {
+	footer := make([]byte, min(r.fileSize, footerLength))
+	if _, err := r.src.ReadAt(footer, r.fileSize-int64(len(footer))); err != nil {
 		return err
 	}
-	if err := binary.Read(bytes.NewBuffer(footer[16:]), binary.BigEndian, &filterLength); err != nil {
-		return err
+	magic := binary.BigEndian.Uint64(footer[len(footer)-8:])
+	switch {
+	case len(footer) == footerLength && magic == footerMagic:
+		r.rangeDelLength = binary.BigEndian.Uint64(footer[24:32])
+		r.propsLength = binary.BigEndian.Uint64(footer[32:40])
+	case len(footer) >= rangeDelFooterLength && magic == rangeDelFooterMagic:
+		footer = footer[len(footer)-rangeDelFooterLength:]
+		r.rangeDelLength = binary.BigEndian.Uint64(footer[24:32])
+	default:
+		footer = footer[len(footer)-legacyFooterLength:]
+		r.legacy = true
 	}
-	r.dataLength = dataLength
-	r.indexLength = indexLength
-	r.filterLength = filterLength
+	r.dataLength = binary.BigEndian.Uint64(footer[:8])
+	r.indexLength = binary.BigEndian.Uint64(footer[8:16])
+	r.filterLength = binary.BigEndian.Uint64(footer[16:24])
 	return nil
 }
 func (r *SSTReader) readIndex() error {
 	return r.readIndexData(r.dataLength, r.indexLength)
 }
 func (r *SSTReader) readIndexData(offset uint64, length uint64) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	r.src.Seek(int64(offset), io.SeekStart)
-	var currOffset uint64 = 0
-	var indexs []*Index
-	for currOffset < length {
-		buf := make([]byte, indexHeaderLength)
-		if _, err := r.src.Read(buf); err != nil {
-			return err
-		}
-		minKeyLen := binary.BigEndian.Uint32(buf[:4])
-		maxKeyLen := binary.BigEndian.Uint32(buf[4:8])
-		offset := binary.BigEndian.Uint64(buf[8:16])
-		length := binary.BigEndian.Uint64(buf[16:24])
-		reminderData := make([]byte, minKeyLen+maxKeyLen)
-		if _, err := r.src.Read(reminderData); err != nil {
-			return err
-		}
-		minKey := reminderData[:minKeyLen]
-		maxKey := reminderData[minKeyLen : minKeyLen+maxKeyLen]
-		index := &Index{minKey: minKey, maxKey: maxKey, offset: offset, length: length}
-		indexs = append(indexs, index)
-		currOffset += indexHeaderLength + uint64(minKeyLen) + uint64(maxKeyLen)
+	buf := make([]byte, length)
+	if _, err := r.src.ReadAt(buf, int64(offset)); err != nil {
+		return err
+	}
+	indexs, err := DecodeStream(bytes.NewReader(buf))
+	if err != nil {
+		return err
 	}
 	r.indexs = indexs
 	return nil
 }
 
-func (r *SSTReader) readData(offset uint64, length uint64, target []byte) ([]byte, bool, error) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// readBlock 读取索引对应的数据块，优先从块缓存中获取
+func (r *SSTReader) readBlock(index *Index) ([]byte, error) {
+	cache := r.conf.BlockCache
+	key := utils.BlockCacheKey{ID: r.cacheID, Offset: index.offset}
+	if cache != nil {
+		if block, ok := cache.Get(key); ok {
+			r.conf.Statistics.Add(utils.TickerBlockCacheHits, 1)
+			return block, nil
+		}
+		r.conf.Statistics.Add(utils.TickerBlockCacheMisses, 1)
+	}
+	block := make([]byte, index.length)
+	if _, err := r.src.ReadAt(block, int64(index.offset)); err != nil {
+		return nil, err
+	}
+	r.conf.Statistics.Add(utils.TickerBlockReadBytes, index.length)
+	if cache != nil {
+		cache.Put(key, block)
+	}
+	return block, nil
+}
 
-	r.src.Seek(int64(offset), io.SeekStart)
-	var currOffset uint64 = 0
+// decodeEntry 解析数据块中offset处的键值对，返回下一个键值对的偏移量
+func decodeEntry(block []byte, offset uint64) ([]byte, []byte, uint64, error) {
+	if offset+8 > uint64(len(block)) {
+		return nil, nil, 0, errCorruptedBlock
+	}
+	keyLen := uint64(binary.BigEndian.Uint32(block[offset : offset+4]))
+	valueLen := uint64(binary.BigEndian.Uint32(block[offset+4 : offset+8]))
+	keyStart := offset + 8
+	valueStart := keyStart + keyLen
+	next := valueStart + valueLen
+	if next > uint64(len(block)) {
+		return nil, nil, 0, errCorruptedBlock
+	}
+	return block[keyStart:valueStart], block[valueStart:next], next, nil
+}
 
-	for currOffset < length {
-		var keyLen, valueLen uint32
-		var key, value []byte
-		if err := binary.Read(r.src, binary.BigEndian, &keyLen); err != nil {
-			if err == io.EOF {
-				return nil, false, nil
-			}
-			return nil, false, err
-		}
-		if err := binary.Read(r.src, binary.BigEndian, &valueLen); err != nil {
-			return nil, false, err
-		}
-		key = make([]byte, keyLen)
-		value = make([]byte, valueLen)
-		if _, err := r.src.Read(key); err != nil {
-			return nil, false, err
-		}
-		if _, err := r.src.Read(value); err != nil {
+func (r *SSTReader) readData(index *Index, target []byte) ([]byte, bool, error) {
+	block, err := r.readBlock(index)
+	if err != nil {
+		return nil, false, err
+	}
+	for offset := uint64(0); offset < uint64(len(block)); {
+		key, value, next, err := decodeEntry(block, offset)
+		if err != nil {
 			return nil, false, err
 		}
 		if utils.CompareBytes(key, target) == 0 {
-			return value, true, nil
+			return utils.CopyKey(value), true, nil
 		}
-		currOffset += uint64(keyLen) + uint64(valueLen)
+		offset = next
 	}
 	return nil, false, nil
 }
 func (r *SSTReader) readFilter() error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	r.src.Seek(int64(r.dataLength+r.indexLength), io.SeekStart)
-	var currOffset uint64 = 0
-	for currOffset < r.filterLength {
-		var offset uint64
-		var length uint32
-		if err := binary.Read(r.src, binary.BigEndian, &offset); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
+	buf := make([]byte, r.filterLength)
+	if _, err := r.src.ReadAt(buf, int64(r.dataLength+r.indexLength)); err != nil {
+		return err
+	}
+	for currOffset := uint64(0); currOffset < r.filterLength; {
+		if currOffset+filterHeaderLength > r.filterLength {
+			return errors.New("corrupted filter block")
 		}
-		if err := binary.Read(r.src, binary.BigEndian, &length); err != nil {
-			return err
+		offset := binary.BigEndian.Uint64(buf[currOffset : currOffset+8])
+		length := uint64(binary.BigEndian.Uint32(buf[currOffset+8 : currOffset+filterHeaderLength]))
+		start := currOffset + filterHeaderLength
+		if start+length > r.filterLength {
+			return errors.New("corrupted filter block")
 		}
-		filterData := make([]byte, length)
-		if _, err := r.src.Read(filterData); err != nil {
+		f := r.conf.NewFilter()
+		if err := f.Load(buf[start : start+length]); err != nil {
 			return err
 		}
-		r.filterMap[offset] = filterData
-		currOffset += uint64(length) + filterHeaderLength
+		r.filters[offset] = f
+		currOffset = start + length
+	}
+	return nil
+}
+
+// readRangeDels 读取过滤器之后的范围删除块
+func (r *SSTReader) readRangeDels() error {
+	if r.rangeDelLength == 0 {
+		return nil
+	}
+	buf := make([]byte, r.rangeDelLength)
+	if _, err := r.src.ReadAt(buf, int64(r.dataLength+r.indexLength+r.filterLength)); err != nil {
+		return err
+	}
+	rangeDels, err := decodeRangeTombstones(buf)
+	if err != nil {
+		return err
+	}
+	r.rangeDels = rangeDels
+	return nil
+}
+
+// readProperties 读取范围删除块之后的属性块，没有属性块的旧文件使用从索引和尾部得到的属性
+func (r *SSTReader) readProperties() error {
+	if r.propsLength == 0 {
+		r.props = &Properties{
+			NumRangeDeletions: uint64(len(r.rangeDels)),
+			NumDataBlocks:     uint64(len(r.indexs)),
+			DataSize:          r.dataLength,
+			IndexSize:         r.indexLength,
+			FilterSize:        r.filterLength,
+		}
+		if len(r.indexs) > 0 {
+			r.props.SmallestKey = utils.CopyKey(r.indexs[0].minKey)
+			r.props.LargestKey = utils.CopyKey(r.indexs[len(r.indexs)-1].maxKey)
+		}
+		return nil
+	}
+	buf := make([]byte, r.propsLength)
+	if _, err := r.src.ReadAt(buf, int64(r.dataLength+r.indexLength+r.filterLength+r.rangeDelLength)); err != nil {
+		return err
 	}
+	props, err := decodeProperties(buf)
+	if err != nil {
+		return err
+	}
+	r.props = props
 	return nil
 }
+
 func (r *SSTReader) getIndex(key []byte) (*Index, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
 	for _, index := range r.indexs {
-		if bytes.Compare(key, index.minKey) >= 0 && bytes.Compare(key, index.maxKey) <= 0 {
+		if utils.CompareBytes(key, index.minKey) >= 0 && utils.CompareBytes(key, index.maxKey) <= 0 {
 			return index, nil
 		}
 	}
@@ -194,54 +313,34 @@ func (r *SSTReader) Get(key []byte) ([]byte, bool, error) {
 	if err != nil {
 		return nil, false, err
 	}
-	if data, ok := r.filterMap[index.offset]; ok {
-		r.bloomFilter.Load(data)
-		if !r.bloomFilter.Contains(key) {
-			return nil, false, nil
-		}
-		return r.readData(index.offset, index.length, key)
+	f, ok := r.filters[index.offset]
+	if !ok {
+		return nil, false, errors.New("filter not found")
 	}
-	return nil, false, errors.New("filter not found")
-}
-func (r *SSTReader) readDataCallback(offset uint64, length uint64, callback func([]byte, []byte) bool) error {
-	r.src.Seek(int64(offset), io.SeekStart)
-	var currOffset uint64 = 0
-
-	for currOffset < length {
-		var keyLen, valueLen uint32
-		var key, value []byte
-		if err := binary.Read(r.src, binary.BigEndian, &keyLen); err != nil {
-			if err == io.EOF {
-				return nil
-			}
-			return err
-		}
-		if err := binary.Read(r.src, binary.BigEndian, &valueLen); err != nil {
-			return err
-		}
-		key = make([]byte, keyLen)
-		value = make([]byte, valueLen)
-		if _, err := r.src.Read(key); err != nil {
-			return err
-		}
-		if _, err := r.src.Read(value); err != nil {
-			return err
-		}
-		if callback(key, value) {
-			return nil
-		}
-		currOffset += uint64(keyLen) + uint64(valueLen)
+	if !f.Contains(key) {
+		r.conf.Statistics.Add(utils.TickerBloomUseful, 1)
+		return nil, false, nil
 	}
-	return nil
+	value, found, err := r.readData(index, key)
+	if err == nil && !found {
+		r.conf.Statistics.Add(utils.TickerBloomFalsePositive, 1)
+	}
+	return value, found, err
 }
 func (r *SSTReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	_ = r.src.Close()
 	r.src = nil
 	r.indexs = nil
-	r.filterMap = nil
+	r.filters = nil
 	r.dataLength = 0
 	r.indexLength = 0
 	r.filterLength = 0
+	r.rangeDelLength = 0
+	r.propsLength = 0
+	r.rangeDels = nil
+	r.props = nil
 	r.conf = nil
 	r.filename = ""
 	return nil
@@ -259,6 +358,8 @@ type Iterator interface {
 	Key() []byte
 	// Value returns the current value the iterator is positioned at
 	Value() []byte
+	// Err returns the error that stopped the iteration early, if any
+	Err() error
 }
 
 // SSTIterator implements the Iterator interface for SSTReader
@@ -266,12 +367,12 @@ type SSTIterator struct {
 	reader     *SSTReader
 	index      int    // Current index position
 	indexCount int    // Total number of indexes
-	dataOffset uint64 // Current data offset
-	dataLength uint64 // Current data length
+	block      []byte // Current data block
 	currKey    []byte // Current key
 	currValue  []byte // Current value
 	valid      bool   // Whether current position is valid
 	currOffset uint64 // Current offset within data block
+	err        error  // Error that invalidated the iterator
 }
 
 // Iterator returns a new iterator for the SSTable
@@ -298,16 +399,20 @@ func (it *SSTIterator) First() {
 	}
 
 	it.index = 0
-	it.loadCurrentIndex()
-	it.valid = it.readNextKeyValue()
+	it.valid = it.loadCurrentIndex() && it.readNextKeyValue()
 }
 
-// loadCurrentIndex loads the current index information
-func (it *SSTIterator) loadCurrentIndex() {
-	index := it.reader.indexs[it.index]
-	it.dataOffset = index.offset
-	it.dataLength = index.length
+// loadCurrentIndex loads the data block of the current index
+func (it *SSTIterator) loadCurrentIndex() bool {
+	block, err := it.reader.readBlock(it.reader.indexs[it.index])
+	if err != nil {
+		it.block = nil
+		it.err = err
+		return false
+	}
+	it.block = block
 	it.currOffset = 0
+	return true
 }
 
 // Next advances to the next key-value pair
@@ -328,52 +433,26 @@ func (it *SSTIterator) Next() bool {
 		return false
 	}
 
-	it.loadCurrentIndex()
-	it.valid = it.readNextKeyValue()
+	it.valid = it.loadCurrentIndex() && it.readNextKeyValue()
 	return it.valid
 }
 
-// readNextKeyValue reads the next key-value pair in the current index
+// readNextKeyValue reads the next key-value pair in the current data block
 func (it *SSTIterator) readNextKeyValue() bool {
-	if it.currOffset >= it.dataLength {
+	if it.currOffset >= uint64(len(it.block)) {
 		return false
 	}
 
-	reader := it.reader
-	reader.mu.RLock()
-	defer reader.mu.RUnlock()
-
-	// Seek to the current position in the data block
-	_, err := reader.src.Seek(int64(it.dataOffset+it.currOffset), io.SeekStart)
+	key, value, next, err := decodeEntry(it.block, it.currOffset)
 	if err != nil {
+		it.err = err
 		return false
 	}
 
-	// Read key and value lengths
-	var keyLen, valueLen uint32
-	if err := binary.Read(reader.src, binary.BigEndian, &keyLen); err != nil {
-		return false
-	}
-	if err := binary.Read(reader.src, binary.BigEndian, &valueLen); err != nil {
-		return false
-	}
-
-	// Read key and value
-	key := make([]byte, keyLen)
-	value := make([]byte, valueLen)
-	if _, err := reader.src.Read(key); err != nil {
-		return false
-	}
-	if _, err := reader.src.Read(value); err != nil {
-		return false
-	}
-
-	// Update current key and value
-	it.currKey = key
-	it.currValue = value
-
-	// Update offset
-	it.currOffset += 8 + uint64(keyLen) + uint64(valueLen) // 8 bytes for key and value lengths
+	// Copy out of the block, which may be shared through the block cache
+	it.currKey = utils.CopyKey(key)
+	it.currValue = utils.CopyKey(value)
+	it.currOffset = next
 
 	return true
 }
@@ -398,3 +477,8 @@ func (it *SSTIterator) Value() []byte {
 	}
 	return it.currValue
 }
+
+// Err returns the read or decode error that ended the iteration, if any
+func (it *SSTIterator) Err() error {
+	return it.err
+}
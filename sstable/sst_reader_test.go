@@ -2,6 +2,8 @@ package sstable
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/aixiasang/sqldb/config"
@@ -44,8 +46,145 @@ func TestSSTReader_Get(t *testing.T) {
 	if !ok {
 		t.Fatal("key not found")
 	}
-	if string(value) != "value_1" {
+	if string(value) != string(utils.GenerateValue(1)) {
 		t.Fatal("value not match")
 	}
 	fmt.Println("value", value)
 }
+
+func TestSSTReader_RangeTombstones(t *testing.T) {
+	conf := config.NewConfig()
+	conf.BlockSize = 256
+	dir := t.TempDir()
+
+	write := func(path string, tombstones ...RangeTombstone) {
+		t.Helper()
+		writer, err := NewSSTWriter(path, conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mt := config.NewMemTableConstructor()
+		for i := 10; i < 20; i++ {
+			mt.Put(utils.GenerateKey(i), utils.GenerateValue(i))
+		}
+		for _, tombstone := range tombstones {
+			writer.AddRangeTombstone(tombstone.Start, tombstone.End)
+		}
+		if err := writer.Write(mt); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(dir, "rangedel.sst")
+	write(path, RangeTombstone{Start: utils.GenerateKey(0), End: utils.GenerateKey(5)},
+		RangeTombstone{Start: utils.GenerateKey(30), End: utils.GenerateKey(40)})
+	reader, err := NewSSTReader(path, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	tombstones := reader.RangeTombstones()
+	if len(tombstones) != 2 || !tombstones[1].Contains(utils.GenerateKey(35)) || tombstones[0].Contains(utils.GenerateKey(6)) {
+		t.Fatalf("unexpected tombstones: %v", tombstones)
+	}
+	// 键范围包含范围删除标记的边界
+	if string(reader.SmallestKey()) != string(utils.GenerateKey(0)) || string(reader.LargestKey()) != string(utils.GenerateKey(40)) {
+		t.Fatalf("unexpected key range: %s - %s", reader.SmallestKey(), reader.LargestKey())
+	}
+	if value, ok, err := reader.Get(utils.GenerateKey(15)); err != nil || !ok || string(value) != string(utils.GenerateValue(15)) {
+		t.Fatalf("value=%q, ok=%v, err=%v", value, ok, err)
+	}
+
+	// 旧格式的文件没有范围删除块，尾部只有三个长度
+	legacy := filepath.Join(dir, "legacy.sst")
+	write(legacy)
+	data, err := os.ReadFile(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacy, append(data[:len(data)-footerLength], data[len(data)-footerLength:len(data)-footerLength+legacyFooterLength]...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader, err = NewSSTReader(legacy, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if len(reader.RangeTombstones()) != 0 {
+		t.Fatalf("unexpected tombstones in legacy table: %v", reader.RangeTombstones())
+	}
+	if value, ok, err := reader.Get(utils.GenerateKey(19)); err != nil || !ok || string(value) != string(utils.GenerateValue(19)) {
+		t.Fatalf("value=%q, ok=%v, err=%v", value, ok, err)
+	}
+}
+
+func TestSSTReader_Properties(t *testing.T) {
+	conf := config.NewConfig()
+	conf.BlockSize = 256
+	path := filepath.Join(t.TempDir(), "props.sst")
+
+	writer, err := NewSSTWriter(path, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		add := writer.Add
+		if i%10 == 0 {
+			add = writer.AddDeletion
+		}
+		if err := add(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.AddRangeTombstone(utils.GenerateKey(200), utils.GenerateKey(300))
+	if err := writer.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewSSTReader(path, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	props := reader.Properties()
+	if props.NumEntries != 100 || props.NumDeletions != 10 || props.NumRangeDeletions != 1 {
+		t.Fatalf("unexpected counts: %s", props)
+	}
+	if props.NumDataBlocks < 2 || props.DataSize == 0 || props.IndexSize == 0 || props.FilterSize == 0 {
+		t.Fatalf("unexpected block sizes: %s", props)
+	}
+	if props.RawKeySize != 100*uint64(len(utils.GenerateKey(0))) {
+		t.Fatalf("raw key size=%d", props.RawKeySize)
+	}
+	// 最小和最大的键不包括范围删除标记
+	if string(props.SmallestKey) != string(utils.GenerateKey(0)) || string(props.LargestKey) != string(utils.GenerateKey(99)) {
+		t.Fatalf("unexpected key range: %s", props)
+	}
+	if props.Comparator != ComparatorName || props.Compression != CompressionNone ||
+		props.FilterPolicy != filterPolicy(conf) || props.WriterVersion != WriterVersion || props.CreatedAt.IsZero() {
+		t.Fatalf("unexpected metadata: %s", props)
+	}
+
+	// 没有属性块的文件使用从索引和尾部得到的属性
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := filepath.Join(t.TempDir(), "legacy.sst")
+	if err := os.WriteFile(legacy, append(data[:len(data)-footerLength], data[len(data)-footerLength:len(data)-footerLength+legacyFooterLength]...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old, err := NewSSTReader(legacy, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	oldProps := old.Properties()
+	if oldProps.WriterVersion != 0 || oldProps.NumDataBlocks != props.NumDataBlocks || oldProps.DataSize != props.DataSize ||
+		string(oldProps.SmallestKey) != string(props.SmallestKey) || string(oldProps.LargestKey) != string(props.LargestKey) {
+		t.Fatalf("unexpected legacy properties: %s", oldProps)
+	}
+}
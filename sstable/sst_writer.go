@@ -1,92 +1,222 @@
 package sstable
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/aixiasang/sqldb/config"
 	"github.com/aixiasang/sqldb/filter"
 	"github.com/aixiasang/sqldb/memtable"
+	"github.com/aixiasang/sqldb/utils"
 )
 
+const (
+	writeBufferSize = 64 << 10 // 写入文件的缓冲区大小
+	TempFileSuffix  = ".tmp"   // 写入中的SST文件的后缀，完成后重命名为最终的文件名
+)
+
+// ErrKeyOrder 添加的键没有严格递增
+var ErrKeyOrder = errors.New("sstable: keys must be added in strictly ascending order")
+
+// SSTWriter 增量地写入SST文件：数据块写满后经缓冲区写出到文件，内存中只保留当前数据块、
+// 索引和各数据块的过滤器。Add按升序添加键值对，Finish写入索引、过滤器和尾部后关闭文件，
+// 出错时调用Abandon删除文件。写入期间使用带TempFileSuffix后缀的临时文件，Finish同步后
+// 原子地重命名并同步目录，崩溃时不会留下不完整的SST文件
 type SSTWriter struct {
-	filename    string         // 文件名
-	dest        *os.File       // 文件描述符
-	dataBuf     *bytes.Buffer  // 数据缓冲区
-	indexBuf    *bytes.Buffer  // 索引缓冲区
-	filterBuf   *bytes.Buffer  // 过滤器缓冲区
-	block       *DataBlock     // 数据块
-	filterBlock *BloomBlock    // 过滤器块
-	filter      filter.Filter  // 过滤器
-	conf        *config.Config // 配置
-	indexs      []*Index       // 索引
+	filename    string           // 文件名
+	tmpName     string           // 写入中的临时文件名
+	dest        *os.File         // 文件描述符
+	buf         *bufio.Writer    // 写入缓冲区
+	dataLength  uint64           // 已写出的数据块的总长度
+	block       *DataBlock       // 数据块
+	filterBlock *BloomBlock      // 过滤器块
+	filter      filter.Filter    // 过滤器
+	conf        *config.Config   // 配置
+	indexs      []*Index         // 索引
+	rangeDels   []RangeTombstone // 范围删除标记
+	lastKey     []byte           // 最后添加的键
+	props       Properties       // 文件属性，Finish时写入属性块
+	finished    bool             // 已写入尾部
+	renamed     bool             // 临时文件已重命名为最终的文件名
 }
 
 func NewSSTWriter(filename string, conf *config.Config) (*SSTWriter, error) {
-	dest, err := os.Create(filename)
+	tmpName := filename + TempFileSuffix
+	dest, err := os.Create(tmpName)
 	if err != nil {
 		return nil, err
 	}
 	return &SSTWriter{
 		filename:    filename,
+		tmpName:     tmpName,
 		dest:        dest,
-		dataBuf:     bytes.NewBuffer(nil),
-		indexBuf:    bytes.NewBuffer(nil),
+		buf:         bufio.NewWriterSize(dest, writeBufferSize),
 		block:       NewDataBlock(conf),
 		filterBlock: NewBloomBlock(conf),
 		conf:        conf,
-		filter:      config.NewFilterConstructor(),
-		filterBuf:   bytes.NewBuffer(nil),
+		filter:      conf.NewFilter(),
+		props: Properties{
+			CreatedAt:     now(conf),
+			Compression:   CompressionNone,
+			FilterPolicy:  filterPolicy(conf),
+			Comparator:    ComparatorName,
+			WriterVersion: WriterVersion,
+		},
 	}, nil
 }
 
+// now 返回配置的时钟的当前时间
+func now(conf *config.Config) time.Time {
+	if conf.Clock == nil {
+		return time.Now()
+	}
+	return conf.Clock.Now()
+}
+
+// AddRangeTombstone 添加范围删除标记，在Finish时写入范围删除块
+func (w *SSTWriter) AddRangeTombstone(start, end []byte) {
+	w.rangeDels = append(w.rangeDels, RangeTombstone{Start: start, End: end})
+}
+
+// Add 添加键值对，键不能为空，且必须按utils.CompareBytes的顺序严格递增
+func (w *SSTWriter) Add(key, value []byte) error {
+	if len(key) == 0 {
+		return errors.New("sstable: empty key")
+	}
+	if w.props.NumEntries > 0 && utils.CompareBytes(key, w.lastKey) <= 0 {
+		return fmt.Errorf("%w: %q after %q", ErrKeyOrder, key, w.lastKey)
+	}
+	if err := w.writeKV(key, value); err != nil {
+		return err
+	}
+	w.lastKey = utils.CopyKey(key)
+	if w.props.NumEntries == 0 {
+		w.props.SmallestKey = w.lastKey
+	}
+	w.props.NumEntries++
+	w.props.RawKeySize += uint64(len(key))
+	w.props.RawValueSize += uint64(len(value))
+	return nil
+}
+
+// AddDeletion 与Add相同，并在属性中计为删除标记。SST本身不解释值，由调用方区分删除标记
+func (w *SSTWriter) AddDeletion(key, value []byte) error {
+	if err := w.Add(key, value); err != nil {
+		return err
+	}
+	w.props.NumDeletions++
+	return nil
+}
+
+// Count 返回已添加的键值对数量
+func (w *SSTWriter) Count() int {
+	return int(w.props.NumEntries)
+}
+
+// FileSize 返回目前为止的文件大小，包括尚未写出的当前数据块，不包括索引、过滤器和尾部
+func (w *SSTWriter) FileSize() int64 {
+	return int64(w.dataLength) + int64(w.block.Size())
+}
+
+// Write 写入内存表中的全部键值对以及索引和尾部，之后需调用Close完成文件
 func (w *SSTWriter) Write(mem memtable.MemTable) error {
 	iter := mem.Iterator()
 	for iter.Next() {
-		if err := w.writeKV(iter.Key(), iter.Value()); err != nil {
+		if err := w.Add(iter.Key(), iter.Value()); err != nil {
 			return err
 		}
 	}
+	return w.finish()
+}
+
+// Finish 写入最后一个数据块以及索引、过滤器、范围删除块、属性块和尾部，同步并关闭临时文件后重命名为最终的文件名。
+// 失败时需调用Abandon
+func (w *SSTWriter) Finish() error {
+	if err := w.finish(); err != nil {
+		return err
+	}
+	return w.commit()
+}
+
+// Abandon 放弃写入，关闭并删除文件
+func (w *SSTWriter) Abandon() error {
+	w.dest.Close()
+	if w.renamed {
+		return os.Remove(w.filename)
+	}
+	return os.Remove(w.tmpName)
+}
+
+// commit 同步并关闭临时文件，原子地重命名为最终的文件名后同步所在目录
+func (w *SSTWriter) commit() error {
+	if err := w.dest.Sync(); err != nil {
+		return err
+	}
+	if err := w.dest.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.tmpName, w.filename); err != nil {
+		return err
+	}
+	w.renamed = true
+	return utils.SyncDir(filepath.Dir(w.filename))
+}
+
+// finish 写入最后一个数据块以及索引、过滤器、范围删除块、属性块和尾部，并清空写入缓冲区
+func (w *SSTWriter) finish() error {
 	if w.block.Size() > 0 {
 		if err := w.mustFlush(); err != nil {
 			return err
 		}
 	}
-	dataLength := w.dataBuf.Len()
+	var indexLength int
 	for _, index := range w.indexs {
 		buf, err := index.Encode()
 		if err != nil {
 			return err
 		}
-		if _, err := w.indexBuf.Write(buf); err != nil {
+		if _, err := w.buf.Write(buf); err != nil {
 			return err
 		}
+		indexLength += len(buf)
 	}
-	indexLength := w.indexBuf.Len()
-	if _, err := w.dest.Write(w.dataBuf.Bytes()); err != nil {
-		return err
-	}
-	if _, err := w.dest.Write(w.indexBuf.Bytes()); err != nil {
+	filterLength := w.filterBlock.Size()
+	if _, err := w.buf.Write(w.filterBlock.Bytes()); err != nil {
 		return err
 	}
-	filterLength := w.filterBlock.Size()
-	if _, err := w.dest.Write(w.filterBlock.Bytes()); err != nil {
+	rangeDelBlock := encodeRangeTombstones(w.rangeDels)
+	if _, err := w.buf.Write(rangeDelBlock); err != nil {
 		return err
 	}
-	if err := binary.Write(w.dest, binary.BigEndian, uint64(dataLength)); err != nil {
+	w.props.LargestKey = w.lastKey
+	w.props.NumRangeDeletions = uint64(len(w.rangeDels))
+	w.props.NumDataBlocks = uint64(len(w.indexs))
+	w.props.DataSize = w.dataLength
+	w.props.IndexSize = uint64(indexLength)
+	w.props.FilterSize = uint64(filterLength)
+	propsBlock := encodeProperties(&w.props)
+	if _, err := w.buf.Write(propsBlock); err != nil {
 		return err
 	}
-	if err := binary.Write(w.dest, binary.BigEndian, uint64(indexLength)); err != nil {
+	footer := make([]byte, 0, footerLength)
+	footer = binary.BigEndian.AppendUint64(footer, w.dataLength)
+	footer = binary.BigEndian.AppendUint64(footer, uint64(indexLength))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(filterLength))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(len(rangeDelBlock)))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(len(propsBlock)))
+	footer = binary.BigEndian.AppendUint64(footer, footerMagic)
+	if _, err := w.buf.Write(footer); err != nil {
 		return err
 	}
-	if err := binary.Write(w.dest, binary.BigEndian, uint64(filterLength)); err != nil {
+	if err := w.buf.Flush(); err != nil {
 		return err
 	}
-	// fmt.Println("dataLength", dataLength)
-	// fmt.Println("indexLength", indexLength)
-	// fmt.Println("filterLength", filterLength)
-	// fmt.Println("indexs", w.indexs)
+	w.finished = true
 	return nil
 }
 func (w *SSTWriter) writeKV(key, value []byte) error {
@@ -109,28 +239,36 @@ func (w *SSTWriter) tryFlush() error {
 	}
 	return nil
 }
+
+// mustFlush 把当前数据块写出到文件，记录索引和过滤器
 func (w *SSTWriter) mustFlush() error {
 	minKey := w.block.MinKey()
 	maxKey := w.block.MaxKey()
-	offset := w.dataBuf.Len()
+	offset := w.dataLength
 
-	length, err := w.dataBuf.Write(w.block.Bytes())
+	length, err := w.buf.Write(w.block.Bytes())
 	if err != nil {
 		return err
 	}
+	w.dataLength += uint64(length)
 	w.block.Clear()
 	w.indexs = append(w.indexs, &Index{
 		minKey: minKey,
 		maxKey: maxKey,
-		offset: uint64(offset),
+		offset: offset,
 		length: uint64(length),
 	})
-	if err := w.filterBlock.Add(uint64(offset), w.filter.Save()); err != nil {
+	if err := w.filterBlock.Add(offset, w.filter.Save()); err != nil {
 		return err
 	}
 	w.filter.Reset()
 	return nil
 }
+
+// Close 关闭文件：Write完成后提交文件，否则放弃写入
 func (w *SSTWriter) Close() error {
-	return w.dest.Close()
+	if !w.finished {
+		return w.Abandon()
+	}
+	return w.commit()
 }
@@ -0,0 +1,44 @@
+package sstable
+
+import (
+	"github.com/aixiasang/sqldb/config"
+)
+
+// Writer 按键的升序逐个添加键值对来构建SST文件，不需要先写入内存表。
+// 用于在LSM之外批量生成数据，再通过LSM.IngestExternalFiles导入
+type Writer struct {
+	sst *SSTWriter
+}
+
+// NewWriter 创建filename并返回写入器，conf应与导入的LSM(列族)的配置相同
+func NewWriter(filename string, conf *config.Config) (*Writer, error) {
+	sst, err := NewSSTWriter(filename, conf)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{sst: sst}, nil
+}
+
+// Add 添加键值对，键不能为空，且必须按utils.CompareBytes的顺序严格递增
+func (w *Writer) Add(key, value []byte) error {
+	return w.sst.Add(key, value)
+}
+
+// Count 返回已添加的键值对数量
+func (w *Writer) Count() int {
+	return w.sst.Count()
+}
+
+// Finish 写入索引和尾部，同步后生成文件，失败时删除临时文件
+func (w *Writer) Finish() error {
+	if err := w.sst.Finish(); err != nil {
+		w.sst.Abandon()
+		return err
+	}
+	return nil
+}
+
+// Abort 放弃写入，关闭并删除文件
+func (w *Writer) Abort() error {
+	return w.sst.Abandon()
+}
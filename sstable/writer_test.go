@@ -0,0 +1,143 @@
+package sstable
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+func TestWriter(t *testing.T) {
+	conf := config.NewConfig()
+	conf.BlockSize = 256
+	path := filepath.Join(t.TempDir(), "external.sst")
+
+	writer, err := NewWriter(path, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 100 {
+		if err := writer.Add(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Add(utils.GenerateKey(50), nil); !errors.Is(err, ErrKeyOrder) {
+		t.Fatalf("expected ErrKeyOrder, got %v", err)
+	}
+	if err := writer.Add(utils.GenerateKey(99), nil); !errors.Is(err, ErrKeyOrder) {
+		t.Fatalf("expected ErrKeyOrder for duplicate key, got %v", err)
+	}
+	if writer.Count() != 100 {
+		t.Fatalf("expected 100 entries, got %d", writer.Count())
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewSSTReader(path, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	iter := reader.Iterator()
+	var n int
+	for iter.First(); iter.Valid(); iter.Next() {
+		if string(iter.Key()) != string(utils.GenerateKey(n)) || string(iter.Value()) != string(utils.GenerateValue(n)) {
+			t.Fatalf("entry %d: %s=%s", n, iter.Key(), iter.Value())
+		}
+		n++
+	}
+	if n != 100 {
+		t.Fatalf("expected 100 entries, got %d", n)
+	}
+
+	// 放弃写入时删除文件
+	aborted := filepath.Join(t.TempDir(), "aborted.sst")
+	writer, err = NewWriter(aborted, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Add(utils.GenerateKey(1), utils.GenerateValue(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(aborted); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("aborted file still exists: %v", err)
+	}
+}
+
+func TestSSTWriter_Streaming(t *testing.T) {
+	conf := config.NewConfig()
+	conf.BlockSize = 4096
+	path := filepath.Join(t.TempDir(), "streaming.sst")
+
+	writer, err := NewSSTWriter(path, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 写满多个缓冲区后数据块已经写到文件中，而不是全部留在内存里
+	var n int
+	for ; writer.FileSize() < 4*writeBufferSize; n++ {
+		if err := writer.Add(utils.GenerateKey(n), utils.GenerateValue(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.Stat(path + TempFileSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() < 2*writeBufferSize {
+		t.Fatalf("expected data blocks to be written before Finish, file size %d", info.Size())
+	}
+	// 完成之前只有临时文件
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("final file should not exist before Finish: %v", err)
+	}
+	if err := writer.Add(utils.GenerateKey(0), nil); !errors.Is(err, ErrKeyOrder) {
+		t.Fatalf("expected ErrKeyOrder, got %v", err)
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + TempFileSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("temporary file should be renamed: %v", err)
+	}
+
+	reader, err := NewSSTReader(path, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if reader.Size() <= writer.FileSize() {
+		t.Fatalf("file size %d should include index and footer beyond data size %d", reader.Size(), writer.FileSize())
+	}
+	for _, i := range []int{0, n / 2, n - 1} {
+		value, ok, err := reader.Get(utils.GenerateKey(i))
+		if err != nil || !ok || string(value) != string(utils.GenerateValue(i)) {
+			t.Fatalf("key %d: value=%q, ok=%v, err=%v", i, value, ok, err)
+		}
+	}
+
+	// 放弃写入时删除文件
+	abandoned := filepath.Join(t.TempDir(), "abandoned.sst")
+	writer, err = NewSSTWriter(abandoned, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Add(utils.GenerateKey(1), utils.GenerateValue(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Abandon(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{abandoned, abandoned + TempFileSuffix} {
+		if _, err := os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("abandoned file %s still exists: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package lsm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+// LevelStats 单个层级的文件统计
+type LevelStats struct {
+	Level     int    // 层级
+	Files     int    // 文件数
+	Bytes     int64  // 文件总大小
+	Entries   uint64 // 文件中的键值对总数，来自各文件的属性
+	Deletions uint64 // 文件中的删除标记总数，来自各文件的属性
+}
+
+// Stats LSM运行状态的快照
+type Stats struct {
+	Levels []LevelStats // 各层级的文件统计
+
+	MemtableBytes          int64 // 可变内存表的大小
+	ImmutableMemtables     int   // 等待刷盘的不可变内存表数量
+	ImmutableMemtableBytes int64 // 不可变内存表的总大小
+	LatestSequence         uint64
+
+	KeysWritten  uint64                  // 写入的键数
+	BytesWritten uint64                  // 写入的用户数据字节数
+	PutTime      utils.HistogramSnapshot // 写入耗时
+	KeysRead     uint64                  // 读取的键数
+	KeysFound    uint64                  // 读取命中的键数
+	BytesRead    uint64                  // 读取返回的字节数
+	GetTime      utils.HistogramSnapshot // 读取耗时
+
+	WalBytes    uint64                  // 写入WAL的字节数
+	WalSyncs    uint64                  // WAL同步次数
+	WalSyncTime utils.HistogramSnapshot // WAL同步耗时
+
+	Flushes    uint64                  // 刷盘次数
+	FlushBytes uint64                  // 刷盘写入的字节数
+	FlushTime  utils.HistogramSnapshot // 刷盘耗时
+
+	Compactions          uint64                  // 合并次数
+	CompactionReadBytes  uint64                  // 合并读取的字节数
+	CompactionWriteBytes uint64                  // 合并写入的字节数
+	CompactionTime       utils.HistogramSnapshot // 合并耗时
+
+	// PendingCompactionBytes 估计需要合并才能使各层级回到阈值以内的字节数
+	PendingCompactionBytes int64
+
+	// WriteAmplification 写放大，刷盘和合并写入SST的字节数与用户写入字节数之比
+	WriteAmplification float64
+
+	BloomUseful        uint64 // 布隆过滤器排除的查询次数
+	BloomFalsePositive uint64 // 布隆过滤器误判次数
+
+	Stalls    uint64        // 写入停顿次数
+	StallTime time.Duration // 写入停顿的总时长
+
+	BlockCacheHits   uint64 // 块缓存命中次数
+	BlockCacheMisses uint64 // 块缓存未命中次数
+	BlockCacheBytes  int64  // 块缓存占用的字节数
+	BlockReadBytes   uint64 // 从文件读取的数据块字节数
+}
+
+// TotalFiles 返回所有层级的文件数
+func (s *Stats) TotalFiles() int {
+	total := 0
+	for _, level := range s.Levels {
+		total += level.Files
+	}
+	return total
+}
+
+// TotalBytes 返回所有层级的文件总大小
+func (s *Stats) TotalBytes() int64 {
+	var total int64
+	for _, level := range s.Levels {
+		total += level.Bytes
+	}
+	return total
+}
+
+// String 以多行文本输出统计信息
+func (s *Stats) String() string {
+	var b strings.Builder
+	b.WriteString("Level  Files  Entries    Deletions  Bytes\n")
+	var entries, deletions uint64
+	for _, level := range s.Levels {
+		fmt.Fprintf(&b, "L%-5d %-6d %-10d %-10d %d\n", level.Level, level.Files, level.Entries, level.Deletions, level.Bytes)
+		entries += level.Entries
+		deletions += level.Deletions
+	}
+	fmt.Fprintf(&b, "Sum    %-6d %-10d %-10d %d\n", s.TotalFiles(), entries, deletions, s.TotalBytes())
+	fmt.Fprintf(&b, "Memtable: active=%d bytes, immutable=%d (%d bytes)\n",
+		s.MemtableBytes, s.ImmutableMemtables, s.ImmutableMemtableBytes)
+	fmt.Fprintf(&b, "Writes: keys=%d, bytes=%d, wal=%d bytes, syncs=%d, seq=%d\n",
+		s.KeysWritten, s.BytesWritten, s.WalBytes, s.WalSyncs, s.LatestSequence)
+	fmt.Fprintf(&b, "Reads: keys=%d, found=%d, bytes=%d\n", s.KeysRead, s.KeysFound, s.BytesRead)
+	fmt.Fprintf(&b, "Flush: count=%d, bytes=%d, avg=%v, max=%v\n",
+		s.Flushes, s.FlushBytes, s.FlushTime.Average(), s.FlushTime.Max)
+	fmt.Fprintf(&b, "Compaction: count=%d, read=%d bytes, write=%d bytes, pending=%d bytes, avg=%v, max=%v\n",
+		s.Compactions, s.CompactionReadBytes, s.CompactionWriteBytes, s.PendingCompactionBytes,
+		s.CompactionTime.Average(), s.CompactionTime.Max)
+	fmt.Fprintf(&b, "Write amplification: %.2f\n", s.WriteAmplification)
+	fmt.Fprintf(&b, "Bloom: useful=%d, false positive=%d\n", s.BloomUseful, s.BloomFalsePositive)
+	fmt.Fprintf(&b, "Stall: count=%d, time=%v\n", s.Stalls, s.StallTime)
+	fmt.Fprintf(&b, "Block cache: hits=%d, misses=%d, usage=%d bytes, read=%d bytes\n",
+		s.BlockCacheHits, s.BlockCacheMisses, s.BlockCacheBytes, s.BlockReadBytes)
+	return b.String()
+}
+
+// Stats 返回当前运行状态的快照
+func (l *LSM) Stats() *Stats {
+	stats := l.conf.Statistics
+	s := &Stats{
+		KeysWritten:          stats.Get(utils.TickerKeysWritten),
+		BytesWritten:         stats.Get(utils.TickerBytesWritten),
+		PutTime:              stats.Histogram(utils.HistogramPutTime),
+		KeysRead:             stats.Get(utils.TickerKeysRead),
+		KeysFound:            stats.Get(utils.TickerKeysFound),
+		BytesRead:            stats.Get(utils.TickerBytesRead),
+		GetTime:              stats.Histogram(utils.HistogramGetTime),
+		WalBytes:             stats.Get(utils.TickerWalBytes),
+		WalSyncs:             stats.Get(utils.TickerWalSyncs),
+		WalSyncTime:          stats.Histogram(utils.HistogramWalSyncTime),
+		Flushes:              stats.Get(utils.TickerFlushes),
+		FlushBytes:           stats.Get(utils.TickerFlushBytes),
+		FlushTime:            stats.Histogram(utils.HistogramFlushTime),
+		Compactions:          stats.Get(utils.TickerCompactions),
+		CompactionReadBytes:  stats.Get(utils.TickerCompactionReadBytes),
+		CompactionWriteBytes: stats.Get(utils.TickerCompactionWriteBytes),
+		CompactionTime:       stats.Histogram(utils.HistogramCompactionTime),
+		BloomUseful:          stats.Get(utils.TickerBloomUseful),
+		BloomFalsePositive:   stats.Get(utils.TickerBloomFalsePositive),
+		Stalls:               stats.Get(utils.TickerStalls),
+		StallTime:            time.Duration(stats.Get(utils.TickerStallMicros)) * time.Microsecond,
+		BlockCacheHits:       stats.Get(utils.TickerBlockCacheHits),
+		BlockCacheMisses:     stats.Get(utils.TickerBlockCacheMisses),
+		BlockReadBytes:       stats.Get(utils.TickerBlockReadBytes),
+	}
+	if s.BytesWritten > 0 {
+		s.WriteAmplification = float64(s.FlushBytes+s.CompactionWriteBytes) / float64(s.BytesWritten)
+	}
+	if l.conf.BlockCache != nil {
+		s.BlockCacheBytes = l.conf.BlockCache.Size()
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	// 各层级和内存表的统计为所有列族之和，待合并的字节数按列族分别估计
+	s.Levels = make([]LevelStats, l.conf.MaxLevel)
+	for level := range s.Levels {
+		s.Levels[level].Level = level
+	}
+	for _, cf := range l.columnFamilies {
+		levels := columnFamilyLevels(cf)
+		for level, stats := range levels {
+			s.Levels[level].Files += stats.Files
+			s.Levels[level].Bytes += stats.Bytes
+			s.Levels[level].Entries += stats.Entries
+			s.Levels[level].Deletions += stats.Deletions
+		}
+		s.PendingCompactionBytes += l.pendingCompactionBytes(cf, levels)
+	}
+	s.MemtableBytes = int64(l.mutableSize())
+	s.ImmutableMemtables = len(l.immutableMemtables)
+	for _, immutable := range l.immutableMemtables {
+		s.ImmutableMemtableBytes += int64(immutable.size())
+	}
+	s.LatestSequence = l.seq
+	return s
+}
+
+// columnFamilyLevels 返回列族各层级的文件数量、大小以及键值对和删除标记的数量。调用方需持有锁
+func columnFamilyLevels(cf *ColumnFamily) []LevelStats {
+	levels := make([]LevelStats, len(cf.nodes))
+	for level, nodes := range cf.nodes {
+		levels[level].Level = level
+		levels[level].Files = len(nodes)
+		for _, node := range nodes {
+			levels[level].Bytes += node.Size()
+			props := node.Properties()
+			levels[level].Entries += props.NumEntries
+			levels[level].Deletions += props.NumDeletions
+		}
+	}
+	return levels
+}
+
+// pendingCompactionBytes 估计列族需要合并的字节数。分层合并为0层超过阈值的文件和各层超出上限的部分，
+// 通用合并为有序段过多时除最旧有序段外的总大小，FIFO合并为超出总大小上限的部分。调用方需持有锁
+func (l *LSM) pendingCompactionBytes(cf *ColumnFamily, levels []LevelStats) int64 {
+	var pending int64
+	if l.conf.CompactionStyle == config.CompactionStyleFIFO {
+		return max(levels[0].Bytes-l.conf.FIFOMaxTableFilesSize, 0)
+	}
+	if l.conf.CompactionStyle == config.CompactionStyleUniversal {
+		runs := l.sortedRuns(cf)
+		if len(runs) > l.conf.UniversalMaxSortedRuns {
+			for _, run := range runs[:len(runs)-1] {
+				pending += run.size
+			}
+		}
+		return pending
+	}
+	if levels[0].Files >= l.conf.Level0CompactionTrigger {
+		pending = levels[0].Bytes
+	}
+	for level := 1; level < len(levels)-1; level++ {
+		if excess := levels[level].Bytes - l.maxBytesForLevel(level); excess > 0 {
+			pending += excess
+		}
+	}
+	return pending
+}
+
+const (
+	propertyPrefix          = "sqldb."
+	propertyNumFilesAtLevel = propertyPrefix + "num-files-at-level"
+	propertyBytesAtLevel    = propertyPrefix + "bytes-at-level"
+	propertyStats           = propertyPrefix + "stats"
+)
+
+// properties 支持的属性及其取值方式
+var properties = map[string]func(s *Stats) string{
+	propertyPrefix + "total-sst-files-size":              func(s *Stats) string { return strconv.FormatInt(s.TotalBytes(), 10) },
+	propertyPrefix + "num-files":                         func(s *Stats) string { return strconv.Itoa(s.TotalFiles()) },
+	propertyPrefix + "cur-size-active-mem-table":         func(s *Stats) string { return strconv.FormatInt(s.MemtableBytes, 10) },
+	propertyPrefix + "cur-size-all-mem-tables":           func(s *Stats) string { return strconv.FormatInt(s.MemtableBytes+s.ImmutableMemtableBytes, 10) },
+	propertyPrefix + "num-immutable-mem-table":           func(s *Stats) string { return strconv.Itoa(s.ImmutableMemtables) },
+	propertyPrefix + "latest-sequence-number":            func(s *Stats) string { return strconv.FormatUint(s.LatestSequence, 10) },
+	propertyPrefix + "bytes-written":                     func(s *Stats) string { return strconv.FormatUint(s.BytesWritten, 10) },
+	propertyPrefix + "bytes-read":                        func(s *Stats) string { return strconv.FormatUint(s.BytesRead, 10) },
+	propertyPrefix + "wal-bytes":                         func(s *Stats) string { return strconv.FormatUint(s.WalBytes, 10) },
+	propertyPrefix + "num-flushes":                       func(s *Stats) string { return strconv.FormatUint(s.Flushes, 10) },
+	propertyPrefix + "flush-bytes":                       func(s *Stats) string { return strconv.FormatUint(s.FlushBytes, 10) },
+	propertyPrefix + "num-compactions":                   func(s *Stats) string { return strconv.FormatUint(s.Compactions, 10) },
+	propertyPrefix + "estimate-pending-compaction-bytes": func(s *Stats) string { return strconv.FormatInt(s.PendingCompactionBytes, 10) },
+	propertyPrefix + "compaction-bytes-written":          func(s *Stats) string { return strconv.FormatUint(s.CompactionWriteBytes, 10) },
+	propertyPrefix + "write-amplification":               func(s *Stats) string { return strconv.FormatFloat(s.WriteAmplification, 'f', 2, 64) },
+	propertyPrefix + "bloom-filter-useful":               func(s *Stats) string { return strconv.FormatUint(s.BloomUseful, 10) },
+	propertyPrefix + "bloom-filter-false-positive":       func(s *Stats) string { return strconv.FormatUint(s.BloomFalsePositive, 10) },
+	propertyPrefix + "stall-micros":                      func(s *Stats) string { return strconv.FormatInt(s.StallTime.Microseconds(), 10) },
+	propertyPrefix + "block-cache-hit":                   func(s *Stats) string { return strconv.FormatUint(s.BlockCacheHits, 10) },
+	propertyPrefix + "block-cache-miss":                  func(s *Stats) string { return strconv.FormatUint(s.BlockCacheMisses, 10) },
+	propertyPrefix + "block-cache-usage":                 func(s *Stats) string { return strconv.FormatInt(s.BlockCacheBytes, 10) },
+	propertyStats:                                        func(s *Stats) string { return s.String() },
+}
+
+// GetProperty 返回名为name的属性值，属性不存在时ok为false。
+// 按层级的属性在名称后追加层级编号，例如"sqldb.num-files-at-level0"
+func (l *LSM) GetProperty(name string) (string, bool) {
+	if fn, ok := properties[name]; ok {
+		return fn(l.Stats()), true
+	}
+	for _, prefix := range []string{propertyNumFilesAtLevel, propertyBytesAtLevel} {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		level, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+		if err != nil || level < 0 || level >= l.conf.MaxLevel {
+			return "", false
+		}
+		s := l.Stats().Levels[level]
+		if prefix == propertyNumFilesAtLevel {
+			return strconv.Itoa(s.Files), true
+		}
+		return strconv.FormatInt(s.Bytes, 10), true
+	}
+	return "", false
+}
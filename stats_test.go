@@ -0,0 +1,162 @@
+package lsm
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+func TestLsmStats(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+	conf.BlockCache = utils.NewBlockCache(8 << 20)
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	// 只写入偶数键，奇数键落在SST的键范围内但不存在
+	dataCount := 100
+	for i := 0; i < dataCount; i++ {
+		if err := lsm.Put(utils.GenerateKey(2*i), utils.GenerateValue(2*i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(1500 * time.Millisecond)
+	for round := 0; round < 2; round++ {
+		for i := 0; i < dataCount; i++ {
+			if _, _, err := lsm.Get(utils.GenerateKey(2 * i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// 不存在的键由布隆过滤器排除
+	for i := 0; i < dataCount; i++ {
+		if _, found, _ := lsm.Get(utils.GenerateKey(2*i + 1)); found {
+			t.Fatalf("unexpected key %d", i)
+		}
+	}
+
+	stats := lsm.Stats()
+	if stats.KeysWritten != uint64(dataCount) || stats.BytesWritten == 0 {
+		t.Fatalf("unexpected write stats: keys=%d, bytes=%d", stats.KeysWritten, stats.BytesWritten)
+	}
+	if stats.KeysRead != uint64(3*dataCount) || stats.KeysFound != uint64(2*dataCount) {
+		t.Fatalf("unexpected read stats: keys=%d, found=%d", stats.KeysRead, stats.KeysFound)
+	}
+	if stats.WalBytes == 0 {
+		t.Fatal("expected wal bytes")
+	}
+	if stats.Flushes == 0 || stats.FlushBytes == 0 || stats.FlushTime.Count != stats.Flushes {
+		t.Fatalf("unexpected flush stats: %+v", stats)
+	}
+	if stats.TotalFiles() == 0 || stats.TotalBytes() == 0 {
+		t.Fatalf("expected sst files: %+v", stats.Levels)
+	}
+	// 刷盘生成的0层文件超过阈值后合并到1层
+	if stats.Compactions == 0 || stats.CompactionWriteBytes == 0 || stats.Levels[1].Files == 0 {
+		t.Fatalf("unexpected compaction stats: count=%d, write=%d, levels=%+v",
+			stats.Compactions, stats.CompactionWriteBytes, stats.Levels)
+	}
+	if stats.WriteAmplification <= 0 {
+		t.Fatalf("expected write amplification, got %f", stats.WriteAmplification)
+	}
+	if stats.BlockCacheHits == 0 || stats.BlockCacheMisses == 0 {
+		t.Fatalf("unexpected block cache stats: hits=%d, misses=%d", stats.BlockCacheHits, stats.BlockCacheMisses)
+	}
+	if stats.BloomUseful == 0 {
+		t.Fatal("expected bloom filter to exclude missing keys")
+	}
+
+	value, ok := lsm.GetProperty("sqldb.num-files-at-level0")
+	if !ok || value != strconv.Itoa(lsm.Stats().Levels[0].Files) {
+		t.Fatalf("unexpected num-files-at-level0: %q", value)
+	}
+	if _, ok := lsm.GetProperty("sqldb.num-files-at-level99"); ok {
+		t.Fatal("expected unknown level")
+	}
+	if _, ok := lsm.GetProperty("sqldb.unknown"); ok {
+		t.Fatal("expected unknown property")
+	}
+	if value, ok := lsm.GetProperty("sqldb.stats"); !ok || value == "" {
+		t.Fatal("expected stats property")
+	}
+}
+
+func TestLsmWriteStall(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 64
+	conf.MaxImmutableMemtables = 1
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 50; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+		lsm.mu.RLock()
+		immCount := len(lsm.immutableMemtables)
+		lsm.mu.RUnlock()
+		if immCount > conf.MaxImmutableMemtables {
+			t.Fatalf("expected at most %d immutable memtables, got %d", conf.MaxImmutableMemtables, immCount)
+		}
+	}
+	if stats := lsm.Stats(); stats.Stalls == 0 {
+		t.Fatal("expected write stalls")
+	}
+	for i := 0; i < 50; i++ {
+		value, found, err := lsm.Get(utils.GenerateKey(i))
+		if err != nil || !found || string(value) != string(utils.GenerateValue(i)) {
+			t.Fatalf("key %d not match: found=%v, err=%v", i, found, err)
+		}
+	}
+}
+
+func TestLsmTableProperties(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.Level0CompactionTrigger = 100
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := lsm.Delete(utils.GenerateKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Flush(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// 删除标记覆盖内存表中的写入，刷盘后的文件有10个键值对，其中3个是删除标记
+	level0 := lsm.Stats().Levels[0]
+	if level0.Files != 1 || level0.Entries != 10 || level0.Deletions != 3 {
+		t.Fatalf("unexpected level 0 stats: %+v", level0)
+	}
+	lsm.mu.RLock()
+	props := lsm.defaultCF.nodes[0][0].Properties()
+	lsm.mu.RUnlock()
+	if string(props.SmallestKey) != string(utils.GenerateKey(0)) || string(props.LargestKey) != string(utils.GenerateKey(9)) {
+		t.Fatalf("unexpected properties: %s", props)
+	}
+}
@@ -0,0 +1,134 @@
+package lsm
+
+const (
+	compactionReasonUniversalSizeAmp   = "universal-size-amplification"
+	compactionReasonUniversalSizeRatio = "universal-size-ratio"
+	compactionReasonUniversalRuns      = "universal-sorted-runs"
+)
+
+// sortedRun 通用合并中的一个有序段：0层的单个文件，或1层及以上的一个非空层级
+type sortedRun struct {
+	level int
+	nodes []*Node
+	size  int64
+	busy  bool // 正在被合并，或者是进行中的合并的输出层级
+}
+
+// sortedRuns 按从新到旧的顺序返回列族的所有有序段。调用方需持有锁
+func (l *LSM) sortedRuns(cf *ColumnFamily) []*sortedRun {
+	outputs := make(map[int]bool, len(l.runningCompactions))
+	for _, c := range l.runningCompactions {
+		if c.cf == cf {
+			outputs[c.outputLevel] = true
+		}
+	}
+
+	runs := make([]*sortedRun, 0, len(cf.nodes[0])+len(cf.nodes)-1)
+	for i := len(cf.nodes[0]) - 1; i >= 0; i-- {
+		node := cf.nodes[0][i]
+		runs = append(runs, &sortedRun{level: 0, nodes: []*Node{node}, size: node.Size(), busy: node.compacting})
+	}
+	for level := 1; level < len(cf.nodes); level++ {
+		nodes := cf.nodes[level]
+		if len(nodes) == 0 && !outputs[level] {
+			continue
+		}
+		run := &sortedRun{level: level, nodes: nodes, busy: outputs[level] || anyCompacting(nodes)}
+		for _, node := range nodes {
+			run.size += node.Size()
+		}
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// pickUniversalCompaction 有序段数量超过UniversalMaxSortedRuns时，依次尝试按空间放大、
+// 大小比例和有序段数量选择一组相邻的有序段合并。调用方需持有写锁
+func (l *LSM) pickUniversalCompaction(cf *ColumnFamily) *compaction {
+	runs := l.sortedRuns(cf)
+	if len(runs) <= l.conf.UniversalMaxSortedRuns {
+		return nil
+	}
+
+	// 1. 较新的有序段相对最旧有序段过大时全部合并，控制空间放大
+	var newer int64
+	for _, run := range runs[:len(runs)-1] {
+		newer += run.size
+	}
+	if oldest := runs[len(runs)-1].size; oldest > 0 &&
+		newer*100 > oldest*int64(l.conf.UniversalMaxSizeAmplificationPercent) {
+		if c := l.universalCompaction(cf, runs, 0, len(runs)-1); c != nil {
+			c.reason = compactionReasonUniversalSizeAmp
+			return c
+		}
+	}
+
+	// 2. 从较新的有序段开始，合并大小相近的连续有序段
+	for i := 0; i < len(runs)-1; i++ {
+		if runs[i].busy {
+			continue
+		}
+		total, j := runs[i].size, i
+		for j+1 < len(runs) && !runs[j+1].busy &&
+			runs[j+1].size*100 <= total*int64(100+l.conf.UniversalSizeRatio) {
+			j++
+			total += runs[j].size
+		}
+		if j > i {
+			if c := l.universalCompaction(cf, runs, i, j); c != nil {
+				c.reason = compactionReasonUniversalSizeRatio
+				return c
+			}
+		}
+	}
+
+	// 3. 合并最新的若干有序段，使数量回到上限以内
+	width := len(runs) - l.conf.UniversalMaxSortedRuns + 1
+	for i := 0; i+width <= len(runs); i++ {
+		if c := l.universalCompaction(cf, runs, i, i+width-1); c != nil {
+			c.reason = compactionReasonUniversalRuns
+			return c
+		}
+	}
+	return nil
+}
+
+// universalCompaction 合并有序段runs[i..j]，输出层级必须比所有未参与合并的较新有序段更旧、
+// 比较旧的有序段更新，必要时向更旧的方向扩展。存在冲突时返回nil
+func (l *LSM) universalCompaction(cf *ColumnFamily, runs []*sortedRun, i, j int) *compaction {
+	// 0层文件只能整体向下移动，较旧的0层文件必须一起合并
+	for runs[j].level == 0 && j+1 < len(runs) && runs[j+1].level == 0 {
+		j++
+	}
+
+	outputLevel := runs[j].level
+	if outputLevel == 0 {
+		next := len(cf.nodes)
+		if j+1 < len(runs) {
+			next = runs[j+1].level
+		}
+		outputLevel = next - 1
+		if outputLevel < 1 {
+			// 1层已被更旧的有序段占用，一起合并
+			if j+1 >= len(runs) {
+				return nil
+			}
+			j++
+			outputLevel = runs[j].level
+		}
+	}
+
+	c := &compaction{cf: cf, level: runs[i].level, outputLevel: outputLevel}
+	for _, run := range runs[i : j+1] {
+		if run.busy {
+			return nil
+		}
+		c.inputs = append(c.inputs, run.nodes...)
+	}
+	if len(c.inputs) == 0 {
+		return nil
+	}
+	c.smallest, c.largest = keyRange(c.inputs)
+	c.bottommost = isBottommost(cf, c.outputLevel, c.smallest, c.largest)
+	return c
+}
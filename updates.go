@@ -0,0 +1,199 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/aixiasang/sqldb/wal"
+)
+
+// UpdateBatch 一次提交的写入批次
+type UpdateBatch struct {
+	Seq     uint64        // 批次中第一条记录的序列号
+	Records []*wal.Record // 批次中的记录，ColumnFamily为所属列族的ID
+}
+
+// updateLog 待读取的WAL，可能位于WAL目录或归档目录
+type updateLog struct {
+	logNum uint32
+	paths  []string // 候选路径，依次尝试
+}
+
+// UpdatesIterator 按序列号顺序遍历活跃WAL和归档WAL中已提交的写入批次。
+// 读到当前WAL的末尾即结束，调用方可从最后一个批次的序列号之后重新获取
+type UpdatesIterator struct {
+	logs    []*updateLog // 尚未读取的WAL，按日志编号升序
+	seq     uint64       // 起始序列号
+	fp      *os.File     // 当前读取的文件
+	reader  *wal.Reader  // 当前WAL的读取器
+	batch   *UpdateBatch // 当前批次
+	started bool         // 是否已返回过批次
+	err     error
+}
+
+// GetUpdatesSince 返回从序列号seq(含)开始的写入批次迭代器
+func (l *LSM) GetUpdatesSince(seq uint64) (*UpdatesIterator, error) {
+	if l.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	logNums := make(map[uint32]struct{})
+	if l.archiveEnabled() {
+		archived, err := l.listArchivedWals()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range archived {
+			logNums[a.logNum] = struct{}{}
+		}
+	}
+	l.mu.RLock()
+	for _, immutable := range l.immutableMemtables {
+		if immutable.wal != nil {
+			logNums[immutable.wal.LogNum()] = struct{}{}
+		}
+	}
+	if l.currWal != nil {
+		logNums[l.currWal.LogNum()] = struct{}{}
+	}
+	l.mu.RUnlock()
+
+	logs := make([]*updateLog, 0, len(logNums))
+	for logNum := range logNums {
+		paths := []string{l.getWalPath(logNum)}
+		if l.archiveEnabled() {
+			paths = append(paths, l.getArchivedWalPath(logNum))
+		}
+		logs = append(logs, &updateLog{logNum: logNum, paths: paths})
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].logNum < logs[j].logNum
+	})
+
+	// 从最后一个起始序列号不大于seq的WAL开始读取，跳过更早的WAL
+	start := 0
+	for i := len(logs) - 1; i >= 0; i-- {
+		firstSeq, ok, err := readFirstSeq(logs[i])
+		if err != nil {
+			return nil, err
+		}
+		if ok && firstSeq <= seq {
+			start = i
+			break
+		}
+	}
+	return &UpdatesIterator{logs: logs[start:], seq: seq}, nil
+}
+
+// Next 移动到下一个批次，没有更多批次或出错时返回false
+func (it *UpdatesIterator) Next() bool {
+	for it.err == nil {
+		if it.reader == nil {
+			if len(it.logs) == 0 {
+				return false
+			}
+			fp, err := openUpdateLog(it.logs[0])
+			if err != nil {
+				it.err = err
+				return false
+			}
+			it.fp = fp
+			it.reader = wal.NewReader(fp, it.logs[0].logNum)
+			it.logs = it.logs[1:]
+		}
+
+		if it.reader.Next() {
+			rec := it.reader.Record()
+			if rec.Seq < it.seq {
+				continue
+			}
+			// 第一个批次的序列号不连续，说明中间的WAL已经被删除
+			if !it.started && rec.Seq > max(it.seq, 1) {
+				it.err = fmt.Errorf("%w: want seq %d, oldest available %d", ErrUpdatesUnavailable, it.seq, rec.Seq)
+				return false
+			}
+			it.started = true
+			it.batch = &UpdateBatch{Seq: rec.Seq, Records: []*wal.Record{rec}}
+			if rec.RecordType == wal.RecordTypeBatch {
+				records, err := rec.BatchRecords()
+				if err != nil {
+					it.err = err
+					return false
+				}
+				it.batch.Records = records
+			}
+			return true
+		}
+
+		// 末尾不完整的记录可能正在写入，视为该WAL的结尾
+		if err := it.reader.Err(); err != nil && !errors.Is(err, wal.ErrTruncated) {
+			it.err = err
+		}
+		it.closeLog()
+	}
+	return false
+}
+
+// Batch 返回当前批次
+func (it *UpdatesIterator) Batch() *UpdateBatch {
+	return it.batch
+}
+
+// Err 返回遍历过程中遇到的错误
+func (it *UpdatesIterator) Err() error {
+	return it.err
+}
+
+// Close 释放迭代器持有的文件
+func (it *UpdatesIterator) Close() error {
+	it.logs = nil
+	return it.closeLog()
+}
+
+func (it *UpdatesIterator) closeLog() error {
+	it.reader = nil
+	if it.fp == nil {
+		return nil
+	}
+	err := it.fp.Close()
+	it.fp = nil
+	return err
+}
+
+// openUpdateLog 依次尝试WAL的候选路径，文件在活跃目录和归档目录之间移动时也能打开
+func openUpdateLog(log *updateLog) (*os.File, error) {
+	for _, path := range log.paths {
+		fp, err := os.Open(path)
+		if err == nil {
+			return fp, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: log %d", ErrUpdatesUnavailable, log.logNum)
+}
+
+// readFirstSeq 读取WAL中第一条记录的序列号，WAL为空时ok为false
+func readFirstSeq(log *updateLog) (uint64, bool, error) {
+	fp, err := openUpdateLog(log)
+	if err != nil {
+		// 已被回收的WAL留到真正读取时再报错
+		if errors.Is(err, ErrUpdatesUnavailable) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	defer fp.Close()
+
+	reader := wal.NewReader(fp, log.logNum)
+	if reader.Next() {
+		return reader.Record().Seq, true, nil
+	}
+	if err := reader.Err(); err != nil && !errors.Is(err, wal.ErrTruncated) {
+		return 0, false, err
+	}
+	return 0, false, nil
+}
@@ -0,0 +1,184 @@
+package lsm
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+func collectUpdates(t *testing.T, l *LSM, seq uint64) []*UpdateBatch {
+	iter, err := l.GetUpdatesSince(seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	batches := make([]*UpdateBatch, 0)
+	for iter.Next() {
+		batches = append(batches, iter.Batch())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return batches
+}
+
+func TestGetUpdatesSince(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+	conf.WalArchiveDir = "archive"
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataCount := 100
+	for i := 0; i < dataCount; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 等待内存表刷盘，使部分WAL进入归档目录
+	time.Sleep(1500 * time.Millisecond)
+
+	archived, err := lsm.listArchivedWals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) == 0 {
+		t.Fatal("expected archived wal files")
+	}
+
+	batches := collectUpdates(t, lsm, 1)
+	if len(batches) != dataCount {
+		t.Fatalf("expected %d batches, got %d", dataCount, len(batches))
+	}
+	for i, batch := range batches {
+		if batch.Seq != uint64(i+1) {
+			t.Fatalf("expected seq %d, got %d", i+1, batch.Seq)
+		}
+		if string(batch.Records[0].Key) != string(utils.GenerateKey(i)) {
+			t.Fatalf("key not match: %s", batch.Records[0].Key)
+		}
+	}
+
+	batches = collectUpdates(t, lsm, 60)
+	if len(batches) != dataCount-59 || batches[0].Seq != 60 {
+		t.Fatalf("expected updates since 60, got %d batches", len(batches))
+	}
+
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后序列号从归档和WAL中恢复
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	if seq := lsm.LatestSequenceNumber(); seq != uint64(dataCount) {
+		t.Fatalf("expected latest seq %d, got %d", dataCount, seq)
+	}
+}
+
+func TestWalArchivePurge(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.MemTableCapSize = 256
+	conf.WalArchiveDir = "archive"
+	conf.WalArchiveSizeLimit = 1024
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for i := 0; i < 200; i++ {
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(1500 * time.Millisecond)
+
+	archived, err := lsm.listArchivedWals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var totalSize int64
+	for _, a := range archived {
+		totalSize += a.size
+	}
+	if totalSize > conf.WalArchiveSizeLimit {
+		t.Fatalf("archive size %d exceeds limit %d", totalSize, conf.WalArchiveSizeLimit)
+	}
+
+	// 最早的更新已被清理
+	iter, err := lsm.GetUpdatesSince(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	for iter.Next() {
+	}
+	if !errors.Is(iter.Err(), ErrUpdatesUnavailable) {
+		t.Fatalf("expected updates unavailable, got %v", iter.Err())
+	}
+}
+
+func TestWalArchiveTTL(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1700000000, 0)}
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	conf.Clock = clock
+	conf.WalArchiveDir = "archive"
+	conf.WalArchiveTTL = time.Hour
+
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	archiveFlush := func(i int) {
+		t.Helper()
+		if err := lsm.Put(utils.GenerateKey(i), utils.GenerateValue(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := lsm.Flush(true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitArchived := func(done func(archived []*archivedWal) bool) []*archivedWal {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			archived, err := lsm.listArchivedWals()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if done(archived) || time.Now().After(deadline) {
+				return archived
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	archiveFlush(0)
+	archived := waitArchived(func(archived []*archivedWal) bool { return len(archived) == 1 })
+	if len(archived) != 1 || !archived[0].modTime.Equal(clock.Now()) {
+		t.Fatalf("unexpected archive: %+v", archived)
+	}
+
+	// 超过保留时长后，下一次归档时清理较早的归档
+	clock.Advance(2 * time.Hour)
+	archiveFlush(1)
+	archived = waitArchived(func(archived []*archivedWal) bool {
+		return len(archived) == 1 && archived[0].logNum == 1
+	})
+	if len(archived) != 1 || archived[0].logNum != 1 {
+		t.Fatalf("expected only the newest archive, got %+v", archived)
+	}
+}
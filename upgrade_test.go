@@ -0,0 +1,48 @@
+package lsm
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aixiasang/sqldb/config"
+	"github.com/aixiasang/sqldb/utils"
+)
+
+// testdata/baseline 由上一个发布版本写入：SST中的值没有类型前缀，WAL是旧格式的记录，没有清单
+func TestLsmOpenBaseline(t *testing.T) {
+	conf := config.NewConfig()
+	conf.DataDir = t.TempDir()
+	if err := os.CopyFS(conf.DataDir, os.DirFS("testdata/baseline")); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(lsm *LSM) {
+		t.Helper()
+		for i := 0; i < 200; i++ {
+			value, found, err := lsm.Get(utils.GenerateKey(i))
+			if err != nil || !found || string(value) != string(utils.GenerateValue(i)) {
+				t.Fatalf("key %d: value=%q, found=%v, err=%v", i, value, found, err)
+			}
+		}
+	}
+	lsm, err := NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(lsm)
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开时按清单加载，合并后旧文件被改写为带类型前缀的新格式
+	lsm, err = NewLSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	check(lsm)
+	if err := lsm.CompactRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	check(lsm)
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// BlockCacheKey 缓存键，由文件的缓存ID和数据块偏移量组成
+type BlockCacheKey struct {
+	ID     uint64
+	Offset uint64
+}
+
+type blockCacheEntry struct {
+	key   BlockCacheKey
+	value []byte
+}
+
+// BlockCache 按字节容量淘汰的LRU数据块缓存，可在多个SST文件之间共享
+type BlockCache struct {
+	capacity int64
+	size     int64
+	nextID   atomic.Uint64
+	ll       *list.List
+	items    map[BlockCacheKey]*list.Element
+	mu       sync.Mutex
+}
+
+// NewBlockCache 创建容量为capacity字节的块缓存
+func NewBlockCache(capacity int64) *BlockCache {
+	return &BlockCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[BlockCacheKey]*list.Element),
+	}
+}
+
+// NewID 为新打开的文件分配缓存ID，重新打开的文件使用新的ID，旧数据块随LRU淘汰
+func (c *BlockCache) NewID() uint64 {
+	return c.nextID.Add(1)
+}
+
+// Get 查找数据块，命中时将其移到队头
+func (c *BlockCache) Get(key BlockCacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*blockCacheEntry).value, true
+}
+
+// Put 插入数据块，超出容量时淘汰最久未使用的数据块。value插入后不应再被修改
+func (c *BlockCache) Put(key BlockCacheKey, value []byte) {
+	if int64(len(value)) > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*blockCacheEntry)
+		c.size += int64(len(value) - len(entry.value))
+		entry.value = value
+		c.ll.MoveToFront(elem)
+	} else {
+		c.items[key] = c.ll.PushFront(&blockCacheEntry{key: key, value: value})
+		c.size += int64(len(value))
+	}
+	for c.size > c.capacity {
+		back := c.ll.Back()
+		entry := back.Value.(*blockCacheEntry)
+		c.ll.Remove(back)
+		delete(c.items, entry.key)
+		c.size -= int64(len(entry.value))
+	}
+}
+
+// Size 返回缓存中数据块的总字节数
+func (c *BlockCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Capacity 返回缓存容量
+func (c *BlockCache) Capacity() int64 {
+	return c.capacity
+}
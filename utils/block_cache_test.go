@@ -0,0 +1,32 @@
+package utils
+
+import "testing"
+
+func TestBlockCache_Evict(t *testing.T) {
+	cache := NewBlockCache(30)
+	id := cache.NewID()
+	for i := uint64(0); i < 3; i++ {
+		cache.Put(BlockCacheKey{ID: id, Offset: i}, make([]byte, 10))
+	}
+	// 访问第0块，使第1块成为最久未使用的数据块
+	if _, ok := cache.Get(BlockCacheKey{ID: id, Offset: 0}); !ok {
+		t.Fatal("expected block 0 cached")
+	}
+	cache.Put(BlockCacheKey{ID: id, Offset: 3}, make([]byte, 10))
+	if _, ok := cache.Get(BlockCacheKey{ID: id, Offset: 1}); ok {
+		t.Fatal("expected block 1 evicted")
+	}
+	for _, offset := range []uint64{0, 2, 3} {
+		if _, ok := cache.Get(BlockCacheKey{ID: id, Offset: offset}); !ok {
+			t.Fatalf("expected block %d cached", offset)
+		}
+	}
+	if cache.Size() != 30 {
+		t.Fatalf("expected size 30, got %d", cache.Size())
+	}
+	// 超过容量的数据块不缓存
+	cache.Put(BlockCacheKey{ID: cache.NewID(), Offset: 0}, make([]byte, 31))
+	if cache.Size() != 30 {
+		t.Fatalf("expected size 30, got %d", cache.Size())
+	}
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// histogramBounds 直方图各桶的上界，最后一个桶之后的耗时计入溢出桶
+var histogramBounds = [...]time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Histogram 按固定桶统计耗时分布，并发安全
+type Histogram struct {
+	sum     atomic.Int64
+	max     atomic.Int64
+	buckets [len(histogramBounds) + 1]atomic.Uint64
+}
+
+// HistogramBucket 直方图的一个桶，Count为耗时不超过UpperBound的累计次数
+type HistogramBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// HistogramSnapshot 直方图的快照
+type HistogramSnapshot struct {
+	Count   uint64            // 记录次数，等于包括溢出桶在内的各桶之和
+	Sum     time.Duration     // 总耗时
+	Max     time.Duration     // 最大耗时
+	Buckets []HistogramBucket // 各桶的累计次数，不含溢出桶
+}
+
+// Record 记录一次耗时
+func (h *Histogram) Record(d time.Duration) {
+	i := 0
+	for i < len(histogramBounds) && d > histogramBounds[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.sum.Add(int64(d))
+	for {
+		old := h.max.Load()
+		if int64(d) <= old || h.max.CompareAndSwap(old, int64(d)) {
+			break
+		}
+	}
+}
+
+// Snapshot 返回当前的统计快照。Count由读取到的各桶累加得到，并发记录时也不小于任何一个桶的累计次数
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	snapshot := HistogramSnapshot{
+		Sum:     time.Duration(h.sum.Load()),
+		Max:     time.Duration(h.max.Load()),
+		Buckets: make([]HistogramBucket, len(histogramBounds)),
+	}
+	var cumulative uint64
+	for i, bound := range histogramBounds {
+		cumulative += h.buckets[i].Load()
+		snapshot.Buckets[i] = HistogramBucket{UpperBound: bound, Count: cumulative}
+	}
+	snapshot.Count = cumulative + h.buckets[len(histogramBounds)].Load()
+	return snapshot
+}
+
+// Average 返回平均耗时
+func (s HistogramSnapshot) Average() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
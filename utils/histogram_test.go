@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHistogram_SnapshotConsistent(t *testing.T) {
+	h := &Histogram{}
+	h.Record(time.Minute)
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					h.Record(time.Duration(i) * 20 * time.Second)
+				}
+			}
+		}(i)
+	}
+	// 并发记录时，总次数不能小于任何一个桶的累计次数，各桶的累计次数不能减小
+	for n := 0; n < 1000; n++ {
+		s := h.Snapshot()
+		for i := 1; i < len(s.Buckets); i++ {
+			if s.Buckets[i].Count < s.Buckets[i-1].Count {
+				t.Fatalf("bucket %d decreased: %+v", i, s.Buckets)
+			}
+		}
+		if last := s.Buckets[len(s.Buckets)-1].Count; s.Count < last {
+			t.Fatalf("count %d below last bucket %d", s.Count, last)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	s := h.Snapshot()
+	if s.Count == 0 || s.Max != time.Minute {
+		t.Fatalf("unexpected snapshot: count=%d, max=%v", s.Count, s.Max)
+	}
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Ticker 累加计数器的编号
+type Ticker int
+
+const (
+	TickerKeysWritten          Ticker = iota // 写入的键数
+	TickerBytesWritten                       // 写入的用户数据字节数
+	TickerKeysRead                           // 读取的键数
+	TickerKeysFound                          // 读取命中的键数
+	TickerBytesRead                          // 读取返回的字节数
+	TickerWalBytes                           // 写入WAL的字节数
+	TickerWalSyncs                           // WAL同步次数
+	TickerFlushes                            // 内存表刷盘次数
+	TickerFlushBytes                         // 刷盘写入SST的字节数
+	TickerCompactions                        // SST合并次数
+	TickerCompactionReadBytes                // 合并读取的字节数
+	TickerCompactionWriteBytes               // 合并写入的字节数
+	TickerBloomUseful                        // 布隆过滤器排除的查询次数
+	TickerBloomFalsePositive                 // 布隆过滤器判定存在但实际不存在的次数
+	TickerBlockCacheHits                     // 块缓存命中次数
+	TickerBlockCacheMisses                   // 块缓存未命中次数
+	TickerBlockReadBytes                     // 从文件读取的数据块字节数
+	TickerStalls                             // 写入停顿次数
+	TickerStallMicros                        // 写入停顿的总时长(微秒)
+	tickerCount
+)
+
+// HistogramType 耗时直方图的编号
+type HistogramType int
+
+const (
+	HistogramFlushTime      HistogramType = iota // 内存表刷盘耗时
+	HistogramCompactionTime                      // SST合并耗时
+	HistogramWalSyncTime                         // WAL同步耗时
+	HistogramPutTime                             // 写入耗时
+	HistogramGetTime                             // 读取耗时
+	histogramCount
+)
+
+// Statistics 引擎内部的统计信息，所有方法都是并发安全的。
+// nil值的Statistics丢弃所有统计，单独使用sstable或wal时无需初始化
+type Statistics struct {
+	tickers    [tickerCount]atomic.Uint64
+	histograms [histogramCount]Histogram
+}
+
+// NewStatistics 创建统计信息
+func NewStatistics() *Statistics {
+	return &Statistics{}
+}
+
+// Add 将计数器t增加n
+func (s *Statistics) Add(t Ticker, n uint64) {
+	if s == nil {
+		return
+	}
+	s.tickers[t].Add(n)
+}
+
+// Get 返回计数器t的当前值
+func (s *Statistics) Get(t Ticker) uint64 {
+	if s == nil {
+		return 0
+	}
+	return s.tickers[t].Load()
+}
+
+// Record 在直方图h中记录一次耗时
+func (s *Statistics) Record(h HistogramType, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.histograms[h].Record(d)
+}
+
+// Histogram 返回直方图h的快照
+func (s *Statistics) Histogram(h HistogramType) HistogramSnapshot {
+	if s == nil {
+		return HistogramSnapshot{}
+	}
+	return s.histograms[h].Snapshot()
+}
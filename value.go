@@ -0,0 +1,241 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/aixiasang/sqldb/wal"
+)
+
+// valueKind 内存表和SST中保存的值的类型，编码在值的第一个字节
+type valueKind byte
+
+const (
+	kindValue          valueKind = iota // 普通值
+	kindDeletion                        // 删除标记，遮蔽更低层级中的旧值，合并到最底层时丢弃
+	kindMerge                           // 合并操作数列表，读取时与更低层级中的值一起解析
+	kindExpiringValue                   // 带过期时间的值，8字节过期时间(Unix纳秒)后接用户值，过期后视为删除标记
+	kindSingleDeletion                  // 单删除标记，读取时与删除标记相同，合并时与紧接着的一次写入相互抵消
+)
+
+const expiresAtLength = 8 // 过期时间的长度
+
+// encodeValue 在用户值前加上类型
+func encodeValue(kind valueKind, value []byte) []byte {
+	buf := make([]byte, 1+len(value))
+	buf[0] = byte(kind)
+	copy(buf[1:], value)
+	return buf
+}
+
+// decodeValue 拆分出值的类型和用户值
+func decodeValue(raw []byte) (valueKind, []byte) {
+	if len(raw) == 0 {
+		return kindValue, nil
+	}
+	return valueKind(raw[0]), raw[1:]
+}
+
+// encodeEntry 编码普通值，expiresAt不为0时编码为带过期时间的值
+func encodeEntry(value []byte, expiresAt int64) []byte {
+	if expiresAt == 0 {
+		return encodeValue(kindValue, value)
+	}
+	buf := make([]byte, 1+expiresAtLength+len(value))
+	buf[0] = byte(kindExpiringValue)
+	binary.BigEndian.PutUint64(buf[1:], uint64(expiresAt))
+	copy(buf[1+expiresAtLength:], value)
+	return buf
+}
+
+// isDeletion 是否为删除标记或单删除标记
+func isDeletion(kind valueKind) bool {
+	return kind == kindDeletion || kind == kindSingleDeletion
+}
+
+// decodeEntry 按now解析编码值：未过期的带过期时间的值返回kindValue和过期时间，已过期的返回kindDeletion
+func decodeEntry(raw []byte, now int64) (kind valueKind, value []byte, expiresAt int64) {
+	kind, value = decodeValue(raw)
+	if kind != kindExpiringValue {
+		return kind, value, 0
+	}
+	if len(value) < expiresAtLength {
+		return kindDeletion, nil, 0
+	}
+	expiresAt = int64(binary.BigEndian.Uint64(value))
+	if expiresAt <= now {
+		return kindDeletion, nil, 0
+	}
+	return kindValue, value[expiresAtLength:], expiresAt
+}
+
+// now 返回当前时间的Unix纳秒，用于判断键是否过期
+func (l *LSM) now() int64 {
+	return l.conf.Clock.Now().UnixNano()
+}
+
+// encodeOperands 编码按从旧到新排列的合并操作数，每个操作数前加上变长编码的长度
+func encodeOperands(operands [][]byte) []byte {
+	buf := []byte{byte(kindMerge)}
+	for _, operand := range operands {
+		buf = binary.AppendUvarint(buf, uint64(len(operand)))
+		buf = append(buf, operand...)
+	}
+	return buf
+}
+
+// decodeOperands 解析encodeOperands编码的操作数(不含类型字节)
+func decodeOperands(data []byte) ([][]byte, error) {
+	var operands [][]byte
+	for len(data) > 0 {
+		n, size := binary.Uvarint(data)
+		if size <= 0 || uint64(len(data)-size) < n {
+			return nil, errors.New("lsm: corrupted merge operands")
+		}
+		data = data[size:]
+		operands = append(operands, data[:n:n])
+		data = data[n:]
+	}
+	return operands, nil
+}
+
+// applyRecord 将WAL记录写入所属列族的内存表，批次记录逐条写入，已删除的列族的记录被忽略。
+// 删除记录写入删除标记，范围删除记录写入范围删除标记，合并记录与内存表中已有的值合并，
+// 与内存表中的写入相互抵消的单删除记录移除该键
+func (l *LSM) applyRecord(memtables map[uint32]*memTable, rec *wal.Record) error {
+	if rec.RecordType == wal.RecordTypeBatch {
+		records, err := rec.BatchRecords()
+		if err != nil {
+			return err
+		}
+		for _, sub := range records {
+			if err := l.applyRecord(memtables, sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	mem, ok := memtables[rec.ColumnFamily]
+	if !ok {
+		return nil
+	}
+	if rec.RecordType == wal.RecordTypeRangeDelete {
+		return mem.deleteRange(rec.Key, rec.Value)
+	}
+	entry, err := l.memtableEntry(mem.get, rec)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return mem.Delete(rec.Key)
+	}
+	return mem.Put(rec.Key, entry)
+}
+
+// memtableEntry 计算记录写入内存表后键的编码值，get读取内存表中键当前的值。内存表中已有完整的值或
+// 删除标记时直接解析合并记录，否则追加到操作数列表中，能合并的相邻操作数先用PartialMerge合并。
+// 返回nil表示单删除与内存表中的写入相互抵消，应从内存表中移除该键
+func (l *LSM) memtableEntry(get func(key []byte) ([]byte, error), rec *wal.Record) ([]byte, error) {
+	switch rec.RecordType {
+	case wal.RecordTypeDelete:
+		return encodeValue(kindDeletion, nil), nil
+	case wal.RecordTypeSingleDelete:
+		return singleDeleteEntry(get, rec.Key), nil
+	case wal.RecordTypePutWithTTL:
+		return encodeEntry(rec.Value, rec.ExpiresAt), nil
+	case wal.RecordTypeMerge:
+	default:
+		return encodeValue(kindValue, rec.Value), nil
+	}
+
+	op := l.conf.MergeOperator
+	if op == nil {
+		return nil, ErrNoMergeOperator
+	}
+	raw, err := get(rec.Key)
+	if err != nil {
+		// 内存表中没有该键，基础值在更低的层级中
+		return encodeOperands([][]byte{rec.Value}), nil
+	}
+	kind, value, expiresAt := decodeEntry(raw, l.now())
+	switch kind {
+	case kindValue:
+		return l.fullMerge(rec.Key, value, [][]byte{rec.Value}, expiresAt)
+	case kindDeletion, kindSingleDeletion:
+		return l.fullMerge(rec.Key, nil, [][]byte{rec.Value}, 0)
+	}
+	operands, err := decodeOperands(value)
+	if err != nil {
+		return nil, err
+	}
+	if merged, ok := op.PartialMerge(rec.Key, operands[len(operands)-1], rec.Value); ok {
+		operands[len(operands)-1] = merged
+	} else {
+		operands = append(operands, rec.Value)
+	}
+	return encodeOperands(operands), nil
+}
+
+// fullMerge 把按从旧到新排列的操作数作用在基础值上，返回编码后的值，结果沿用基础值的过期时间
+func (l *LSM) fullMerge(key, existing []byte, operands [][]byte, expiresAt int64) ([]byte, error) {
+	op := l.conf.MergeOperator
+	if op == nil {
+		return nil, ErrNoMergeOperator
+	}
+	value, ok := op.FullMerge(key, existing, operands)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s, key=%q", ErrMergeFailed, op.Name(), key)
+	}
+	return encodeEntry(value, expiresAt), nil
+}
+
+// resolveVersions 解析同一个键从新到旧排列的多个编码值：在第一个普通值或删除标记(包括已过期的值)处停止，
+// 把之前的操作数作用在它上面。没有找到基础值且base为false时，只用PartialMerge合并操作数，
+// 返回的仍是操作数列表；base为true表示更旧的数据中不会再有该键
+func (l *LSM) resolveVersions(key []byte, versions [][]byte, base bool) ([]byte, error) {
+	var operands [][]byte // 从新到旧
+	var existing []byte
+	var expiresAt int64
+	now := l.now()
+	for _, raw := range versions {
+		kind, value, expires := decodeEntry(raw, now)
+		if kind == kindMerge {
+			ops, err := decodeOperands(value)
+			if err != nil {
+				return nil, err
+			}
+			for i := len(ops) - 1; i >= 0; i-- {
+				operands = append(operands, ops[i])
+			}
+			continue
+		}
+		if len(operands) == 0 {
+			return raw, nil
+		}
+		if kind == kindValue {
+			existing, expiresAt = value, expires
+		}
+		base = true
+		break
+	}
+	slices.Reverse(operands)
+	if base {
+		return l.fullMerge(key, existing, operands, expiresAt)
+	}
+
+	op := l.conf.MergeOperator
+	if op == nil {
+		return nil, ErrNoMergeOperator
+	}
+	merged := operands[:1]
+	for _, operand := range operands[1:] {
+		if value, ok := op.PartialMerge(key, merged[len(merged)-1], operand); ok {
+			merged[len(merged)-1] = value
+		} else {
+			merged = append(merged, operand)
+		}
+	}
+	return encodeOperands(merged), nil
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package wal
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate 使用fallocate将文件扩展到size并分配磁盘空间，
+// 之后在该范围内写入并同步时无需再更新文件大小等元数据
+func preallocate(fp *os.File, size int64) error {
+	err := syscall.Fallocate(int(fp.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		// 文件系统不支持fallocate时退化为扩展文件大小
+		return fp.Truncate(size)
+	}
+	return err
+}
+
+// syncData 使用fdatasync只同步数据，文件大小未变化时不会写入元数据
+func syncData(fp *os.File) error {
+	return syscall.Fdatasync(int(fp.Fd()))
+}
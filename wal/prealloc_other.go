@@ -0,0 +1,14 @@
+//go:build !linux
+
+package wal
+
+import "os"
+
+// preallocate 非Linux平台不做预分配
+func preallocate(fp *os.File, size int64) error {
+	return nil
+}
+
+func syncData(fp *os.File) error {
+	return fp.Sync()
+}
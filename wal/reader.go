@@ -0,0 +1,174 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+var (
+	ErrTruncated      = errors.New("wal: truncated record")        // 记录不完整，通常是崩溃时未写完的尾部
+	ErrChecksum       = errors.New("wal: checksum mismatch")       // CRC校验失败
+	ErrRecordTooLarge = errors.New("wal: record length too large") // key或value长度超过上限
+)
+
+// CorruptionError 描述WAL中第一条损坏记录的位置和原因
+type CorruptionError struct {
+	Offset int64 // 损坏记录的起始偏移量
+	Err    error // 损坏原因
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("wal: corrupt record at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// Reader 流式读取WAL记录，内存占用只与单条记录的大小有关。兼容旧版本写入的没有日志编号和序列号的记录，
+// 其序列号为0。遇到预分配的零值区域或其他日志编号的残留记录时视为日志结束
+type Reader struct {
+	r       *bufio.Reader
+	logNum  uint32             // 期望的日志编号
+	offset  int64              // 已成功读取的记录的结束偏移量
+	header  [headerLength]byte // 头部缓冲区，复用以减少分配
+	rec     *Record            // 当前记录
+	err     error              // 第一个遇到的错误
+	current bool               // 已读到当前格式的记录，之后的旧格式记录是复用文件中的残留
+}
+
+func NewReader(r io.Reader, logNum uint32) *Reader {
+	return &Reader{r: bufio.NewReader(r), logNum: logNum}
+}
+
+// Next 读取下一条记录，读到文件末尾或遇到损坏记录时返回false
+func (r *Reader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	r.rec = nil
+
+	first, err := r.r.Peek(1)
+	if err != nil {
+		if err != io.EOF {
+			r.err = err
+		}
+		return false
+	}
+	if r.isEnd() {
+		return false
+	}
+	legacy := first[0]&recordFormatFlag == 0
+	header := r.header[:]
+	if legacy {
+		header = r.header[:legacyHeaderLength]
+	}
+
+	n, err := io.ReadFull(r.r, header)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return r.fail(ErrTruncated)
+		}
+		r.err = err
+		return false
+	}
+
+	lengths := header[len(header)-8:]
+	keyLength := binary.BigEndian.Uint32(lengths[0:4])
+	valueLength := binary.BigEndian.Uint32(lengths[4:8])
+	if keyLength > MaxKeySize || valueLength > MaxValueSize {
+		return r.fail(ErrRecordTooLarge)
+	}
+
+	body := make([]byte, int(keyLength)+int(valueLength)+crcLength)
+	m, err := io.ReadFull(r.r, body)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return r.fail(ErrTruncated)
+		}
+		r.err = err
+		return false
+	}
+
+	dataLength := int(keyLength) + int(valueLength)
+	crc := crc32.NewIEEE()
+	crc.Write(header)
+	crc.Write(body[:dataLength])
+	if crc.Sum32() != binary.BigEndian.Uint32(body[dataLength:]) {
+		// 最后一条记录校验失败说明崩溃时只写入了一部分
+		if r.atTail() {
+			return r.fail(ErrTruncated)
+		}
+		return r.fail(ErrChecksum)
+	}
+
+	rec := &Record{
+		RecordType: RecordType(header[0] &^ recordFormatFlag),
+		LogNum:     r.logNum,
+		Key:        body[:keyLength:keyLength],
+		Value:      body[keyLength:dataLength:dataLength],
+	}
+	if !legacy {
+		rec.Seq = binary.BigEndian.Uint64(header[5:13])
+		r.current = true
+	}
+	if err := rec.parsePayload(); err != nil {
+		return r.fail(err)
+	}
+	r.rec = rec
+	r.offset += int64(n + m)
+	return true
+}
+
+// isEnd 判断接下来的数据是否标志着日志的结束：预分配的零值区域、复用文件中上一个日志残留的记录，
+// 或当前格式的记录之后残留的旧格式记录
+func (r *Reader) isEnd() bool {
+	header, _ := r.r.Peek(headerLength)
+	if len(header) == 0 {
+		return true
+	}
+	if header[0]&recordFormatFlag == 0 {
+		// 旧格式记录的CRC覆盖头部，合法记录的头部和CRC不会全为零
+		return r.current || isZero(header[:min(len(header), legacyHeaderLength+crcLength)])
+	}
+	return len(header) >= 5 && binary.BigEndian.Uint32(header[1:5]) != r.logNum
+}
+
+// atTail 判断当前记录之后是否已没有属于本日志的数据
+func (r *Reader) atTail() bool {
+	return r.isEnd()
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// fail 记录损坏错误并停止读取
+func (r *Reader) fail(err error) bool {
+	r.err = &CorruptionError{Offset: r.offset, Err: err}
+	return false
+}
+
+// Record 返回当前记录
+func (r *Reader) Record() *Record {
+	return r.rec
+}
+
+// Offset 返回最后一条完好记录的结束偏移量，出错时即为损坏记录的起始偏移量
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// Err 返回读取过程中遇到的错误，正常读到末尾时为nil
+func (r *Reader) Err() error {
+	return r.err
+}
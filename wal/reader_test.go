@@ -0,0 +1,305 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"testing"
+)
+
+const testLogNum = 7
+
+func encodeRecords(t *testing.T, count int) ([]byte, []int64) {
+	buf := bytes.NewBuffer(nil)
+	offsets := make([]int64, 0, count)
+	for i := 0; i < count; i++ {
+		offsets = append(offsets, int64(buf.Len()))
+		rec := NewRecord([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%03d", i)))
+		rec.LogNum = testLogNum
+		rec.Seq = uint64(i + 1)
+		data, err := rec.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes(), offsets
+}
+
+func TestReader_Next(t *testing.T) {
+	data, _ := encodeRecords(t, 100)
+	reader := NewReader(bytes.NewReader(data), testLogNum)
+	count := 0
+	for reader.Next() {
+		rec := reader.Record()
+		if string(rec.Key) != fmt.Sprintf("key-%03d", count) {
+			t.Fatalf("key not match: %s", rec.Key)
+		}
+		if string(rec.Value) != fmt.Sprintf("value-%03d", count) {
+			t.Fatalf("value not match: %s", rec.Value)
+		}
+		if rec.Seq != uint64(count+1) {
+			t.Fatalf("seq not match: %d", rec.Seq)
+		}
+		count++
+	}
+	if err := reader.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 100 {
+		t.Fatalf("expected 100 records, got %d", count)
+	}
+	if reader.Offset() != int64(len(data)) {
+		t.Fatalf("expected offset %d, got %d", len(data), reader.Offset())
+	}
+}
+
+func TestReader_Corruption(t *testing.T) {
+	data, offsets := encodeRecords(t, 10)
+	// 破坏第5条记录的value
+	data[offsets[5]+headerLength+2] ^= 0xff
+
+	reader := NewReader(bytes.NewReader(data), testLogNum)
+	count := 0
+	for reader.Next() {
+		count++
+	}
+	if count != 5 {
+		t.Fatalf("expected 5 good records, got %d", count)
+	}
+	var corruption *CorruptionError
+	if !errors.As(reader.Err(), &corruption) {
+		t.Fatalf("expected corruption error, got %v", reader.Err())
+	}
+	if corruption.Offset != offsets[5] {
+		t.Fatalf("expected corruption at %d, got %d", offsets[5], corruption.Offset)
+	}
+	if !errors.Is(reader.Err(), ErrChecksum) {
+		t.Fatalf("expected checksum error, got %v", reader.Err())
+	}
+}
+
+func TestReader_Truncated(t *testing.T) {
+	data, offsets := encodeRecords(t, 10)
+	reader := NewReader(bytes.NewReader(data[:len(data)-3]), testLogNum)
+	count := 0
+	for reader.Next() {
+		count++
+	}
+	if count != 9 {
+		t.Fatalf("expected 9 good records, got %d", count)
+	}
+	if !errors.Is(reader.Err(), ErrTruncated) {
+		t.Fatalf("expected truncated error, got %v", reader.Err())
+	}
+	if reader.Offset() != offsets[9] {
+		t.Fatalf("expected offset %d, got %d", offsets[9], reader.Offset())
+	}
+}
+
+func TestReader_TornTail(t *testing.T) {
+	data, offsets := encodeRecords(t, 10)
+	// 最后一条记录只写入了一部分，其后是预分配的零值区域
+	for i := offsets[9] + headerLength; i < int64(len(data)); i++ {
+		data[i] = 0
+	}
+	data = append(data, make([]byte, 64)...)
+
+	reader := NewReader(bytes.NewReader(data), testLogNum)
+	count := 0
+	for reader.Next() {
+		count++
+	}
+	if count != 9 {
+		t.Fatalf("expected 9 good records, got %d", count)
+	}
+	if !errors.Is(reader.Err(), ErrTruncated) {
+		t.Fatalf("expected truncated error, got %v", reader.Err())
+	}
+}
+
+func TestReader_StaleTail(t *testing.T) {
+	stale, _ := encodeRecords(t, 10)
+	// 复用文件时新日志只覆盖了开头部分
+	rec := NewRecord([]byte("new-key"), []byte("new-value"))
+	rec.LogNum = testLogNum + 1
+	fresh, err := rec.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(fresh, stale[len(fresh):]...)
+
+	reader := NewReader(bytes.NewReader(data), testLogNum+1)
+	count := 0
+	for reader.Next() {
+		if string(reader.Record().Key) != "new-key" {
+			t.Fatalf("unexpected key: %s", reader.Record().Key)
+		}
+		count++
+	}
+	if err := reader.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 record, got %d", count)
+	}
+	if reader.Offset() != int64(len(fresh)) {
+		t.Fatalf("expected offset %d, got %d", len(fresh), reader.Offset())
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	data, _ := encodeRecords(t, 20)
+	count := 0
+	err := DecodeStream(bytes.NewReader(data), testLogNum, func(key, value []byte) error {
+		if string(key) != fmt.Sprintf("key-%03d", count) {
+			return fmt.Errorf("key not match: %s", key)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 20 {
+		t.Fatalf("expected 20 records, got %d", count)
+	}
+}
+
+func TestReader_RecordWithTTL(t *testing.T) {
+	rec := NewRecordWithTTL([]byte("session"), []byte("token"), 1234567890)
+	rec.LogNum = testLogNum
+	rec.Seq = 1
+	data, err := rec.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewReader(bytes.NewReader(data), testLogNum)
+	if !reader.Next() {
+		t.Fatalf("expected a record, err=%v", reader.Err())
+	}
+	got := reader.Record()
+	if got.RecordType != RecordTypePutWithTTL || string(got.Value) != "token" || got.ExpiresAt != 1234567890 {
+		t.Fatalf("unexpected record: %+v", got)
+	}
+
+	decoded, err := DecodeRecord(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded.Value) != "token" || decoded.ExpiresAt != 1234567890 {
+		t.Fatalf("unexpected decoded record: %+v", decoded)
+	}
+}
+
+func TestReader_BatchRecord(t *testing.T) {
+	records := []*Record{
+		NewRecord([]byte("a"), []byte("1")),
+		NewRecord([]byte("b"), nil),
+		NewRecordWithTTL([]byte("c"), []byte("3"), 42),
+		NewMergeRecord([]byte("d"), []byte("4")),
+	}
+	for i, rec := range records {
+		rec.ColumnFamily = uint32(i)
+	}
+	batch := NewBatchRecord(records)
+	batch.LogNum = testLogNum
+	batch.Seq = 9
+	data, err := batch.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewReader(bytes.NewReader(data), testLogNum)
+	if !reader.Next() {
+		t.Fatalf("expected a record, err=%v", reader.Err())
+	}
+	got, err := reader.Record().BatchRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(records) {
+		t.Fatalf("expected %d records, got %d", len(records), len(got))
+	}
+	for i, rec := range got {
+		want := records[i]
+		if rec.RecordType != want.RecordType || rec.ColumnFamily != uint32(i) || rec.Seq != 9 ||
+			string(rec.Key) != string(want.Key) || string(rec.Value) != string(want.Value) || rec.ExpiresAt != want.ExpiresAt {
+			t.Fatalf("record %d: got %+v, want %+v", i, rec, want)
+		}
+	}
+}
+
+// encodeLegacyRecord 按旧版本的格式编码记录：类型、key长度、value长度、key、value、CRC
+func encodeLegacyRecord(recordType RecordType, key, value []byte) []byte {
+	data := []byte{byte(recordType)}
+	data = binary.BigEndian.AppendUint32(data, uint32(len(key)))
+	data = binary.BigEndian.AppendUint32(data, uint32(len(value)))
+	data = append(data, key...)
+	data = append(data, value...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+}
+
+func TestReader_LegacyRecords(t *testing.T) {
+	// 旧版本写入的日志，新版本继续追加记录
+	var data []byte
+	data = append(data, encodeLegacyRecord(RecordTypePut, []byte("old-key"), []byte("old-value"))...)
+	data = append(data, encodeLegacyRecord(RecordTypeDelete, []byte("deleted"), nil)...)
+	current, _ := encodeRecords(t, 2)
+	data = append(data, current...)
+	data = append(data, make([]byte, 64)...)
+
+	reader := NewReader(bytes.NewReader(data), testLogNum)
+	var records []*Record
+	for reader.Next() {
+		records = append(records, reader.Record())
+	}
+	if err := reader.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
+	}
+	if records[0].RecordType != RecordTypePut || string(records[0].Key) != "old-key" ||
+		string(records[0].Value) != "old-value" || records[0].Seq != 0 {
+		t.Fatalf("unexpected legacy put: %+v", records[0])
+	}
+	if records[1].RecordType != RecordTypeDelete || string(records[1].Key) != "deleted" {
+		t.Fatalf("unexpected legacy delete: %+v", records[1])
+	}
+	if records[2].RecordType != RecordTypePut || records[2].Seq != 1 {
+		t.Fatalf("unexpected record: %+v", records[2])
+	}
+	if reader.Offset() != int64(len(data)-64) {
+		t.Fatalf("expected offset %d, got %d", len(data)-64, reader.Offset())
+	}
+
+	rec, err := DecodeRecord(encodeLegacyRecord(RecordTypeDelete, []byte("key"), nil))
+	if err != nil || rec.RecordType != RecordTypeDelete || string(rec.Key) != "key" {
+		t.Fatalf("rec=%+v, err=%v", rec, err)
+	}
+}
+
+func TestReader_LegacyResidue(t *testing.T) {
+	// 复用旧版本的日志文件时，新记录之后残留的旧格式记录不能被读出
+	data, _ := encodeRecords(t, 3)
+	data = append(data, encodeLegacyRecord(RecordTypePut, []byte("stale"), []byte("stale"))...)
+
+	reader := NewReader(bytes.NewReader(data), testLogNum)
+	count := 0
+	for reader.Next() {
+		if string(reader.Record().Key) == "stale" {
+			t.Fatal("stale legacy record replayed")
+		}
+		count++
+	}
+	if err := reader.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 records, got %d", count)
+	}
+}
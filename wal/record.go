@@ -7,21 +7,48 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"math"
 )
 
 // RecordType 记录类型
 type RecordType uint8
 
+// 记录类型的取值写入日志文件，已有的取值不能改变，新类型只能追加在最后
 const (
-	RecordTypePut    RecordType = iota // 写入
-	RecordTypeDelete                   // 删除
+	RecordTypePut          RecordType = iota // 写入
+	RecordTypeDelete                         // 删除
+	RecordTypeMerge                          // 合并操作数，由MergeOperator作用在已有的值上
+	RecordTypePutWithTTL                     // 带过期时间的写入，值内容前8字节为过期时间
+	RecordTypeBatch                          // 原子写入的一组记录，可以跨列族，值内容为编码后的子记录
+	RecordTypeRangeDelete                    // 范围删除，键为范围的起点，值为范围的终点(均包含)
+	RecordTypeSingleDelete                   // 单删除，只删除键唯一的一次写入，合并时与该写入相互抵消
+)
+
+const expiresAtLength = 8 // 过期时间的长度
+
+// recordFormatFlag 记录类型字节的最高位，标记带日志编号和序列号的记录格式。
+// 旧版本写入的记录没有该标记，头部只有类型、key长度和value长度
+const recordFormatFlag = 0x80
+
+const (
+	headerLength       = 1 + 4 + 8 + 4 + 4 // 类型 + 日志编号 + 序列号 + key长度 + value长度
+	legacyHeaderLength = 1 + 4 + 4         // 旧格式：类型 + key长度 + value长度
+	crcLength          = 4                 // CRC校验
+	MaxKeySize         = 10 * 1024 * 1024  // key长度上限
+	MaxValueSize       = 100 * 1024 * 1024 // value长度上限
 )
 
 // Record 记录
 type Record struct {
 	RecordType RecordType // 记录类型
+	LogNum     uint32     // 日志编号，用于区分复用文件中残留的旧记录
+	Seq        uint64     // 序列号，全局单调递增
 	Key        []byte     // 键
 	Value      []byte     // 值
+	ExpiresAt  int64      // 过期时间(Unix纳秒)，仅RecordTypePutWithTTL有效
+
+	// 列族ID，只在批次的子记录中编码，其余记录属于默认列族(ID为0)
+	ColumnFamily uint32
 }
 
 func NewRecord(key, value []byte) *Record {
@@ -31,6 +58,93 @@ func NewRecord(key, value []byte) *Record {
 	return newRecord(key, value, RecordTypePut)
 }
 
+// NewRecordWithTTL 创建带过期时间的写入记录，expiresAt为Unix纳秒
+func NewRecordWithTTL(key, value []byte, expiresAt int64) *Record {
+	if value == nil {
+		value = []byte{}
+	}
+	rec := newRecord(key, value, RecordTypePutWithTTL)
+	rec.ExpiresAt = expiresAt
+	return rec
+}
+
+// NewBatchRecord 把一组记录编码为一条批次记录，子记录保留各自的类型、列族和过期时间，共用批次的序列号
+func NewBatchRecord(records []*Record) *Record {
+	var buf []byte
+	for _, rec := range records {
+		buf = append(buf, byte(rec.RecordType))
+		buf = binary.AppendUvarint(buf, uint64(rec.ColumnFamily))
+		buf = binary.AppendUvarint(buf, uint64(len(rec.Key)))
+		buf = append(buf, rec.Key...)
+		value := rec.payload()
+		buf = binary.AppendUvarint(buf, uint64(len(value)))
+		buf = append(buf, value...)
+	}
+	return newRecord(nil, buf, RecordTypeBatch)
+}
+
+// BatchRecords 解码批次记录中的子记录
+func (r *Record) BatchRecords() ([]*Record, error) {
+	if r.RecordType != RecordTypeBatch {
+		return nil, errors.New("not a batch record")
+	}
+	var records []*Record
+	data := r.Value
+	readBytes := func() ([]byte, bool) {
+		n, size := binary.Uvarint(data)
+		if size <= 0 || uint64(len(data)-size) < n {
+			return nil, false
+		}
+		b := data[size : size+int(n) : size+int(n)]
+		data = data[size+int(n):]
+		return b, true
+	}
+	for len(data) > 0 {
+		recordType := RecordType(data[0])
+		cf, size := binary.Uvarint(data[1:])
+		if size <= 0 || cf > math.MaxUint32 {
+			return nil, errors.New("corrupted batch record")
+		}
+		data = data[1+size:]
+		key, ok := readBytes()
+		if !ok {
+			return nil, errors.New("corrupted batch record")
+		}
+		value, ok := readBytes()
+		if !ok {
+			return nil, errors.New("corrupted batch record")
+		}
+		rec := &Record{
+			RecordType:   recordType,
+			LogNum:       r.LogNum,
+			Seq:          r.Seq,
+			Key:          key,
+			Value:        value,
+			ColumnFamily: uint32(cf),
+		}
+		if err := rec.parsePayload(); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// NewMergeRecord 创建合并记录，operand为合并操作数
+func NewMergeRecord(key, operand []byte) *Record {
+	return newRecord(key, operand, RecordTypeMerge)
+}
+
+// NewRangeDeleteRecord 创建范围删除记录，删除[start, end]内的键
+func NewRangeDeleteRecord(start, end []byte) *Record {
+	return newRecord(start, end, RecordTypeRangeDelete)
+}
+
+// NewSingleDeleteRecord 创建单删除记录
+func NewSingleDeleteRecord(key []byte) *Record {
+	return newRecord(key, nil, RecordTypeSingleDelete)
+}
+
 func newRecord(key, value []byte, recordType RecordType) *Record {
 	return &Record{
 		Key:        key,
@@ -38,21 +152,51 @@ func newRecord(key, value []byte, recordType RecordType) *Record {
 		RecordType: recordType,
 	}
 }
+
+// payload 返回写入日志的值内容，带过期时间的记录在值前加上过期时间
+func (r *Record) payload() []byte {
+	if r.RecordType != RecordTypePutWithTTL {
+		return r.Value
+	}
+	payload := binary.BigEndian.AppendUint64(make([]byte, 0, expiresAtLength+len(r.Value)), uint64(r.ExpiresAt))
+	return append(payload, r.Value...)
+}
+
+// parsePayload 从日志中的值内容拆分出过期时间和值
+func (r *Record) parsePayload() error {
+	if r.RecordType != RecordTypePutWithTTL {
+		return nil
+	}
+	if len(r.Value) < expiresAtLength {
+		return errors.New("record expiration missing")
+	}
+	r.ExpiresAt = int64(binary.BigEndian.Uint64(r.Value))
+	r.Value = r.Value[expiresAtLength:]
+	return nil
+}
+
 func (r *Record) Encode() ([]byte, error) {
+	value := r.payload()
 	buf := bytes.NewBuffer(nil)
-	if err := buf.WriteByte(byte(r.RecordType)); err != nil {
+	if err := buf.WriteByte(byte(r.RecordType) | recordFormatFlag); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, r.LogNum); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, r.Seq); err != nil {
 		return nil, err
 	}
 	if err := binary.Write(buf, binary.BigEndian, uint32(len(r.Key))); err != nil {
 		return nil, err
 	}
-	if err := binary.Write(buf, binary.BigEndian, uint32(len(r.Value))); err != nil {
+	if err := binary.Write(buf, binary.BigEndian, uint32(len(value))); err != nil {
 		return nil, err
 	}
 	if _, err := buf.Write(r.Key); err != nil {
 		return nil, err
 	}
-	if _, err := buf.Write(r.Value); err != nil {
+	if _, err := buf.Write(value); err != nil {
 		return nil, err
 	}
 	crc := crc32.ChecksumIEEE(buf.Bytes())
@@ -61,100 +205,89 @@ func (r *Record) Encode() ([]byte, error) {
 	}
 	return buf.Bytes(), nil
 }
+
+// DecodeRecord 解码一条记录，兼容旧版本写入的没有日志编号和序列号的记录
 func DecodeRecord(data []byte) (*Record, error) {
-	if len(data) < 9 { // 至少需要 1 字节类型 + 4 字节 key 长度 + 4 字节 value 长度
-		return nil, errors.New("record data too short")
+	if len(data) > 0 && data[0]&recordFormatFlag == 0 {
+		return decodeLegacyRecord(data)
 	}
-
-	recordType := RecordType(data[0])
-
-	var keyLength uint32
-	if err := binary.Read(bytes.NewReader(data[1:5]), binary.BigEndian, &keyLength); err != nil {
-		return nil, err
+	if len(data) < headerLength { // 至少需要完整的头部
+		return nil, errors.New("record data too short")
 	}
 
-	var valueLength uint32
-	if err := binary.Read(bytes.NewReader(data[5:9]), binary.BigEndian, &valueLength); err != nil {
-		return nil, err
-	}
+	recordType := RecordType(data[0] &^ recordFormatFlag)
+	logNum := binary.BigEndian.Uint32(data[1:5])
+	seq := binary.BigEndian.Uint64(data[5:13])
+	keyLength := binary.BigEndian.Uint32(data[13:17])
+	valueLength := binary.BigEndian.Uint32(data[17:21])
 
 	// 验证长度合理性
-	if keyLength > 10*1024*1024 || valueLength > 100*1024*1024 {
+	if keyLength > MaxKeySize || valueLength > MaxValueSize {
 		return nil, fmt.Errorf("key or value length too large: keyLength=%d, valueLength=%d", keyLength, valueLength)
 	}
 
 	// 验证数据长度是否足够
-	expectedLength := 9 + keyLength + valueLength + 4 // header + key + value + crc
-	if uint32(len(data)) < expectedLength {
+	dataLength := headerLength + keyLength + valueLength
+	if uint32(len(data)) < dataLength+crcLength { // header + key + value + crc
 		return nil, errors.New("record data incomplete")
 	}
 
 	// 读取 key 和 value
-	key := data[9 : 9+keyLength]
-	value := data[9+keyLength : 9+keyLength+valueLength]
+	key := data[headerLength : headerLength+keyLength]
+	value := data[headerLength+keyLength : dataLength]
 
 	// 验证 CRC
-	crcData := data[9+keyLength+valueLength:]
-	var storedCrc uint32
-	if err := binary.Read(bytes.NewReader(crcData), binary.BigEndian, &storedCrc); err != nil {
-		return nil, err
-	}
-
-	// 计算 CRC
-	actualCrc := crc32.ChecksumIEEE(data[:9+keyLength+valueLength])
+	storedCrc := binary.BigEndian.Uint32(data[dataLength : dataLength+crcLength])
+	actualCrc := crc32.ChecksumIEEE(data[:dataLength])
 	if storedCrc != actualCrc {
 		return nil, errors.New("crc mismatch")
 	}
 
-	return &Record{
+	rec := &Record{
 		RecordType: recordType,
+		LogNum:     logNum,
+		Seq:        seq,
 		Key:        key,
 		Value:      value,
+	}
+	if err := rec.parsePayload(); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// decodeLegacyRecord 解码旧格式的记录：类型、key长度、value长度、key、value、CRC
+func decodeLegacyRecord(data []byte) (*Record, error) {
+	if len(data) < legacyHeaderLength {
+		return nil, errors.New("record data too short")
+	}
+	keyLength := binary.BigEndian.Uint32(data[1:5])
+	valueLength := binary.BigEndian.Uint32(data[5:9])
+	if keyLength > MaxKeySize || valueLength > MaxValueSize {
+		return nil, fmt.Errorf("key or value length too large: keyLength=%d, valueLength=%d", keyLength, valueLength)
+	}
+	dataLength := legacyHeaderLength + keyLength + valueLength
+	if uint32(len(data)) < dataLength+crcLength {
+		return nil, errors.New("record data incomplete")
+	}
+	if binary.BigEndian.Uint32(data[dataLength:dataLength+crcLength]) != crc32.ChecksumIEEE(data[:dataLength]) {
+		return nil, errors.New("crc mismatch")
+	}
+	return &Record{
+		RecordType: RecordType(data[0]),
+		Key:        data[legacyHeaderLength : legacyHeaderLength+keyLength],
+		Value:      data[legacyHeaderLength+keyLength : dataLength],
 	}, nil
 }
-func DecodeStream(r io.Reader, callback func(key, value []byte) error) error {
-	offset := 0
-	buf := make([]byte, 1+4+4)
-	for {
-		n, err := r.Read(buf)
-		if err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF || n == 0 {
-				return nil
-			}
-			return err
-		}
-		rec := &Record{}
-		// todo: 这里需要优化 recordType 的读取
-		rec.RecordType = RecordType(buf[0])
-		var keyLength uint32
-		if err := binary.Read(bytes.NewBuffer(buf[1:5]), binary.BigEndian, &keyLength); err != nil {
-			return err
-		}
-		var valueLength uint32
-		if err := binary.Read(bytes.NewBuffer(buf[5:9]), binary.BigEndian, &valueLength); err != nil {
-			return err
-		}
-		key := make([]byte, keyLength)
-		if _, err := io.ReadFull(bytes.NewBuffer(buf[9:9+keyLength]), key); err != nil {
-			return err
-		}
-		value := make([]byte, valueLength)
-		if _, err := io.ReadFull(bytes.NewBuffer(buf[9+keyLength:]), value); err != nil {
-			return err
-		}
-		var expectCrc uint32
-		if err := binary.Read(bytes.NewBuffer(buf[9+keyLength+valueLength:]), binary.BigEndian, &expectCrc); err != nil {
-			return err
-		}
-		fullData := append(buf[:], key...)
-		fullData = append(fullData, value...)
-		crc := crc32.ChecksumIEEE(fullData)
-		if crc != expectCrc {
-			return errors.New("crc mismatch")
-		}
-		if err := callback(key, value); err != nil {
+
+// DecodeStream 流式解码r中属于logNum号日志的全部记录，并对每条记录调用callback
+func DecodeStream(r io.Reader, logNum uint32, callback func(key, value []byte) error) error {
+	reader := NewReader(r, logNum)
+	for reader.Next() {
+		rec := reader.Record()
+		if err := callback(rec.Key, rec.Value); err != nil {
 			return err
 		}
-		offset += n
 	}
+	return reader.Err()
 }
@@ -1,57 +1,128 @@
 package wal
 
 import (
-	"encoding/binary"
-	"fmt"
-	"hash/crc32"
+	"errors"
 	"io"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/aixiasang/sqldb/config"
-	"github.com/aixiasang/sqldb/memtable"
+	"github.com/aixiasang/sqldb/utils"
 )
 
 type Wal struct {
-	conf     *config.Config // 配置
-	offset   uint32         // 偏移量
-	fp       *os.File       // 文件
-	mu       sync.RWMutex   // 互斥锁
-	filePath string
+	conf      *config.Config // 配置
+	logNum    uint32         // 日志编号
+	lastSeq   uint64         // 最后一条记录的序列号
+	offset    int64          // 偏移量
+	allocated int64          // 已预分配的文件大小
+	fp        *os.File       // 文件
+	mu        sync.RWMutex   // 互斥锁
+	filePath  string
 }
 
-func NewWal(conf *config.Config, filename string) (*Wal, error) {
-	fp, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+// preallocateChunk 写入超出预分配空间时每次扩展的大小
+const preallocateChunk = 1 << 20
+
+// NewWal 打开或创建logNum号WAL文件。写入从偏移量0开始，
+// 已有文件需要先调用ReadAll定位到有效数据的末尾。开启预分配时文件一次扩展到预期的日志大小
+func NewWal(conf *config.Config, filename string, logNum uint32) (*Wal, error) {
+	fp, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := fp.Stat()
 	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	w := &Wal{
+		conf:      conf,
+		logNum:    logNum,
+		allocated: fileInfo.Size(),
+		fp:        fp,
+		filePath:  filename,
+	}
+	if size := preallocateSize(conf); conf.WalPreallocate && w.allocated < size {
+		if err := preallocate(fp, size); err != nil {
+			fp.Close()
+			return nil, err
+		}
+		w.allocated = size
+	}
+	return w, nil
+}
+
+// preallocateSize 返回WAL的预期大小：日志超过内存表容量的85%时切换，内存表容量足以容纳最后一次写入
+func preallocateSize(conf *config.Config) int64 {
+	return conf.MemTableCapSize
+}
+
+// ReuseWal 将回收的WAL文件重命名为filename，作为logNum号日志从头覆盖写入。
+// 文件中残留的旧记录日志编号不同，读取时会被当作日志结尾
+func ReuseWal(conf *config.Config, recycledPath, filename string, logNum uint32) (*Wal, error) {
+	if err := os.Rename(recycledPath, filename); err != nil {
 		return nil, err
 	}
-	return &Wal{conf: conf, fp: fp, filePath: filename}, nil
+	return NewWal(conf, filename, logNum)
 }
 
-func (w *Wal) Write(key, value []byte) error {
+// Write 将记录追加到WAL，记录的日志编号由WAL填写
+func (w *Wal) Write(rec *Record) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	rec := NewRecord(key, value)
+	rec.LogNum = w.logNum
 	encoded, err := rec.Encode()
 	if err != nil {
 		return err
 	}
-	length, err := w.fp.Write(encoded)
+	if err := w.ensureSpace(int64(len(encoded))); err != nil {
+		return err
+	}
+	length, err := w.fp.WriteAt(encoded, w.offset)
 	if err != nil {
 		return err
 	}
+	w.conf.Statistics.Add(utils.TickerWalBytes, uint64(length))
 	if w.conf.AutoSync {
-		if err := w.fp.Sync(); err != nil {
+		if err := w.sync(); err != nil {
 			return err
 		}
 	}
-	w.offset += uint32(length)
+	w.offset += int64(length)
+	w.lastSeq = rec.Seq
+	return nil
+}
+
+// ensureSpace 确保文件有足够的预分配空间写入n字节。创建时已预分配预期的日志大小，
+// 超出时按固定的大块扩展，使大多数同步无需更新文件大小
+func (w *Wal) ensureSpace(n int64) error {
+	if !w.conf.WalPreallocate || w.offset+n <= w.allocated {
+		return nil
+	}
+	size := w.offset + max(preallocateChunk, n)
+	if err := preallocate(w.fp, size); err != nil {
+		return err
+	}
+	w.allocated = size
 	return nil
 }
 
 func (w *Wal) Close() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	return w.close()
+}
+
+// close 截断未使用的预分配空间并关闭文件
+func (w *Wal) close() error {
+	if w.allocated > w.offset {
+		if err := w.fp.Truncate(w.offset); err != nil {
+			return err
+		}
+		w.allocated = w.offset
+	}
 	if err := w.fp.Sync(); err != nil {
 		return err
 	}
@@ -60,119 +131,51 @@ func (w *Wal) Close() error {
 func (w *Wal) Clear() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	w.Close()
+	w.close()
 	return os.Remove(w.filePath)
 }
-func (w *Wal) ReadAll(memTable memtable.MemTable) error {
-	// 将文件指针移到开始位置
-	if _, err := w.fp.Seek(0, 0); err != nil {
-		return err
-	}
-	if w.conf.IsDebug {
-		fmt.Printf("开始从文件%s读取全部记录\n", w.filePath)
-	}
 
-	// 获取文件大小
-	fileInfo, err := w.fp.Stat()
-	if err != nil {
-		return fmt.Errorf("无法获取文件大小: %v", err)
-	}
-	fileSize := fileInfo.Size()
+// Replay 从头流式读取WAL中的全部记录，按顺序交给apply处理，apply出错时停止读取并返回该错误。
+// 末尾不完整的记录视为崩溃时未写完的追加，会被截断；其余损坏返回*CorruptionError
+func (w *Wal) Replay(apply func(rec *Record) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	// 读取整个文件
-	buffer := make([]byte, fileSize)
-	n, err := w.fp.ReadAt(buffer, 0)
-	if err != nil && err != io.EOF {
-		return fmt.Errorf("读取文件内容失败: %v", err)
-	}
-	if int64(n) < fileSize {
-		fmt.Printf("警告：仅读取了文件部分内容: %d 字节，总大小 %d 字节\n", n, fileSize)
+	// 将文件指针移到开始位置
+	if _, err := w.fp.Seek(0, io.SeekStart); err != nil {
+		return err
 	}
+	logger := w.conf.GetLogger()
 
-	// 逐条解析记录并保存最新的记录位置
-	var offset uint32 = 0
-	for offset < uint32(n) {
-		// 确保至少能读取头部
-		if offset+9 > uint32(n) {
-			fmt.Printf("文件末尾不完整，停止解析: 剩余 %d 字节\n", uint32(n)-offset)
-			break
-		}
-
-		// 读取记录类型
-		recordType := RecordType(buffer[offset])
-
-		// 读取 key 长度
-		keyLength := binary.BigEndian.Uint32(buffer[offset+1 : offset+5])
-
-		// 读取 value 长度
-		valueLength := binary.BigEndian.Uint32(buffer[offset+5 : offset+9])
-
-		// 检查 key 和 value 长度的合理性
-		if keyLength > 10*1024*1024 || valueLength > 100*1024*1024 {
-			fmt.Printf("警告: 可能的数据损坏 - key长度: %d, value长度: %d\n", keyLength, valueLength)
-			break
-		}
-
-		// 计算记录总长度
-		recordLength := 9 + keyLength + valueLength + 4
-
-		// 确保能读取完整的记录
-		if offset+recordLength > uint32(n) {
-			fmt.Printf("文件末尾记录不完整，停止解析: 需要 %d 字节，剩余 %d 字节\n",
-				recordLength, uint32(n)-offset)
-			break
+	reader := NewReader(w.fp, w.logNum)
+	for reader.Next() {
+		rec := reader.Record()
+		w.lastSeq = rec.Seq
+		if err := apply(rec); err != nil {
+			return err
 		}
+	}
 
-		// 读取 key 和 value
-		key := buffer[offset+9 : offset+9+keyLength]
-		value := buffer[offset+9+keyLength : offset+9+keyLength+valueLength]
-
-		// 读取 CRC
-		crc := binary.BigEndian.Uint32(buffer[offset+9+keyLength+valueLength : offset+recordLength])
+	// 更新WAL实例的offset以反映有效数据的实际大小
+	w.offset = reader.Offset()
 
-		// 计算CRC进行验证
-		computedCrc := crc32.ChecksumIEEE(buffer[offset : offset+9+keyLength+valueLength])
-		if crc != computedCrc {
-			fmt.Printf("警告: CRC校验失败 (offset=%d) - 存储的: %d, 计算的: %d\n",
-				offset, crc, computedCrc)
-			// 继续处理，但记录警告
-		}
-		if w.conf.IsDebug {
-			fmt.Printf("解析记录: type=%d, key=%s, keyLen=%d, valueLen=%d, offset=%d, len=%d\n",
-				recordType, string(key), keyLength, valueLength, offset, recordLength)
+	if err := reader.Err(); err != nil {
+		if !errors.Is(err, ErrTruncated) {
+			return err
 		}
-
-		// 基于记录类型处理
-		if recordType == RecordTypeDelete {
-			if w.conf.IsDebug {
-				fmt.Printf("处理删除记录: key=%s\n", string(key))
-			}
-			_ = memTable.Delete(key)
-		} else {
-			if w.conf.IsDebug {
-				fmt.Printf("处理普通记录: key=%s, value=%s\n", string(key), string(value))
-			}
-			// 关键修复: 使用当前记录在文件中的实际位置，而不是旧位置
-			if err := memTable.Put(key, value); err != nil {
-				return fmt.Errorf("更新索引失败: %v", err)
-			}
+		logger.Warn("WAL末尾记录不完整，已截断", "wal", w.logNum, "path", w.filePath, "bytes", w.offset)
+		// 截断不完整的尾部，之后的写入会重新预分配出全零的空间
+		if err := w.fp.Truncate(w.offset); err != nil {
+			return err
 		}
-
-		// 更新偏移量
-		offset += recordLength
+		w.allocated = w.offset
 	}
 
-	if w.conf.IsDebug {
-		fmt.Printf("文件%s读取完成，处理了 %d 字节\n", w.filePath, offset)
-	}
-
-	// 更新WAL实例的offset以反映文件的实际大小
-	w.offset = offset
-
+	logger.Debug("WAL读取完成", "wal", w.logNum, "bytes", w.offset, "seq", w.lastSeq)
 	return nil
 }
 
-func (w *Wal) Size() uint32 {
+func (w *Wal) Size() int64 {
 	w.mu.RLock()
 	defer w.mu.RUnlock()
 	return w.offset
@@ -181,7 +184,18 @@ func (w *Wal) Size() uint32 {
 func (w *Wal) Sync() error {
 	w.mu.RLock()
 	defer w.mu.RUnlock()
-	return w.fp.Sync()
+	return w.sync()
+}
+
+// sync 将已写入的数据持久化，并记录同步耗时
+func (w *Wal) sync() error {
+	start := time.Now()
+	if err := syncData(w.fp); err != nil {
+		return err
+	}
+	w.conf.Statistics.Add(utils.TickerWalSyncs, 1)
+	w.conf.Statistics.Record(utils.HistogramWalSyncTime, time.Since(start))
+	return nil
 }
 
 func (w *Wal) FilePath() string {
@@ -189,16 +203,65 @@ func (w *Wal) FilePath() string {
 	defer w.mu.RUnlock()
 	return w.filePath
 }
-func (w *Wal) UpdateOffset() {
+
+func (w *Wal) LogNum() uint32 {
+	return w.logNum
+}
+
+// LastSeq 返回已写入或重放的最后一条记录的序列号，没有记录时为0
+func (w *Wal) LastSeq() uint64 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.lastSeq
+}
+
+func (w *Wal) Delete() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	fileInfo, err := w.fp.Stat()
+	if err := w.fp.Sync(); err != nil {
+		return err
+	}
+	if err := w.fp.Close(); err != nil {
+		return err
+	}
+	return os.Remove(w.filePath)
+}
+
+// CopyTo 把已写入的记录复制到path并同步，不包括未使用的预分配空间
+func (w *Wal) CopyTo(path string) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	dst, err := os.Create(path)
 	if err != nil {
-		return
+		return err
 	}
-	w.offset = uint32(fileInfo.Size())
+	if _, err := io.Copy(dst, io.NewSectionReader(w.fp, 0, w.offset)); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
 }
-func (w *Wal) Delete() error {
+
+// Archive 关闭WAL并将文件移动到归档路径path，未使用的预分配空间会被截断
+func (w *Wal) Archive(path string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.filePath, path); err != nil {
+		return err
+	}
+	w.filePath = path
+	return nil
+}
+
+// Recycle 关闭WAL并将文件重命名为path留待复用，保留已预分配的空间
+func (w *Wal) Recycle(path string) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	if err := w.fp.Sync(); err != nil {
@@ -207,5 +270,9 @@ func (w *Wal) Delete() error {
 	if err := w.fp.Close(); err != nil {
 		return err
 	}
-	return os.Remove(w.fp.Name())
+	if err := os.Rename(w.filePath, path); err != nil {
+		return err
+	}
+	w.filePath = path
+	return nil
 }
@@ -0,0 +1,132 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/aixiasang/sqldb/config"
+)
+
+func TestWal_Recycle(t *testing.T) {
+	dir := t.TempDir()
+	conf := config.NewConfig()
+	conf.MemTableCapSize = 4096
+
+	w, err := NewWal(conf, filepath.Join(dir, "1.wal"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := w.Write(NewRecord([]byte(fmt.Sprintf("old-key-%03d", i)), []byte("old-value"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := w.Size()
+	recycledPath := filepath.Join(dir, "1.recycle")
+	if err := w.Recycle(recycledPath); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = ReuseWal(conf, recycledPath, filepath.Join(dir, "2.wal"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Size() != 0 {
+		t.Fatalf("expected reused wal to start at 0, got %d", w.Size())
+	}
+	for i := 0; i < 3; i++ {
+		if err := w.Write(NewRecord([]byte(fmt.Sprintf("new-key-%d", i)), []byte("new-value"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := os.Stat(w.FilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Size() < size {
+		t.Fatalf("expected recycled file to keep its space, got %d < %d", fileInfo.Size(), size)
+	}
+
+	// 模拟崩溃后重启：旧日志残留的记录不能被重放
+	reopened, err := NewWal(conf, w.FilePath(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	if err := reopened.Replay(func(rec *Record) error {
+		if string(rec.Value) != "new-value" {
+			t.Errorf("stale record replayed: %s", rec.Key)
+		}
+		count++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 records, got %d", count)
+	}
+	if reopened.Size() != w.Size() {
+		t.Fatalf("expected offset %d, got %d", w.Size(), reopened.Size())
+	}
+}
+
+func TestWal_Preallocate(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("preallocation is only implemented on linux")
+	}
+	conf := config.NewConfig()
+	conf.MemTableCapSize = 64 << 10
+	path := filepath.Join(t.TempDir(), "1.wal")
+
+	fileSize := func() int64 {
+		t.Helper()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+
+	// 创建时一次预分配预期的日志大小，写入期间文件大小不变
+	w, err := NewWal(conf, path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(); size != conf.MemTableCapSize {
+		t.Fatalf("expected preallocated size %d, got %d", conf.MemTableCapSize, size)
+	}
+	value := make([]byte, 1024)
+	for w.Size() < conf.MemTableCapSize*85/100 {
+		if err := w.Write(NewRecord([]byte("key"), value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size := fileSize(); size != conf.MemTableCapSize {
+		t.Fatalf("expected file size to stay %d, got %d", conf.MemTableCapSize, size)
+	}
+
+	// 超出预分配空间后按固定的大块扩展
+	for w.Size() <= conf.MemTableCapSize {
+		if err := w.Write(NewRecord([]byte("key"), value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recordLength := int64(headerLength + len("key") + len(value) + crcLength)
+	if size, want := fileSize(), w.Size()-recordLength+preallocateChunk; size != want {
+		t.Fatalf("expected file size %d after growth, got %d", want, size)
+	}
+
+	// 关闭时截断未使用的空间
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(); size != w.Size() {
+		t.Fatalf("expected file truncated to %d, got %d", w.Size(), size)
+	}
+}